@@ -0,0 +1,132 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+var allowCIDRs, denyCIDRs cidrList
+
+func init() {
+	flag.Var(&allowCIDRs, "allow-cidr", "A CIDR, such as 10.0.0.0/8, of the clients to serve, rejecting all others; may be repeated or comma separated")
+	flag.Var(&denyCIDRs, "deny-cidr", "A CIDR of the clients to reject, even if allowed; may be repeated or comma separated")
+}
+
+// cidrList is a flag of network prefixes, taken from each of its uses, and
+// from each comma separated item of one, as in its environment variable.  A
+// bare address is the prefix of that address alone.
+type cidrList []netip.Prefix
+
+func (c *cidrList) String() string {
+	prefixes := make([]string, len(*c))
+	for i, prefix := range *c {
+		prefixes[i] = prefix.String()
+	}
+	return strings.Join(prefixes, ",")
+}
+
+func (c *cidrList) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(item)
+			if addrErr != nil {
+				return fmt.Errorf("invalid CIDR %q", item)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		*c = append(*c, prefix.Masked())
+	}
+	return nil
+}
+
+// contains reports whether any of the prefixes contains addr
+func (c cidrList) contains(addr netip.Addr) bool {
+	for _, prefix := range c {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether a client of the given address may be served: it
+// must not be denied, and, if any are allowed, must be among them.  An
+// address that cannot be parsed is only served without an allowlist.
+func (p *PollenServer) allowed(clientAddr string) bool {
+	host, _, err := net.SplitHostPort(clientAddr)
+	if err != nil {
+		host = clientAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return len(p.allowCIDRs) == 0 && len(p.denyCIDRs) == 0
+	}
+	addr = addr.Unmap()
+	if p.denyCIDRs.contains(addr) {
+		return false
+	}
+	return len(p.allowCIDRs) == 0 || p.allowCIDRs.contains(addr)
+}
+
+// filterClients refuses clients outside -allow-cidr, or inside -deny-cidr,
+// with 403 Forbidden, by their address as ClientIP extracts it.
+func (p *PollenServer) filterClients(h http.Handler) http.Handler {
+	if len(p.allowCIDRs) == 0 && len(p.denyCIDRs) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !p.allowed(p.clientIP(r)) {
+			p.log.ErrKV("Client address not allowed", "remote_addr", p.clientIP(r), "user_agent", r.UserAgent(), "path", r.URL.Path, "at", time.Now().UnixNano())
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// errClientNotAllowed refuses a client outside -allow-cidr, or inside
+// -deny-cidr
+var errClientNotAllowed = errors.New("Forbidden")
+
+// admit checks a client of the binary protocol or DNS, by its address, as
+// filterClients and limitRate check HTTP clients, logging a refusal, so that
+// no path to a seed bypasses the allowlist or the rate limit.
+func (p *PollenServer) admit(clientAddr, protocol string) error {
+	if (len(p.allowCIDRs) > 0 || len(p.denyCIDRs) > 0) && !p.allowed(clientAddr) {
+		p.log.ErrKV("Client address not allowed", "remote_addr", clientAddr, "protocol", protocol, "at", time.Now().UnixNano())
+		return errClientNotAllowed
+	}
+	if p.overRateLimit(clientAddr) {
+		p.log.InfoKV("Client over rate limit", "remote_addr", clientAddr, "protocol", protocol, "at", time.Now().UnixNano())
+		return errRateLimited
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestClientCIDRs tests that denied clients, and those outside the
+// allowlist, are refused, while allowed clients are served
+func TestClientCIDRs(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+	s.pollen.ClientIP = headerClientIP("X-Forwarded-For")
+	if err := s.pollen.allowCIDRs.Set("192.0.2.0/24, 2001:db8::/32"); err != nil {
+		t.Fatal("cannot set -allow-cidr:", err)
+	}
+	if err := s.pollen.denyCIDRs.Set("192.0.2.66"); err != nil {
+		t.Fatal("cannot set -deny-cidr:", err)
+	}
+	s.Config.Handler = s.pollen.mux()
+
+	for _, tc := range []struct {
+		addr string
+		code int
+	}{
+		{"192.0.2.1", http.StatusOK},
+		{"2001:db8::1", http.StatusOK},
+		{"192.0.2.66", http.StatusForbidden},
+		{"198.51.100.1", http.StatusForbidden},
+		{"not an address", http.StatusForbidden},
+	} {
+		req, _ := http.NewRequest("GET", s.URL+"?challenge=xxx", nil)
+		req.Header.Set("X-Forwarded-For", tc.addr)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("http client error:", err)
+		}
+		res.Body.Close()
+		s.Assert(res.StatusCode == tc.code, tc.addr, "expected", tc.code, "got:", res.Status)
+	}
+	denied := 0
+	for _, log := range s.logger.Logs() {
+		if log.severity == "err" {
+			denied++
+		}
+	}
+	s.Assert(denied == 3, "expected an err log message for each refused client, got:", s.logger.Logs())
+
+	var bad cidrList
+	if err := bad.Set("10.0.0.0/33"); err == nil {
+		t.Error("expected an invalid CIDR to be refused")
+	}
+}
+
+// TestDeniedClientOtherProtocols tests that a denied client is refused over
+// pollen/1 and DNS, as over HTTP
+func TestDeniedClientOtherProtocols(t *testing.T) {
+	s := NewSuiteWithDev(t, bytes.NewBufferString(DilbertRandom))
+	defer s.TearDown()
+	if err := s.pollen.denyCIDRs.Set("127.0.0.1"); err != nil {
+		t.Fatal("cannot set -deny-cidr:", err)
+	}
+	server := httptest.NewUnstartedServer(s.pollen.mux())
+	s.pollen.configureALPN(server.Config)
+	server.TLS = newTLSConfig(false)
+	server.StartTLS()
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "example.com", NextProtos: []string{pollenProto}})
+	if err != nil {
+		t.Fatal("tls error:", err)
+	}
+	defer conn.Close()
+	_, err = conn.Write(appendFrame(nil, []byte("pork chop sandwiches")))
+	s.Assert(err == nil, "write error:", err)
+	status := make([]byte, 1)
+	_, err = conn.Read(status)
+	s.Assert(err == nil && status[0] == pollenProtoError, "expected failure, got:", status, err)
+	reason, err := readFrame(conn)
+	s.Assert(err == nil && string(reason) == "Forbidden", "unexpected reason:", string(reason), err)
+	_, err = conn.Read(status)
+	s.Assert(err != nil, "expected the connection closed")
+
+	name := strings.ToLower(dnsChallengeEncoding.EncodeToString([]byte("pork chop sandwiches"))) + ".entropy.pollen"
+	query := DNSQuery(7, name)
+	resp, err := s.pollen.answerDNS(context.Background(), query, "entropy.pollen", "127.0.0.1:5353")
+	s.Assert(err == nil, "answer error:", err)
+	rcode, txt := DNSTXT(t, query, resp)
+	s.Assert(rcode == dnsRcodeRefused && txt == "", "expected REFUSED, got:", rcode, txt)
+	s.Assert(s.pollen.metrics.deviceReadSeconds.count.Load() == 0, "expected the device unread")
+}
@@ -0,0 +1,136 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha512"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// maxReseedBytes bounds the bytes one /admin/reseed request may write
+const maxReseedBytes = 1 << 16
+
+// authorized checks the request carries the admin token as a bearer token,
+// writing the error response if not.  Without an admin token configured,
+// the admin endpoints do not exist.
+func (p *PollenServer) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if p.adminToken == "" {
+		http.NotFound(w, r)
+		return false
+	}
+	token := []byte("Bearer " + p.adminToken)
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), token) != 1 {
+		p.log.Err(fmt.Sprintf("Unauthorized admin request to [%s] from [%s, %s] at [%v]", r.URL.Path, p.clientIP(r), r.UserAgent(), time.Now().UnixNano()))
+		w.Header().Set("WWW-Authenticate", `Bearer realm="pollen"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// serveReseed writes the posted bytes straight to the random device, for
+// operators stirring in externally gathered entropy
+func (p *PollenServer) serveReseed(w http.ResponseWriter, r *http.Request) {
+	if !p.authorized(w, r) {
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxReseedBytes+1))
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	if len(data) > maxReseedBytes {
+		http.Error(w, fmt.Sprintf("At most %d bytes may be reseeded at once", maxReseedBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	n, err := p.randomSource.Write(data)
+	if err != nil {
+		p.log.Err(fmt.Sprintf("Cannot write to random device at [%v]", time.Now().UnixNano()))
+		http.Error(w, "Failed to write to random device", http.StatusInternalServerError)
+		return
+	}
+	p.log.Info(fmt.Sprintf("Server reseeded [%d] bytes from [%s, %s] at [%v]", n, p.clientIP(r), r.UserAgent(), time.Now().UnixNano()))
+	fmt.Fprintf(w, "%d\n", n)
+}
+
+// serveDrain takes the server out of rotation on a POST, making /ready
+// fail while requests, and existing connections, are still served, so that
+// it may be shut down once the load balancer has moved on.  A DELETE puts
+// it back into rotation.
+func (p *PollenServer) serveDrain(w http.ResponseWriter, r *http.Request) {
+	if !p.authorized(w, r) {
+		return
+	}
+	switch r.Method {
+	case "POST":
+		p.draining.Store(true)
+		p.log.InfoKV("Server draining, as asked", "remote_addr", p.clientIP(r), "user_agent", r.UserAgent(), "at", time.Now().UnixNano())
+		fmt.Fprintln(w, "draining")
+	case "DELETE":
+		p.draining.Store(false)
+		p.log.InfoKV("Server no longer draining, as asked", "remote_addr", p.clientIP(r), "user_agent", r.UserAgent(), "at", time.Now().UnixNano())
+		fmt.Fprintln(w, "ready")
+	default:
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveDebugRaw responds with the hash of device bytes alone, for operators
+// checking the device's output offline.  The bytes are read straight from
+// the device, so that neither the challenge, the domain tag nor the HMAC key
+// is mixed in, and the hash never enters the seed repeat check.  It exists
+// only with -enable-debug-endpoints, and requires the admin token.
+func (p *PollenServer) serveDebugRaw(w http.ResponseWriter, r *http.Request) {
+	if !p.debugEndpoints {
+		http.NotFound(w, r)
+		return
+	}
+	if !p.authorized(w, r) {
+		return
+	}
+	ctx := r.Context()
+	if p.deviceReadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.deviceReadTimeout)
+		defer cancel()
+	}
+	data := make([]byte, p.readSize)
+	if err := readAll(ctx, p.randomSource, [][]byte{data}); err != nil {
+		p.log.ErrKV("Cannot read from random device", "reason", err, "at", time.Now().UnixNano())
+		http.Error(w, "Failed to read from random device", http.StatusInternalServerError)
+		return
+	}
+	p.log.InfoKV("Server sent raw device hash", "remote_addr", p.clientIP(r), "user_agent", r.UserAgent(), "at", time.Now().UnixNano())
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "%x\n", sha512.Sum512(data))
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const TestAdminToken = "pork-chop-sandwiches"
+
+// PostAdmin posts the body to an admin endpoint with the given token
+func (s *Suite) PostAdmin(path, token, body string) *http.Response {
+	req, err := http.NewRequest("POST", s.URL+path, strings.NewReader(body))
+	s.Assert(err == nil, "request error:", err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		s.t.Fatal("http client error:", err)
+	}
+	return res
+}
+
+// TestReseed tests that reseeding writes the posted bytes to the random device
+func TestReseed(t *testing.T) {
+	b := bytes.NewBufferString(DilbertRandom)
+	s := NewSuiteWithDev(t, b)
+	defer s.TearDown()
+
+	s.pollen.adminToken = TestAdminToken
+	res := s.PostAdmin("/admin/reseed", TestAdminToken, "the bassomatic '76")
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	s.Assert(res.StatusCode == http.StatusOK, "didn't get OK, got:", res.Status)
+	s.Assert(string(body) == "18\n", "expected 18 bytes written, got:", string(body))
+	s.Assert(b.String() == DilbertRandom+"the bassomatic '76", "expected the bytes written, got:", b.String())
+}
+
+// TestReseedUnauthorized tests that reseeding requires the admin token
+func TestReseedUnauthorized(t *testing.T) {
+	b := bytes.NewBufferString(DilbertRandom)
+	s := NewSuiteWithDev(t, b)
+	defer s.TearDown()
+
+	res := s.PostAdmin("/admin/reseed", "", "the bassomatic '76")
+	res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusNotFound, "expected Not Found without an admin token, got:", res.Status)
+	s.pollen.adminToken = TestAdminToken
+	for _, token := range []string{"", "the-wrong-token"} {
+		res = s.PostAdmin("/admin/reseed", token, "the bassomatic '76")
+		res.Body.Close()
+		s.Assert(res.StatusCode == http.StatusUnauthorized, "didn't get Unauthorized, got:", res.Status)
+	}
+	s.Assert(b.String() == DilbertRandom, "random device was written to")
+}
+
+// TestReseedTooLarge tests that reseeding is bounded
+func TestReseedTooLarge(t *testing.T) {
+	b := bytes.NewBufferString(DilbertRandom)
+	s := NewSuiteWithDev(t, b)
+	defer s.TearDown()
+
+	s.pollen.adminToken = TestAdminToken
+	res := s.PostAdmin("/admin/reseed", TestAdminToken, strings.Repeat("9", maxReseedBytes+1))
+	res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusRequestEntityTooLarge, "didn't get Request Entity Too Large, got:", res.Status)
+	s.Assert(b.String() == DilbertRandom, "random device was written to")
+}
+
+// TestDebugRaw tests that /debug/raw hashes the device bytes alone, for admins
+func TestDebugRaw(t *testing.T) {
+	s := NewSuiteWithDev(t, bytes.NewBufferString(DilbertRandom))
+	defer s.TearDown()
+	s.pollen.adminToken = TestAdminToken
+
+	res := s.PostAdmin("/debug/raw", TestAdminToken, "")
+	res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusNotFound, "expected Not Found without -enable-debug-endpoints, got:", res.Status)
+	s.pollen.debugEndpoints = true
+	res = s.PostAdmin("/debug/raw", "", "")
+	res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusUnauthorized, "expected Unauthorized without the token, got:", res.Status)
+	res = s.PostAdmin("/debug/raw", TestAdminToken, "")
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	s.Assert(err == nil, "read error:", err)
+	s.Assert(string(body) == DilbertRandomSHA1+"\n", "expected:", DilbertRandomSHA1, "got:", string(body))
+}
+
+// TestDebugRawUnmixed tests that /debug/raw hashes the device bytes alone,
+// whatever else the seeds mix in, and leaves the seed repeat check alone
+func TestDebugRawUnmixed(t *testing.T) {
+	s := NewSuiteWithDev(t, bytes.NewBufferString(DilbertRandom+DilbertRandom))
+	defer s.TearDown()
+	s.pollen.adminToken = TestAdminToken
+	s.pollen.debugEndpoints = true
+	s.pollen.domainTag = "tenant-a"
+	key := []byte("a rather secret key")
+	s.pollen.hmacKey.Store(&key)
+	s.pollen.recentSeeds = newLRU(16)
+
+	want := fmt.Sprintf("%x\n", sha512.Sum512([]byte(DilbertRandom)))
+	for i := 0; i < 2; i++ {
+		res := s.PostAdmin("/debug/raw", TestAdminToken, "")
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		s.Assert(err == nil && res.StatusCode == http.StatusOK, "unexpected response:", res.Status, err)
+		s.Assert(string(body) == want, "expected the hash of the device bytes:", want, "got:", string(body))
+	}
+}
+
+// TestDrain tests that draining fails /ready while / still serves
+func TestDrain(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+	s.pollen.adminToken = TestAdminToken
+
+	res := s.PostAdmin("/admin/drain", "the-wrong-token", "")
+	res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusUnauthorized, "didn't get Unauthorized, got:", res.Status)
+	s.Assert(s.ReadyStatus() == http.StatusOK, "expected ready before draining")
+	res = s.PostAdmin("/admin/drain", TestAdminToken, "")
+	res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusOK, "didn't get OK, got:", res.Status)
+	s.Assert(s.ReadyStatus() == http.StatusServiceUnavailable, "expected not ready while draining")
+
+	res, err := http.Get(s.URL + "?challenge=xxx")
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	chal, seed, err := ReadResp(res.Body)
+	s.Assert(err == nil, "response error:", err)
+	s.SanityCheck(chal, seed)
+}
+
+// TestRotateHMAC tests that rotating the HMAC key changes the seeds, but not
+// the challenge responses
+func TestRotateHMAC(t *testing.T) {
+	s := NewSuiteWithDev(t, &RepeatingReader{pattern: DilbertRandom})
+	defer s.TearDown()
+	s.pollen.adminToken = TestAdminToken
+	keyFile := filepath.Join(t.TempDir(), "hmac.key")
+	if err := os.WriteFile(keyFile, []byte("first key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s.pollen.hmacKeyFile = keyFile
+
+	seed := func() string {
+		res, err := http.Get(s.URL + "?challenge=pork+chop+sandwiches")
+		if err != nil {
+			t.Fatal("http client error:", err)
+		}
+		defer res.Body.Close()
+		chal, seed, err := ReadResp(res.Body)
+		s.Assert(err == nil, "response error:", err)
+		s.Assert(chal == PorkChopSha512, "expected:", PorkChopSha512, "got:", chal)
+		return seed
+	}
+	_, plain := mix("pork chop sandwiches", []byte(DilbertRandom))
+	s.Assert(seed() == hex.EncodeToString(plain), "expected an unkeyed seed before any key")
+
+	seen := map[string]bool{hex.EncodeToString(plain): true}
+	for _, body := range []string{"", "second key"} {
+		res := s.PostAdmin("/admin/rotate-hmac", TestAdminToken, body)
+		res.Body.Close()
+		s.Assert(res.StatusCode == http.StatusNoContent, "didn't get No Content, got:", res.Status)
+		key := "first key"
+		if body != "" {
+			key = body
+		}
+		mac := hmac.New(sha512.New, []byte(key))
+		mac.Write(plain)
+		keyed := seed()
+		s.Assert(keyed == hex.EncodeToString(mac.Sum(nil)), "expected the seed keyed with", key, "got:", keyed)
+		s.Assert(!seen[keyed], "expected the seed to change with the key")
+		seen[keyed] = true
+	}
+	res := s.PostAdmin("/admin/rotate-hmac", "the-wrong-token", "third key")
+	res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusUnauthorized, "didn't get Unauthorized, got:", res.Status)
+}
@@ -0,0 +1,136 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// pollenProto is the ALPN identifier of the binary protocol.  Each request
+// is a challenge, and each response a status byte, 0 for success followed
+// by the challenge response and the seed, or 1 for failure followed by the
+// reason; every field is prefixed by its length as a big endian uint16.
+const pollenProto = "pollen/1"
+
+const (
+	pollenProtoOK    = 0
+	pollenProtoError = 1
+)
+
+// configureALPN has server speak the binary protocol to TLS clients that
+// negotiate pollenProto, keeping HTTP/1.1 and h2 for everyone else.
+func (p *PollenServer) configureALPN(server *http.Server) {
+	server.Protocols = new(http.Protocols)
+	server.Protocols.SetHTTP1(true)
+	/* Setting TLSNextProto alone would turn off h2 */
+	server.Protocols.SetHTTP2(true)
+	server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){
+		pollenProto: func(_ *http.Server, conn *tls.Conn, _ http.Handler) {
+			p.servePollenProto(conn)
+		},
+	}
+}
+
+// servePollenProto answers the challenges sent on conn until it closes,
+// idles for 10 seconds, or fails
+func (p *PollenServer) servePollenProto(conn *tls.Conn) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	state := conn.ConnectionState()
+	binding, err := p.sessionBinding(&state)
+	if err != nil {
+		p.log.ErrKV("Cannot export TLS keying material", "remote_addr", conn.RemoteAddr().String(), "protocol", pollenProto, "error", err, "at", time.Now().UnixNano())
+		return
+	}
+	for {
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		challenge, err := readFrame(conn)
+		if err != nil {
+			return
+		}
+		if err := p.admit(conn.RemoteAddr().String(), pollenProto); err != nil {
+			/* A denied client is done, while a limited one may try again */
+			if _, writeErr := conn.Write(appendFrame([]byte{pollenProtoError}, []byte(err.Error()))); writeErr != nil || err == errClientNotAllowed {
+				return
+			}
+			continue
+		}
+		reply, err := p.answerPollenProto(ctx, string(challenge), binding, conn.RemoteAddr().String())
+		if err != nil {
+			reply = appendFrame([]byte{pollenProtoError}, []byte(err.Error()))
+		}
+		if _, err := conn.Write(reply); err != nil {
+			return
+		}
+	}
+}
+
+// answerPollenProto returns the successful reply to a challenge, just as a
+// request to / is answered, with binding mixed into the seed
+func (p *PollenServer) answerPollenProto(ctx context.Context, challenge string, binding []byte, remoteAddr string) ([]byte, error) {
+	if p.maxChallengeBytes > 0 && len(challenge) > p.maxChallengeBytes {
+		return nil, fmt.Errorf("The challenge must be at most %d bytes", p.maxChallengeBytes)
+	}
+	challenge, err := p.checkChallenge(challenge)
+	if err != nil {
+		return nil, err
+	}
+	checksum := p.hashChallenge(challenge)
+	challengeResponse := checksum.Sum(nil)
+	checksum.Write(binding)
+	p.stir(challengeResponse, remoteAddr)
+	if p.audit != nil && p.audit.record(challengeResponse) {
+		p.metrics.duplicateChallenges.Add(1)
+	}
+	p.log.InfoKV("Server received challenge", "remote_addr", remoteAddr, "protocol", pollenProto, "at", time.Now().UnixNano())
+	seed, err := p.readSeed(ctx, checksum)
+	if err != nil {
+		p.log.ErrKV("Cannot read from random device", "at", time.Now().UnixNano())
+		return nil, fmt.Errorf("Failed to read from random device")
+	}
+	p.log.InfoKV("Server sent response", "remote_addr", remoteAddr, "protocol", pollenProto, "at", time.Now().UnixNano())
+	return appendFrame(appendFrame([]byte{pollenProtoOK}, challengeResponse), seed), nil
+}
+
+// readFrame reads a field prefixed by its length
+func readFrame(r io.Reader) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	frame := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// appendFrame appends a field prefixed by its length, which must fit a uint16
+func appendFrame(b, frame []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(frame)))
+	return append(b, frame...)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestPollenProto tests the ALPN handshake and binary exchange of pollen/1
+func TestPollenProto(t *testing.T) {
+	s := NewSuiteWithDev(t, bytes.NewBufferString(DilbertRandom))
+	defer s.TearDown()
+	server := httptest.NewUnstartedServer(s.pollen.mux())
+	s.pollen.configureALPN(server.Config)
+	server.TLS = newTLSConfig(false)
+	server.StartTLS()
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "example.com", NextProtos: []string{pollenProto}})
+	if err != nil {
+		t.Fatal("tls error:", err)
+	}
+	defer conn.Close()
+	s.Assert(conn.ConnectionState().NegotiatedProtocol == pollenProto, "expected", pollenProto, "got:", conn.ConnectionState().NegotiatedProtocol)
+
+	_, err = conn.Write(appendFrame(nil, []byte("pork chop sandwiches")))
+	s.Assert(err == nil, "write error:", err)
+	status := make([]byte, 1)
+	_, err = conn.Read(status)
+	s.Assert(err == nil && status[0] == pollenProtoOK, "expected success, got:", status, err)
+	chal, err := readFrame(conn)
+	s.Assert(err == nil, "read error:", err)
+	seed, err := readFrame(conn)
+	s.Assert(err == nil, "read error:", err)
+	s.Assert(fmt.Sprintf("%x", chal) == PorkChopSha512, "expected:", PorkChopSha512, "got:", chal)
+	s.Assert(bytes.Equal(seed, cannedSeed()), "expected:", cannedSeed(), "got:", seed)
+
+	/* The connection carries on after a failure */
+	_, err = conn.Write(appendFrame(nil, nil))
+	s.Assert(err == nil, "write error:", err)
+	_, err = conn.Read(status)
+	s.Assert(err == nil && status[0] == pollenProtoError, "expected failure, got:", status, err)
+	reason, err := readFrame(conn)
+	s.Assert(err == nil && strings.HasPrefix(string(reason), "Please use the pollinate client"), "unexpected reason:", string(reason), err)
+}
+
+// TestPollenProtoKeepsHTTP tests that clients not asking for pollen/1 still get HTTP
+func TestPollenProtoKeepsHTTP(t *testing.T) {
+	s := NewSuiteWithDev(t, bytes.NewBufferString(DilbertRandom))
+	defer s.TearDown()
+	server := httptest.NewUnstartedServer(s.pollen.mux())
+	s.pollen.configureALPN(server.Config)
+	server.TLS = newTLSConfig(false)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	res, err := server.Client().Get(server.URL + "?challenge=pork+chop+sandwiches")
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	s.Assert(res.ProtoMajor == 2, "expected h2, got:", res.Proto)
+	chal, _, err := ReadResp(res.Body)
+	s.Assert(err == nil, "response error:", err)
+	s.Assert(chal == PorkChopSha512, "expected:", PorkChopSha512, "got:", chal)
+}
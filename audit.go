@@ -0,0 +1,52 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// auditLog records the hash of each challenge, never the challenge itself,
+// with how many times it has recently been seen, to spot replays.
+type auditLog struct {
+	mu     sync.Mutex
+	w      io.Writer
+	recent *lru
+}
+
+func newAuditLog(w io.Writer, size int) *auditLog {
+	return &auditLog{w: w, recent: newLRU(size)}
+}
+
+// record logs the challenge response, returning whether it is a duplicate
+// of a recent one
+func (a *auditLog) record(challengeResponse []byte) bool {
+	count := a.recent.see(string(challengeResponse))
+	if a.w != nil {
+		a.mu.Lock()
+		fmt.Fprintf(a.w, "%v %x %d\n", time.Now().UnixNano(), challengeResponse, count)
+		a.mu.Unlock()
+	}
+	return count > 1
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestDuplicateChallenges tests that replayed challenges are counted and audited
+func TestDuplicateChallenges(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+
+	var audit bytes.Buffer
+	s.pollen.audit = newAuditLog(&audit, 16)
+	seeds := make(map[string]bool)
+	for i := 0; i < UniqueChainRounds; i++ {
+		res, err := http.Get(s.URL + "?challenge=" + url.QueryEscape("the bassomatic '76"))
+		s.Assert(err == nil, "http client error:", err)
+		_, seed, err := ReadResp(res.Body)
+		res.Body.Close()
+		s.Assert(err == nil, "response error:", err)
+		seeds[seed] = true
+	}
+	s.Assert(len(seeds) == UniqueChainRounds, "non-unique seed response")
+	s.Assert(s.Stats()["duplicate_challenge_total"] == UniqueChainRounds-1, "expected", UniqueChainRounds-1, "duplicates, got:", s.Stats())
+	s.Assert(strings.Contains(s.Metrics(), fmt.Sprintf("\npollen_duplicate_challenge_total %d\n", UniqueChainRounds-1)), "missing metric:", s.Metrics())
+
+	scanner := bufio.NewScanner(&audit)
+	lines := 0
+	for scanner.Scan() {
+		lines++
+		fields := strings.Fields(scanner.Text())
+		s.Assert(len(fields) == 3, "malformed audit line:", scanner.Text())
+		s.Assert(fields[2] == fmt.Sprint(lines), "expected count", lines, "got:", fields[2])
+		s.Assert(!strings.Contains(scanner.Text(), "bassomatic"), "audit log contains the challenge")
+	}
+	s.Assert(lines == UniqueChainRounds, "expected", UniqueChainRounds, "audit lines, got:", lines)
+}
+
+// TestLRUEvicts tests that the least recently seen key is forgotten first
+func TestLRUEvicts(t *testing.T) {
+	l := newLRU(2)
+	l.see("a")
+	l.see("b")
+	l.see("a")
+	l.see("c")
+	if count := l.see("a"); count != 3 {
+		t.Error("expected a to be remembered 3 times, got:", count)
+	}
+	if count := l.see("b"); count != 1 {
+		t.Error("expected b to be forgotten, got:", count)
+	}
+}
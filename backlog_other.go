@@ -0,0 +1,33 @@
+//go:build !linux
+
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"net"
+)
+
+// listenWithBacklog cannot set the backlog off Linux, so takes the default
+func listenWithBacklog(addr string, backlog int, reusePort bool) (net.Listener, error) {
+	return listenConfig(reusePort).Listen(context.Background(), "tcp", addr)
+}
@@ -0,0 +1,129 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"time"
+)
+
+// maxBatchBodyBytes bounds the JSON body of a /batch request
+const maxBatchBodyBytes = 1 << 20
+
+// batchResponse answers one challenge of a batch
+type batchResponse struct {
+	ChallengeResponse string `json:"challenge_response"`
+	Seed              string `json:"seed"`
+}
+
+// serveBatch answers a JSON array of up to maxBatch challenges with an array
+// of responses, in the same order, from a single read of the device.  Each
+// challenge is mixed with its own slice of that read, so that no two seeds
+// share device bytes.
+func (p *PollenServer) serveBatch(w http.ResponseWriter, r *http.Request) {
+	p.metrics.activeConnections.Add(1)
+	defer p.metrics.activeConnections.Add(-1)
+	requestID := p.requestID()
+	w.Header().Set("X-Request-Id", requestID)
+	w.Header().Set("X-Pollen-Hash", hashName)
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "A batch must be POSTed as a JSON array of challenges", http.StatusMethodNotAllowed)
+		return
+	}
+	if p.userAgent != nil && !p.userAgent.MatchString(r.UserAgent()) {
+		http.Error(w, usePollinateError, http.StatusBadRequest)
+		return
+	}
+	var challenges []string
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBodyBytes)).Decode(&challenges)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("A batch must be at most %d bytes", maxBatchBodyBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil || len(challenges) == 0 {
+		http.Error(w, "A batch must be a JSON array of challenges", http.StatusBadRequest)
+		return
+	}
+	if len(challenges) > p.maxBatch {
+		http.Error(w, fmt.Sprintf("A batch must have at most %d challenges", p.maxBatch), http.StatusBadRequest)
+		return
+	}
+	if p.maxBatchBytes > 0 && len(challenges)*p.readSize > p.maxBatchBytes {
+		/* However many challenges are allowed, the device read stays bounded */
+		http.Error(w, fmt.Sprintf("A batch must read at most %d bytes, %d per challenge", p.maxBatchBytes, p.readSize), http.StatusBadRequest)
+		return
+	}
+	binding, err := p.sessionBinding(r.TLS)
+	if err != nil {
+		p.log.ErrKV("Cannot export TLS keying material", "remote_addr", p.clientIP(r), "request_id", requestID, "error", err, "at", time.Now().UnixNano())
+		http.Error(w, "Cannot bind the seed to the TLS session", http.StatusInternalServerError)
+		return
+	}
+	responses := make([]batchResponse, len(challenges))
+	checksums := make([]hash.Hash, len(challenges))
+	for i, challenge := range challenges {
+		if p.maxChallengeBytes > 0 && len(challenge) > p.maxChallengeBytes {
+			http.Error(w, fmt.Sprintf("Challenge %d must be at most %d bytes", i, p.maxChallengeBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+		challenge, err := p.checkChallenge(challenge)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Challenge %d: %s", i, err), http.StatusBadRequest)
+			return
+		}
+		checksums[i] = p.hashChallenge(challenge)
+		challengeResponse := checksums[i].Sum(nil)
+		checksums[i].Write(binding)
+		p.stir(challengeResponse, p.clientIP(r))
+		if p.audit != nil && p.audit.record(challengeResponse) {
+			p.metrics.duplicateChallenges.Add(1)
+		}
+		responses[i].ChallengeResponse = p.hexText(challengeResponse)
+	}
+	p.log.InfoKV("Server received batch", "remote_addr", p.clientIP(r), "user_agent", r.UserAgent(), "request_id", requestID, "challenges", len(challenges), "at", time.Now().UnixNano())
+	bufs, release, err := p.readSources(r.Context(), len(challenges)*p.readSize)
+	if err == nil {
+		defer release()
+		for i := range challenges {
+			/* Challenge i takes the ith slice of every source */
+			var seed []byte
+			if seed, err = p.mixSeed(checksums[i], sliceSources(bufs, i, p.readSize), nil); err != nil {
+				break
+			}
+			responses[i].Seed = p.hexText(seed)
+		}
+	}
+	if err != nil {
+		p.writeSeedError(w, r, requestID, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	body, _ := json.Marshal(responses)
+	p.writeResponse(w, r, requestID, append(body, '\n'))
+	p.log.InfoKV("Server sent batch", "remote_addr", p.clientIP(r), "request_id", requestID, "challenges", len(challenges), "at", time.Now().UnixNano())
+}
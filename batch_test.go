@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestBatch tests that each challenge of a batch is answered with its own
+// slice of a single device read
+func TestBatch(t *testing.T) {
+	s := NewSuiteWithDev(t, &counterSource{})
+	defer s.TearDown()
+	s.pollen.maxBatch = 4
+
+	challenges := []string{"pork chop sandwiches", "xxx", "xxx"}
+	body, _ := json.Marshal(challenges)
+	res, err := http.Post(s.URL+"/batch", "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatal("http client error:", err)
+	}
+	defer res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusOK, "expected 200, got:", res.Status)
+	var responses []batchResponse
+	if err := json.NewDecoder(res.Body).Decode(&responses); err != nil {
+		t.Fatal("cannot decode batch:", err)
+	}
+	if len(responses) != len(challenges) {
+		t.Fatal("expected", len(challenges), "responses, got:", responses)
+	}
+	device := make([]byte, len(challenges)*64)
+	(&counterSource{}).Read(device)
+	seen := map[string]bool{}
+	for i, challenge := range challenges {
+		challengeResponse, seed := mix(challenge, device[i*64:(i+1)*64])
+		s.Assert(responses[i].ChallengeResponse == hex.EncodeToString(challengeResponse), "challenge", i, "unexpected challenge response:", responses[i])
+		s.Assert(responses[i].Seed == hex.EncodeToString(seed), "challenge", i, "unexpected seed:", responses[i])
+		s.Assert(!seen[responses[i].Seed], "challenge", i, "repeats a seed:", responses[i].Seed)
+		seen[responses[i].Seed] = true
+	}
+	s.Assert(responses[0].ChallengeResponse == PorkChopSha512, "expected:", PorkChopSha512, "got:", responses[0].ChallengeResponse)
+
+	for _, tc := range []struct {
+		body string
+		code int
+	}{
+		{`[]`, http.StatusBadRequest},
+		{`"xxx"`, http.StatusBadRequest},
+		{`["xxx",""]`, http.StatusBadRequest},
+	} {
+		res, err := http.Post(s.URL+"/batch", "application/json", strings.NewReader(tc.body))
+		s.Assert(err == nil, "http client error:", err)
+		res.Body.Close()
+		s.Assert(res.StatusCode == tc.code, tc.body, "expected", tc.code, "got:", res.Status)
+	}
+	res, err = http.Get(s.URL + "/batch")
+	s.Assert(err == nil, "http client error:", err)
+	res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusMethodNotAllowed, "expected 405 for GET, got:", res.Status)
+}
+
+// TestMaxBatch tests that a batch over -max-batch, or reading more than
+// -max-batch-bytes, is refused, while one at the limits is answered
+func TestMaxBatch(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+	s.pollen.maxBatch = 3
+
+	post := func(n int) int {
+		body, _ := json.Marshal(strings.Split(strings.Repeat("xxx,", n-1)+"xxx", ","))
+		res, err := http.Post(s.URL+"/batch", "application/json", strings.NewReader(string(body)))
+		if err != nil {
+			t.Fatal("http client error:", err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	s.Assert(post(3) == http.StatusOK, "expected a batch at -max-batch to be answered")
+	s.Assert(post(4) == http.StatusBadRequest, "expected a batch over -max-batch to get 400")
+	s.pollen.maxBatchBytes = 2 * s.pollen.readSize
+	s.Assert(post(2) == http.StatusOK, "expected a batch at -max-batch-bytes to be answered")
+	s.Assert(post(3) == http.StatusBadRequest, "expected a batch over -max-batch-bytes to get 400")
+}
+
+// TestBatchGroupedHex tests that /batch groups its hex as -hex-group asks,
+// as the text format does
+func TestBatchGroupedHex(t *testing.T) {
+	s := NewSuiteWithDev(t, &counterSource{})
+	defer s.TearDown()
+	s.pollen.maxBatch = 4
+	s.pollen.hexGroup = 2
+	s.pollen.hexSeparator = ":"
+
+	res, err := http.Post(s.URL+"/batch", "application/json", strings.NewReader(`["pork chop sandwiches"]`))
+	if err != nil {
+		t.Fatal("http client error:", err)
+	}
+	defer res.Body.Close()
+	var responses []batchResponse
+	if err := json.NewDecoder(res.Body).Decode(&responses); err != nil || len(responses) != 1 {
+		t.Fatal("cannot decode batch:", responses, err)
+	}
+	device := make([]byte, 64)
+	(&counterSource{}).Read(device)
+	porkChop, seed := mix("pork chop sandwiches", device)
+	s.Assert(responses[0].ChallengeResponse == groupHex(porkChop, 2, ":"), "expected grouped hex, got:", responses[0].ChallengeResponse)
+	s.Assert(responses[0].Seed == groupHex(seed, 2, ":"), "expected a grouped seed, got:", responses[0].Seed)
+}
@@ -0,0 +1,51 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// bufferedSource reads the random device through a buffer of several
+// requests' worth of bytes, making fewer, larger reads.  Stirring writes go
+// straight to the device, so they only mix into the bytes read after those
+// already buffered are used up.
+type bufferedSource struct {
+	mutex  sync.Mutex
+	reader *bufio.Reader
+	dev    io.ReadWriter
+}
+
+func newBufferedSource(dev io.ReadWriter, size int) *bufferedSource {
+	return &bufferedSource{reader: bufio.NewReaderSize(dev, size), dev: dev}
+}
+
+func (b *bufferedSource) Read(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.reader.Read(p)
+}
+
+func (b *bufferedSource) Write(p []byte) (int, error) {
+	return b.dev.Write(p)
+}
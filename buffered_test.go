@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+)
+
+// CountingSource counts the reads made of the random device
+type CountingSource struct {
+	io.ReadWriter
+	reads int
+}
+
+func (c *CountingSource) Read(p []byte) (int, error) {
+	c.reads++
+	return c.ReadWriter.Read(p)
+}
+
+// TestBufferedSource tests that seeds stay unique when reading through a buffer
+func TestBufferedSource(t *testing.T) {
+	dev, err := os.OpenFile("/dev/urandom", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Cannot open device: %s\n", err)
+	}
+	defer dev.Close()
+	counting := &CountingSource{ReadWriter: dev}
+	s := NewSuiteWithDev(t, newBufferedSource(counting, 4096))
+	defer s.TearDown()
+
+	seeds := make(map[string]bool)
+	for i := 0; i < UniqueChainRounds; i++ {
+		res, err := http.Get(fmt.Sprintf("%s/?challenge=%s", s.URL, url.QueryEscape("the bassomatic '76")))
+		s.Assert(err == nil, "http client error:", err)
+		_, seed, err := ReadResp(res.Body)
+		res.Body.Close()
+		s.Assert(err == nil, "response error:", err)
+		seeds[seed] = true
+	}
+	s.Assert(len(seeds) == UniqueChainRounds, "non-unique seed response")
+	/* 100 requests of 64 bytes fit in two 4096 byte reads */
+	s.Assert(counting.reads == 2, "expected 2 device reads, got:", counting.reads)
+}
+
+type randWriter struct{}
+
+func (randWriter) Read(p []byte) (int, error) {
+	return rand.Read(p)
+}
+
+func (randWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func benchmarkSource(b *testing.B, bufferSize int) {
+	counting := &CountingSource{ReadWriter: randWriter{}}
+	var dev io.ReadWriter = counting
+	if bufferSize > 0 {
+		dev = newBufferedSource(counting, bufferSize)
+	}
+	data := make([]byte, 64)
+	for i := 0; i < b.N; i++ {
+		if _, err := io.ReadFull(dev, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(counting.reads)/float64(b.N), "reads/op")
+}
+
+func BenchmarkUnbufferedSource(b *testing.B) {
+	benchmarkSource(b, 0)
+}
+
+func BenchmarkBufferedSource(b *testing.B) {
+	benchmarkSource(b, 4096)
+}
@@ -0,0 +1,72 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// capabilities describes what this server supports, for clients to discover
+type capabilities struct {
+	Formats           []string        `json:"formats"`
+	Hashes            []string        `json:"hashes"`
+	MaxChallengeBytes int             `json:"max_challenge_bytes"`
+	Endpoints         map[string]bool `json:"endpoints"`
+}
+
+// capabilities derives the document from the configuration, for a mux
+// serving the operational endpoints if ops is set; reseed is only listed
+// where a client could reach it.  A max_challenge_bytes of 0 means
+// challenges of any length are accepted.
+func (p *PollenServer) capabilities(ops bool) capabilities {
+	var formats []string
+	for name := range formatNames {
+		formats = append(formats, name)
+	}
+	sort.Strings(formats)
+	maxChallenge := p.maxChallengeBytes
+	if p.strictChallenge && (maxChallenge == 0 || len(p.challengePrefix)+p.challengeLength < maxChallenge) {
+		maxChallenge = len(p.challengePrefix) + p.challengeLength
+	}
+	return capabilities{
+		Formats:           formats,
+		Hashes:            []string{hashName},
+		MaxChallengeBytes: maxChallenge,
+		Endpoints: map[string]bool{
+			"stir":   !p.disabledEndpoints["stir"],
+			"verify": !p.disabledEndpoints["verify"],
+			"stream": !p.disabledEndpoints["stream"],
+			"batch":  !p.disabledEndpoints["batch"],
+			"reseed": ops && p.adminToken != "" && !p.disabledEndpoints["admin"],
+		},
+	}
+}
+
+// serveCapabilities returns the handler of /capabilities on a mux serving
+// the operational endpoints if ops is set
+func (p *PollenServer) serveCapabilities(ops bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p.capabilities(ops))
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// Capabilities fetches and decodes /capabilities
+func (s *Suite) Capabilities() capabilities {
+	res, err := http.Get(s.URL + "/capabilities")
+	if err != nil {
+		s.t.Fatal("http client error:", err)
+	}
+	defer res.Body.Close()
+	var caps capabilities
+	if err := json.NewDecoder(res.Body).Decode(&caps); err != nil {
+		s.t.Fatal("json error:", err)
+	}
+	return caps
+}
+
+// TestCapabilities tests that the capabilities document reflects the configuration
+func TestCapabilities(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+
+	caps := s.Capabilities()
+	s.Assert(len(caps.Formats) == len(formatNames), "expected every format, got:", caps.Formats)
+	for _, name := range caps.Formats {
+		_, ok := formatNames[name]
+		s.Assert(ok, "listed a format that cannot be served:", name)
+		s.Assert(name != "base64", "listed base64, which pollen does not encode")
+	}
+	s.Assert(len(caps.Hashes) == 1 && caps.Hashes[0] == "sha512", "expected sha512, got:", caps.Hashes)
+	s.Assert(caps.MaxChallengeBytes == 0, "expected no challenge limit, got:", caps.MaxChallengeBytes)
+	s.Assert(caps.Endpoints["stir"] && caps.Endpoints["verify"] && caps.Endpoints["stream"],
+		"expected stir, verify and stream, got:", caps.Endpoints)
+	s.Assert(!caps.Endpoints["reseed"], "listed reseed without an admin token")
+
+	s.pollen.strictChallenge = true
+	s.pollen.challengeLength = 128
+	s.pollen.challengePrefix = "tenant:"
+	s.pollen.adminToken = TestAdminToken
+	caps = s.Capabilities()
+	s.pollen.maxChallengeBytes = 1 << 16
+	s.Assert(s.Capabilities().MaxChallengeBytes == 135, "expected a 135 byte challenge limit, got:", s.Capabilities().MaxChallengeBytes)
+	s.pollen.strictChallenge = false
+	s.Assert(s.Capabilities().MaxChallengeBytes == 1<<16, "expected a 64KiB challenge limit, got:", s.Capabilities().MaxChallengeBytes)
+	s.Assert(caps.Endpoints["reseed"], "didn't list reseed with an admin token")
+
+	/* With -monitoring-addr, the admin endpoints are not on the service ports */
+	s.Config.Handler = s.pollen.serviceMux(false)
+	s.Assert(!s.Capabilities().Endpoints["reseed"], "listed reseed where it is not served")
+}
@@ -0,0 +1,65 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"hash"
+	"net"
+	"sync"
+)
+
+// connChainKey holds a connection's *connChain in its requests' contexts
+type connChainKey struct{}
+
+// connChain carries each seed served on a connection into the mix of the
+// next, so that a client asking repeatedly on a keep-alive connection gets
+// a chain of seeds without sending them back as challenges.
+type connChain struct {
+	mu   sync.Mutex
+	last []byte
+}
+
+// connContext gives each connection its own chain, if chaining
+func (p *PollenServer) connContext(ctx context.Context, c net.Conn) context.Context {
+	if !p.connectionChaining {
+		return ctx
+	}
+	return context.WithValue(ctx, connChainKey{}, &connChain{})
+}
+
+// readChainedSeed is readSeedOf, mixing in the last seed served on the
+// connection, if any, after the challenge.  Requests on one connection, as
+// the streams of HTTP/2 may be, take their turns, so that none is skipped.
+func (p *PollenServer) readChainedSeed(ctx context.Context, checksum hash.Hash, size int, tally *byteTally) ([]byte, error) {
+	chain, _ := ctx.Value(connChainKey{}).(*connChain)
+	if chain == nil {
+		return p.readSeedOf(ctx, checksum, size, tally)
+	}
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
+	checksum.Write(chain.last)
+	seed, err := p.readSeedOf(ctx, checksum, size, tally)
+	if err == nil {
+		chain.last = seed
+	}
+	return seed, err
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestConnectionChaining tests that the second seed served on a connection
+// mixes in the first, and that a new connection starts a new chain
+func TestConnectionChaining(t *testing.T) {
+	s := NewSuiteWithDev(t, bytes.NewBufferString(strings.Repeat(DilbertRandom, 3)))
+	defer s.TearDown()
+	s.pollen.connectionChaining = true
+	server := httptest.NewUnstartedServer(s.pollen.mux())
+	server.Config.ConnContext = s.pollen.connContext
+	server.Start()
+	defer server.Close()
+
+	get := func(client *http.Client) string {
+		res, err := client.Get(server.URL + "?challenge=pork+chop+sandwiches")
+		if err != nil {
+			t.Fatal("http client error:", err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		s.Assert(err == nil, "response error:", err)
+		_, seed, err := ReadResp(bytes.NewReader(body))
+		s.Assert(err == nil, "response error:", err)
+		return seed
+	}
+
+	client := &http.Client{Transport: &http.Transport{}}
+	first, second := get(client), get(client)
+	_, expected := mix("pork chop sandwiches", []byte(DilbertRandom))
+	s.Assert(first == fmt.Sprintf("%x", expected), "expected an unchained first seed, got:", first)
+	previous, _ := hex.DecodeString(first)
+	checksum := mixChallenge("pork chop sandwiches")
+	checksum.Write(previous)
+	checksum.Write([]byte(DilbertRandom))
+	s.Assert(second == fmt.Sprintf("%x", checksum.Sum(nil)), "expected the second seed to mix in the first, got:", second)
+
+	fresh := get(&http.Client{Transport: &http.Transport{}})
+	s.Assert(fresh == first, "expected a new connection to start a new chain, got:", fresh)
+}
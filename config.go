@@ -0,0 +1,88 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// envName returns the environment variable setting a flag, such as
+// POLLEN_HTTP_PORT for -http-port
+func envName(flagName string) string {
+	return "POLLEN_" + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// applyEnv sets each flag in fs that was not given on the command line from
+// its environment variable, if lookup finds one, so that flags take
+// precedence over the environment.
+func applyEnv(fs *flag.FlagSet, lookup func(string) (string, bool)) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := lookup(envName(f.Name))
+		if err != nil || given[f.Name] || !ok {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("Invalid %s: %s", envName(f.Name), setErr)
+		}
+	})
+	return err
+}
+
+// secretFlags are the flags whose values are never printed
+var secretFlags = map[string]bool{"admin-token": true}
+
+// effectiveConfig returns the resolved value of every flag in fs, by name,
+// with booleans and numbers as such and everything else as it would be
+// given on the command line.
+func effectiveConfig(fs *flag.FlagSet) map[string]interface{} {
+	config := make(map[string]interface{})
+	fs.VisitAll(func(f *flag.Flag) {
+		if secretFlags[f.Name] && f.Value.String() != "" {
+			config[f.Name] = "<redacted>"
+			return
+		}
+		if getter, ok := f.Value.(flag.Getter); ok {
+			switch value := getter.Get().(type) {
+			case bool, int, int64, uint, uint64, float64:
+				config[f.Name] = value
+				return
+			}
+		}
+		config[f.Name] = f.Value.String()
+	})
+	return config
+}
+
+// printConfig writes the effective configuration as JSON, for -print-config
+func printConfig(w io.Writer, fs *flag.FlagSet) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(effectiveConfig(fs))
+}
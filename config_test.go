@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"testing"
+	"time"
+)
+
+// TestPrintConfig tests that the printed configuration resolves every flag
+func TestPrintConfig(t *testing.T) {
+	fs := flag.NewFlagSet("pollen", flag.ContinueOnError)
+	fs.String("http-port", "80", "")
+	fs.Int("bytes", 64, "")
+	fs.Bool("quiet", false, "")
+	fs.Duration("listen-retry-delay", time.Second, "")
+	fs.String("admin-token", "", "")
+	if err := fs.Parse([]string{"-http-port", "8080", "-admin-token", "hunter2"}); err != nil {
+		t.Fatal("parse error:", err)
+	}
+	var out bytes.Buffer
+	if err := printConfig(&out, fs); err != nil {
+		t.Fatal("print error:", err)
+	}
+	var config map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &config); err != nil {
+		t.Fatal("json error:", err)
+	}
+	expected := map[string]interface{}{
+		"http-port":          "8080",
+		"bytes":              float64(64),
+		"quiet":              false,
+		"listen-retry-delay": "1s",
+		"admin-token":        "<redacted>",
+	}
+	if len(config) != len(expected) {
+		t.Error("expected", len(expected), "settings, got:", config)
+	}
+	for name, value := range expected {
+		if config[name] != value {
+			t.Error("expected", name, "to be", value, "got:", config[name])
+		}
+	}
+}
+
+// TestPrintConfigFlags tests that pollen's own flags all appear
+func TestPrintConfigFlags(t *testing.T) {
+	config := effectiveConfig(flag.CommandLine)
+	for _, name := range []string{"http-port", "https-port", "device", "bytes", "source", "quiet"} {
+		if _, ok := config[name]; !ok {
+			t.Error("missing setting:", name)
+		}
+	}
+	if config["device"] != "/dev/random" {
+		t.Error("expected the default device, got:", config["device"])
+	}
+}
+
+// TestApplyEnv tests that the environment sets the flags not given on the command line
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{"POLLEN_HTTP_PORT": "8080", "POLLEN_BYTES": "128"}
+	lookup := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+	for _, test := range []struct {
+		args  []string
+		port  string
+		bytes int
+	}{
+		{nil, "8080", 128},
+		{[]string{"-http-port", "9090"}, "9090", 128},
+		{[]string{"-http-port", "9090", "-bytes", "32"}, "9090", 32},
+	} {
+		fs := flag.NewFlagSet("pollen", flag.ContinueOnError)
+		port := fs.String("http-port", "80", "")
+		bytes := fs.Int("bytes", 64, "")
+		device := fs.String("device", "/dev/random", "")
+		if err := fs.Parse(test.args); err != nil {
+			t.Fatal("parse error:", err)
+		}
+		if err := applyEnv(fs, lookup); err != nil {
+			t.Fatal("env error:", err)
+		}
+		if *port != test.port || *bytes != test.bytes || *device != "/dev/random" {
+			t.Error(test.args, "expected", test.port, test.bytes, "got:", *port, *bytes, *device)
+		}
+	}
+}
+
+// TestApplyEnvInvalid tests that an invalid environment variable is an error
+func TestApplyEnvInvalid(t *testing.T) {
+	fs := flag.NewFlagSet("pollen", flag.ContinueOnError)
+	fs.Int("bytes", 64, "")
+	err := applyEnv(fs, func(name string) (string, bool) {
+		return "lots", name == "POLLEN_BYTES"
+	})
+	if err == nil {
+		t.Error("expected an error for POLLEN_BYTES=lots")
+	}
+}
@@ -0,0 +1,65 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// unsafeSources are the -source names that must never serve production
+// traffic, which are logged at crit when selected
+var unsafeSources = map[string]bool{"counter": true}
+
+func init() {
+	sources["counter"] = func() (io.ReadWriteCloser, error) {
+		return &counterSource{}, nil
+	}
+}
+
+// counterSource serves a counting sequence of 64-bit big-endian integers,
+// so that load tests measure the HTTP stack rather than the entropy source.
+// No two reads of a whole integer or more are ever the same, so its seeds
+// pass the seed repeat check.  It is entirely predictable, and so unsafe for
+// production.
+type counterSource struct {
+	mu sync.Mutex
+	// offset is the position in the sequence, in bytes
+	offset uint64
+}
+
+func (c *counterSource) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range p {
+		p[i] = byte(c.offset / 8 >> (56 - 8*(c.offset%8)))
+		c.offset++
+	}
+	return len(p), nil
+}
+
+func (c *counterSource) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (c *counterSource) Close() error {
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/binary"
+	"net/http"
+	"testing"
+)
+
+// TestCounterSource tests that the counter source counts in 64-bit integers,
+// across reads
+func TestCounterSource(t *testing.T) {
+	dev, err := sources["counter"]()
+	if err != nil {
+		t.Fatal("open error:", err)
+	}
+	data := make([]byte, 8*300)
+	dev.Read(data[:100])
+	dev.Read(data[100:])
+	for i := 0; i < len(data); i += 8 {
+		if n := binary.BigEndian.Uint64(data[i:]); n != uint64(i/8) {
+			t.Fatalf("expected integer %d to be %d, got: %d", i/8, i/8, n)
+		}
+	}
+	if !unsafeSources["counter"] {
+		t.Error("the counter source must be marked unsafe")
+	}
+}
+
+// TestCounterSourceServes tests that the server serves from the counter source
+func TestCounterSourceServes(t *testing.T) {
+	s := NewSuiteWithDev(t, &counterSource{})
+	defer s.TearDown()
+
+	res, err := http.Get(s.URL + "?challenge=xxx")
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	chal, seed, err := ReadResp(res.Body)
+	s.Assert(err == nil, "response err:", err)
+	s.SanityCheck(chal, seed)
+}
+
+// TestCounterSourceNeverRepeats tests that the counter source serves the same
+// challenge again and again without tripping the seed repeat check
+func TestCounterSourceNeverRepeats(t *testing.T) {
+	s := NewSuiteWithDev(t, &counterSource{})
+	defer s.TearDown()
+	s.pollen.recentSeeds = newLRU(1024)
+
+	for i := 0; i < 16; i++ {
+		res, err := http.Get(s.URL + "?challenge=xxx")
+		s.Assert(err == nil, "http client error:", err)
+		chal, seed, err := ReadResp(res.Body)
+		res.Body.Close()
+		s.Assert(res.StatusCode == http.StatusOK && err == nil, "request", i, "failed:", res.Status, err)
+		s.SanityCheck(chal, seed)
+	}
+}
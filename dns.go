@@ -0,0 +1,245 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// DNS header flags, types and response codes, from RFC 1035
+const (
+	dnsHeaderSize   = 12
+	dnsFlagResponse = 1 << 15
+	dnsFlagAuth     = 1 << 10
+	dnsFlagRecurse  = 1 << 8
+	dnsOpcodeMask   = 0xf << 11
+	dnsTypeTXT      = 16
+	dnsClassIN      = 1
+	dnsRcodeFormat  = 1
+	dnsRcodeServer  = 2
+	dnsRcodeName    = 3
+	dnsRcodeRefused = 5
+	dnsMaxUDPSize   = 512
+)
+
+// dnsChallengeEncoding decodes the labels of a query name into the challenge
+var dnsChallengeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// errNotQuery means a DNS message that deserves no answer at all
+var errNotQuery = errors.New("not a DNS query")
+
+// dnsQuestion is the single question of a DNS query
+type dnsQuestion struct {
+	id     uint16
+	flags  uint16
+	labels []string
+	qtype  uint16
+	qclass uint16
+	// raw is the question section, echoed in the response
+	raw []byte
+}
+
+// parseDNSQuery parses a DNS query of exactly one question, whose name may
+// not use compression, as no query needs to.
+func parseDNSQuery(msg []byte) (*dnsQuestion, error) {
+	if len(msg) < dnsHeaderSize {
+		return nil, errNotQuery
+	}
+	q := &dnsQuestion{
+		id:    binary.BigEndian.Uint16(msg[0:]),
+		flags: binary.BigEndian.Uint16(msg[2:]),
+	}
+	if q.flags&dnsFlagResponse != 0 {
+		return nil, errNotQuery
+	}
+	if q.flags&dnsOpcodeMask != 0 || binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return q, errors.New("unsupported DNS query")
+	}
+	i := dnsHeaderSize
+	for {
+		if i >= len(msg) {
+			return q, errors.New("truncated DNS name")
+		}
+		n := int(msg[i])
+		i++
+		if n == 0 {
+			break
+		}
+		if n > 63 || i+n > len(msg) {
+			return q, errors.New("invalid DNS label")
+		}
+		q.labels = append(q.labels, string(msg[i:i+n]))
+		i += n
+	}
+	if i+4 > len(msg) {
+		return q, errors.New("truncated DNS question")
+	}
+	q.qtype = binary.BigEndian.Uint16(msg[i:])
+	q.qclass = binary.BigEndian.Uint16(msg[i+2:])
+	q.raw = msg[dnsHeaderSize : i+4]
+	return q, nil
+}
+
+// dnsResponse builds the response to q with the given response code, and
+// the TXT record of txt if it is not empty.
+func dnsResponse(q *dnsQuestion, rcode uint16, txt string) []byte {
+	msg := make([]byte, dnsHeaderSize, dnsHeaderSize+len(q.raw)+16+len(txt))
+	binary.BigEndian.PutUint16(msg[0:], q.id)
+	binary.BigEndian.PutUint16(msg[2:], dnsFlagResponse|dnsFlagAuth|q.flags&dnsFlagRecurse|rcode)
+	if q.raw != nil {
+		binary.BigEndian.PutUint16(msg[4:], 1)
+		msg = append(msg, q.raw...)
+	}
+	if txt != "" {
+		binary.BigEndian.PutUint16(msg[6:], 1)
+		/* A pointer to the question's name, then TXT, IN, and a TTL of 0, as seeds must not be cached */
+		msg = append(msg, 0xc0, dnsHeaderSize, 0, dnsTypeTXT, 0, dnsClassIN, 0, 0, 0, 0)
+		msg = append(msg, byte((len(txt)+1)>>8), byte(len(txt)+1), byte(len(txt)))
+		msg = append(msg, txt...)
+	}
+	return msg
+}
+
+// dnsChallenge decodes the challenge from the labels of a query name, less
+// those of the zone, returning false if the name is not in the zone.
+func dnsChallenge(labels []string, zone string) (string, bool, error) {
+	zoneLabels := strings.FieldsFunc(zone, func(r rune) bool { return r == '.' })
+	if len(labels) < len(zoneLabels) {
+		return "", false, nil
+	}
+	split := len(labels) - len(zoneLabels)
+	if !strings.EqualFold(strings.Join(labels[split:], "."), strings.Join(zoneLabels, ".")) {
+		return "", false, nil
+	}
+	challenge, err := dnsChallengeEncoding.DecodeString(strings.ToUpper(strings.Join(labels[:split], "")))
+	return string(challenge), true, err
+}
+
+// answerDNS answers a DNS query for a TXT record whose name is the base32 of
+// a challenge, under zone, with the hex of a seed, mixed just as over HTTP.
+func (p *PollenServer) answerDNS(ctx context.Context, msg []byte, zone, remoteAddr string) ([]byte, error) {
+	q, err := parseDNSQuery(msg)
+	if err == errNotQuery {
+		return nil, err
+	}
+	if err != nil {
+		return dnsResponse(q, dnsRcodeFormat, ""), nil
+	}
+	if q.qtype != dnsTypeTXT || q.qclass != dnsClassIN {
+		/* The name may exist, but it has no records of any other type */
+		return dnsResponse(q, 0, ""), nil
+	}
+	if err := p.admit(remoteAddr, "dns"); err != nil {
+		return dnsResponse(q, dnsRcodeRefused, ""), nil
+	}
+	challenge, ok, err := dnsChallenge(q.labels, zone)
+	if !ok {
+		return dnsResponse(q, dnsRcodeRefused, ""), nil
+	}
+	if err == nil {
+		challenge, err = p.checkChallenge(challenge)
+	}
+	if err != nil {
+		return dnsResponse(q, dnsRcodeName, ""), nil
+	}
+	checksum := p.hashChallenge(challenge)
+	challengeResponse := checksum.Sum(nil)
+	p.stir(challengeResponse, remoteAddr)
+	if p.audit != nil && p.audit.record(challengeResponse) {
+		p.metrics.duplicateChallenges.Add(1)
+	}
+	seed, err := p.readSeed(ctx, checksum)
+	if err != nil {
+		p.log.ErrKV("Cannot read from random device", "at", time.Now().UnixNano())
+		return dnsResponse(q, dnsRcodeServer, ""), nil
+	}
+	p.log.InfoKV("Server answered DNS challenge", "remote_addr", remoteAddr, "at", time.Now().UnixNano())
+	return dnsResponse(q, 0, fmt.Sprintf("%x", seed)), nil
+}
+
+// serveDNSUDP answers DNS queries arriving on conn until it fails, at most
+// dnsMaxInflight at once.  Beyond that a query is dropped and counted, as by
+// a busy resolver, and left to the client to retry, so that a flood of
+// spoofable packets cannot take a goroutine and a device read each.
+func (p *PollenServer) serveDNSUDP(conn net.PacketConn, zone string) error {
+	inflight := make(chan struct{}, max(p.dnsMaxInflight, 1))
+	for {
+		buf := make([]byte, dnsMaxUDPSize)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		select {
+		case inflight <- struct{}{}:
+		default:
+			p.metrics.dnsDropped.Add(1)
+			continue
+		}
+		go func() {
+			defer func() { <-inflight }()
+			resp, err := p.answerDNS(context.Background(), buf[:n], zone, addr.String())
+			if err == nil {
+				conn.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+// serveDNSTCP answers the length prefixed DNS queries of connections
+// accepted on ln until it fails
+func (p *PollenServer) serveDNSTCP(ln net.Listener, zone string) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				conn.SetDeadline(time.Now().Add(10 * time.Second))
+				var size [2]byte
+				if _, err := io.ReadFull(conn, size[:]); err != nil {
+					return
+				}
+				msg := make([]byte, binary.BigEndian.Uint16(size[:]))
+				if _, err := io.ReadFull(conn, msg); err != nil {
+					return
+				}
+				resp, err := p.answerDNS(context.Background(), msg, zone, conn.RemoteAddr().String())
+				if err != nil {
+					return
+				}
+				binary.BigEndian.PutUint16(size[:], uint16(len(resp)))
+				if _, err := conn.Write(append(size[:], resp...)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
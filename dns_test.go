@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// DNSQuery builds a query for the TXT record of name
+func DNSQuery(id uint16, name string) []byte {
+	msg := []byte{byte(id >> 8), byte(id), 1, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(name, ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	return append(msg, 0, 0, dnsTypeTXT, 0, dnsClassIN)
+}
+
+// DNSTXT returns the response code and the TXT answer, if any, of a response
+func DNSTXT(t *testing.T, query, resp []byte) (int, string) {
+	if len(resp) < len(query) || binary.BigEndian.Uint16(resp) != binary.BigEndian.Uint16(query) {
+		t.Fatal("response doesn't answer the query:", resp)
+	}
+	rcode := int(binary.BigEndian.Uint16(resp[2:]) & 0xf)
+	if binary.BigEndian.Uint16(resp[6:]) == 0 {
+		return rcode, ""
+	}
+	/* The answer follows the echoed question, a name pointer, and ten bytes of type, class, ttl and length */
+	answer := resp[len(query)+12:]
+	if ttl := binary.BigEndian.Uint32(resp[len(query)+6:]); ttl != 0 {
+		t.Error("expected a TTL of 0, got:", ttl)
+	}
+	return rcode, string(answer[1 : 1+int(answer[0])])
+}
+
+// TestDNSSeed tests that a TXT query for an encoded challenge answers with a seed
+func TestDNSSeed(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	s.Assert(err == nil, "listen error:", err)
+	defer conn.Close()
+	go s.pollen.serveDNSUDP(conn, "entropy.example.com")
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	s.Assert(err == nil, "dial error:", err)
+	defer client.Close()
+	name := strings.ToLower(dnsChallengeEncoding.EncodeToString([]byte("pork chop sandwiches"))) + ".entropy.example.com"
+	query := DNSQuery(0x1234, name)
+	_, err = client.Write(query)
+	s.Assert(err == nil, "write error:", err)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp := make([]byte, dnsMaxUDPSize)
+	n, err := client.Read(resp)
+	s.Assert(err == nil, "read error:", err)
+	rcode, seed := DNSTXT(t, query, resp[:n])
+	s.Assert(rcode == 0, "expected no error, got rcode:", rcode)
+	s.Assert(len(seed) == 128 && CheckHex(seed) == nil, "seed is not 128 hex characters:", seed)
+}
+
+// TestDNSMaxInflight tests that UDP queries beyond dnsMaxInflight are dropped
+// and counted, while those in flight are still answered
+func TestDNSMaxInflight(t *testing.T) {
+	source := NewBlockingReader()
+	s := NewSuiteWithDev(t, source)
+	defer s.TearDown()
+	s.pollen.dnsMaxInflight = 1
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	s.Assert(err == nil, "listen error:", err)
+	defer conn.Close()
+	go s.pollen.serveDNSUDP(conn, "entropy.example.com")
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	s.Assert(err == nil, "dial error:", err)
+	defer client.Close()
+	name := strings.ToLower(dnsChallengeEncoding.EncodeToString([]byte("pork chop sandwiches"))) + ".entropy.example.com"
+	query := DNSQuery(0x1234, name)
+	deadline := time.Now().Add(5 * time.Second)
+	for s.pollen.metrics.dnsDropped.Load() == 0 && time.Now().Before(deadline) {
+		_, err = client.Write(query)
+		s.Assert(err == nil, "write error:", err)
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Assert(s.pollen.metrics.dnsDropped.Load() > 0, "expected queries beyond -dns-max-inflight dropped")
+	s.Assert(strings.Contains(s.Metrics(), "\npollen_dns_dropped_total "), "expected the drops counted, got:", s.Metrics())
+
+	close(source.release)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp := make([]byte, dnsMaxUDPSize)
+	n, err := client.Read(resp)
+	s.Assert(err == nil, "read error:", err)
+	rcode, seed := DNSTXT(t, query, resp[:n])
+	s.Assert(rcode == 0 && len(seed) == 128, "expected the query in flight answered, got:", rcode, seed)
+}
+
+// TestDNSRefused tests that names outside the zone, and bad challenges, get no seed
+func TestDNSRefused(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+
+	for name, want := range map[string]int{
+		"onxw2zlsmvxgm.example.org":  dnsRcodeRefused,
+		"not-base32!.entropy.pollen": dnsRcodeName,
+	} {
+		query := DNSQuery(7, name)
+		resp, err := s.pollen.answerDNS(context.Background(), query, "entropy.pollen", "test")
+		s.Assert(err == nil, "answer error:", err)
+		rcode, txt := DNSTXT(t, query, resp)
+		s.Assert(rcode == want && txt == "", name, "expected rcode", want, "got:", rcode, txt)
+	}
+}
@@ -0,0 +1,89 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// egressWriter paces the bytes written to a response with a token bucket
+// holding up to one second of bytes, so small responses are never delayed.
+type egressWriter struct {
+	http.ResponseWriter
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newEgressWriter(w http.ResponseWriter, bytesPerSecond int) *egressWriter {
+	rate := float64(bytesPerSecond)
+	return &egressWriter{ResponseWriter: w, rate: rate, tokens: rate, last: time.Now()}
+}
+
+func (e *egressWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		now := time.Now()
+		e.tokens += now.Sub(e.last).Seconds() * e.rate
+		e.last = now
+		if e.tokens > e.rate {
+			e.tokens = e.rate
+		}
+		if e.tokens < 1 {
+			time.Sleep(time.Duration((1 - e.tokens) / e.rate * float64(time.Second)))
+			continue
+		}
+		n := len(p)
+		if float64(n) > e.tokens {
+			n = int(e.tokens)
+		}
+		n, err := e.ResponseWriter.Write(p[:n])
+		written += n
+		e.tokens -= float64(n)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (e *egressWriter) Flush() {
+	if flusher, ok := e.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets an http.ResponseController reach the underlying connection
+func (e *egressWriter) Unwrap() http.ResponseWriter {
+	return e.ResponseWriter
+}
+
+// limitEgress paces each response to the server's egress rate, if any
+func (p *PollenServer) limitEgress(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p.egressRate > 0 {
+			w = newEgressWriter(w, p.egressRate)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
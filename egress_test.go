@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestEgressRate asserts a large response is paced to the egress rate
+func TestEgressRate(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := newEgressWriter(rec, 10000)
+	start := time.Now()
+	// One second of burst, then half a second paced
+	n, err := w.Write(bytes.Repeat([]byte{'9'}, 15000))
+	elapsed := time.Since(start)
+	if n != 15000 || err != nil {
+		t.Fatal("expected 15000 bytes written, got:", n, err)
+	}
+	if rec.Body.Len() != 15000 {
+		t.Error("expected 15000 bytes received, got:", rec.Body.Len())
+	}
+	if elapsed < 400*time.Millisecond || elapsed > 1000*time.Millisecond {
+		t.Error("expected about 500ms to write, took:", elapsed)
+	}
+}
+
+// TestEgressSmallResponse asserts the default response is not delayed by a limit
+func TestEgressSmallResponse(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+
+	s.pollen.egressRate = 1024
+	start := time.Now()
+	res, err := http.Get(s.URL + "?challenge=xxx")
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	chal, seed, err := ReadResp(res.Body)
+	s.Assert(err == nil, "response err:", err)
+	s.SanityCheck(chal, seed)
+	s.Assert(time.Since(start) < 250*time.Millisecond, "small response was delayed:", time.Since(start))
+}
@@ -0,0 +1,96 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// endpointNames are the endpoints -disable-endpoints may turn off, by name.
+// The challenge at / is always served.
+var endpointNames = map[string]bool{
+	"stir":         true,
+	"verify":       true,
+	"ready":        true,
+	"stream":       true,
+	"batch":        true,
+	"capabilities": true,
+	"stats":        true,
+	"metrics":      true,
+	"health":       true,
+	"admin":        true,
+	"debug":        true,
+}
+
+// parseDisabledEndpoints parses a comma separated list of endpoint names
+func parseDisabledEndpoints(list string) (map[string]bool, error) {
+	disabled := map[string]bool{}
+	if list == "" {
+		return disabled, nil
+	}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if !endpointNames[name] {
+			return nil, fmt.Errorf("Unknown endpoint: %s", name)
+		}
+		disabled[name] = true
+	}
+	return disabled, nil
+}
+
+// handle routes pattern to handler, unless the named endpoint is disabled,
+// when it is not found, rather than being taken for a challenge.
+func (p *PollenServer) handle(mux *http.ServeMux, name, pattern string, handler http.HandlerFunc) {
+	if p.disabledEndpoints[name] {
+		mux.Handle(pattern, http.NotFoundHandler())
+		return
+	}
+	mux.HandleFunc(pattern, handler)
+}
+
+// sizeRoutePath matches the paths -size-routes may serve, a single segment
+var sizeRoutePath = regexp.MustCompile(`^/[A-Za-z0-9._-]+$`)
+
+// parseSizeRoutes parses a comma separated list of path=bytes, such as
+// /32=32, mapping each path to the bytes read for its challenges.
+func parseSizeRoutes(list string) (map[string]int, error) {
+	routes := map[string]int{}
+	if list == "" {
+		return routes, nil
+	}
+	for _, route := range strings.Split(list, ",") {
+		path, size, ok := strings.Cut(strings.TrimSpace(route), "=")
+		n, err := strconv.Atoi(size)
+		if !ok || err != nil || n <= 0 {
+			return nil, fmt.Errorf("Invalid size route, expected path=bytes: %s", route)
+		}
+		name := strings.TrimPrefix(path, "/")
+		if !sizeRoutePath.MatchString(path) || endpointNames[name] || name == "favicon.ico" || name == "robots.txt" {
+			return nil, fmt.Errorf("Invalid size route path: %s", path)
+		}
+		routes[path] = n
+	}
+	return routes, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// TestDisabledEndpoints tests that disabled endpoints are not found, while / still serves
+func TestDisabledEndpoints(t *testing.T) {
+	disabled, err := parseDisabledEndpoints("stir, stats")
+	if err != nil {
+		t.Fatal("parse error:", err)
+	}
+	s := NewSuiteWithDev(t, bytes.NewBufferString(DilbertRandom))
+	defer s.TearDown()
+	s.pollen.disabledEndpoints = disabled
+	s.Config.Handler = s.pollen.mux()
+
+	for _, path := range []string{"/stir?challenge=xxx", "/stats"} {
+		res, err := http.Get(s.URL + path)
+		s.Assert(err == nil, "http client error:", err)
+		res.Body.Close()
+		s.Assert(res.StatusCode == http.StatusNotFound, path, "expected 404, got:", res.Status)
+	}
+	res, err := http.Get(s.URL + "/verify?challenge=xxx&challenge_response=00")
+	s.Assert(err == nil, "http client error:", err)
+	res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusConflict, "expected /verify to be served, got:", res.Status)
+	res, err = http.Get(s.URL + "?challenge=pork+chop+sandwiches")
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	chal, _, err := ReadResp(res.Body)
+	s.Assert(err == nil, "response error:", err)
+	s.Assert(chal == PorkChopSha512, "expected:", PorkChopSha512, "got:", chal)
+	s.Assert(!s.pollen.capabilities(true).Endpoints["stir"], "expected stir to be advertised as disabled")
+
+	if _, err := parseDisabledEndpoints("stir,bogus"); err == nil {
+		t.Error("expected an unknown endpoint to be refused")
+	}
+}
+
+// TestSizeRoutes tests that a size route reads its own number of bytes, while / keeps the default
+func TestSizeRoutes(t *testing.T) {
+	routes, err := parseSizeRoutes("/32=32, /64=64")
+	if err != nil {
+		t.Fatal("parse error:", err)
+	}
+	b := bytes.NewBufferString(DilbertRandom + DilbertRandom)
+	s := NewSuiteWithDev(t, b)
+	defer s.TearDown()
+	s.pollen.sizeRoutes = routes
+	s.Config.Handler = s.pollen.mux()
+
+	res, err := http.Get(s.URL + "/32?challenge=pork+chop+sandwiches")
+	s.Assert(err == nil, "http client error:", err)
+	chal, seed, err := ReadResp(res.Body)
+	res.Body.Close()
+	s.Assert(err == nil, "response error:", err)
+	s.Assert(chal == PorkChopSha512, "expected:", PorkChopSha512, "got:", chal)
+	_, expected := mix("pork chop sandwiches", []byte(DilbertRandom[:32]))
+	s.Assert(seed == fmt.Sprintf("%x", expected), "expected a seed of 32 bytes:", fmt.Sprintf("%x", expected), "got:", seed)
+	/* Two challenge hashes were stirred in after the 128 canned bytes */
+	s.Assert(b.Len() == 128-32+64, "expected 32 bytes consumed, got:", 128+64-b.Len())
+
+	res, err = http.Get(s.URL + "?challenge=pork+chop+sandwiches")
+	s.Assert(err == nil, "http client error:", err)
+	res.Body.Close()
+	s.Assert(b.Len() == 128-32-64+128, "expected 64 more bytes consumed at /, got:", 128+128-32-b.Len())
+
+	for _, bad := range []string{"/32", "32=32", "/32=0", "/stir=32", "/a/b=32"} {
+		if _, err := parseSizeRoutes(bad); err == nil {
+			t.Error("expected an invalid size route to be refused:", bad)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+//go:build linux
+
+package main
+
+import "testing"
+
+// TestKernelEntropy tests that RNDGETENTCNT is right for this architecture,
+// which would otherwise fail with ENOTTY
+func TestKernelEntropy(t *testing.T) {
+	bits, err := kernelEntropy()
+	if err != nil {
+		t.Fatal("cannot count kernel entropy:", err)
+	}
+	if bits < 0 || bits > 4096 {
+		t.Error("implausible kernel entropy:", bits)
+	}
+}
@@ -0,0 +1,50 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import "math"
+
+// byteTally counts the bytes read from the device, to estimate their entropy
+type byteTally [256]int
+
+func (t *byteTally) add(data []byte) {
+	for _, b := range data {
+		t[b]++
+	}
+}
+
+// shannon returns the Shannon entropy of the tallied bytes, in bits per
+// byte.  It is only a hint: n bytes can never score above log2(n), and a
+// predictable but varied sequence scores high.
+func (t *byteTally) shannon() float64 {
+	total := 0
+	for _, count := range t {
+		total += count
+	}
+	entropy := 0.0
+	for _, count := range t {
+		if count > 0 {
+			p := float64(count) / float64(total)
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// TestEntropyEstimate tests that all nines estimate low and varied bytes high
+func TestEntropyEstimate(t *testing.T) {
+	estimate := func(dev *bytes.Buffer) float64 {
+		s := NewSuiteWithDev(t, dev)
+		defer s.TearDown()
+		s.pollen.entropyEstimate = true
+		res, err := http.Get(s.URL + "?challenge=pork+chop+sandwiches")
+		s.Assert(err == nil, "http client error:", err)
+		defer res.Body.Close()
+		estimate, err := strconv.ParseFloat(res.Header.Get("X-Entropy-Estimate"), 64)
+		s.Assert(err == nil, "bad estimate:", res.Header.Get("X-Entropy-Estimate"))
+		return estimate
+	}
+	/* Only n, i and e, half of them n */
+	if low := estimate(bytes.NewBufferString(DilbertRandom)); low != 1.5 {
+		t.Error("expected 1.5 bits per byte in all nines, got:", low)
+	}
+	varied := make([]byte, 64)
+	for i := range varied {
+		varied[i] = byte(i * 4)
+	}
+	if high := estimate(bytes.NewBuffer(varied)); high != 6 {
+		t.Error("expected 6 bits per byte in 64 distinct bytes, got:", high)
+	}
+}
+
+// TestNoEntropyEstimate tests that the estimate is only sent when asked for
+func TestNoEntropyEstimate(t *testing.T) {
+	s := NewSuiteWithDev(t, bytes.NewBufferString(DilbertRandom))
+	defer s.TearDown()
+	res, err := http.Get(s.URL + "?challenge=pork+chop+sandwiches")
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	s.Assert(res.Header.Get("X-Entropy-Estimate") == "", "unexpected estimate:", res.Header.Get("X-Entropy-Estimate"))
+}
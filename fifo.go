@@ -0,0 +1,49 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"os"
+)
+
+// fifoSource reads a named pipe fed by an external daemon.  Stirring would
+// only feed pollen's own output back to it, so writes are discarded.
+type fifoSource struct {
+	*os.File
+}
+
+func (f fifoSource) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// isFIFO reports whether path is a named pipe
+func isFIFO(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode()&os.ModeNamedPipe != 0
+}
+
+// openFIFO opens a named pipe read only, which waits for its producer to
+// open it.  Reads then wait for the producer to write, and fail once it
+// has closed it.
+func openFIFO(path string) (fifoSource, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY, 0)
+	return fifoSource{f}, err
+}
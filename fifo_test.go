@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// NewFIFOSuite serves from a named pipe, with the producer's end returned
+func NewFIFOSuite(t *testing.T) (*Suite, *os.File) {
+	path := filepath.Join(t.TempDir(), "entropy")
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		t.Fatal("mkfifo error:", err)
+	}
+	if !isFIFO(path) {
+		t.Fatal("expected a FIFO at", path)
+	}
+	/* Each end waits for the other to open */
+	producer := make(chan *os.File)
+	go func() {
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			t.Error("producer open error:", err)
+		}
+		producer <- f
+	}()
+	dev, err := openFIFO(path)
+	if err != nil {
+		t.Fatal("fifo open error:", err)
+	}
+	return NewSuiteWithDev(t, dev), <-producer
+}
+
+// TestFIFODevice tests that bytes written by a producer to a FIFO are served
+func TestFIFODevice(t *testing.T) {
+	s, producer := NewFIFOSuite(t)
+	defer s.TearDown()
+	defer producer.Close()
+	go io.WriteString(producer, DilbertRandom)
+
+	res, err := http.Get(s.URL + "?challenge=pork+chop+sandwiches")
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	chal, seed, err := ReadResp(res.Body)
+	s.Assert(err == nil, "response error:", err)
+	s.Assert(chal == PorkChopSha512, "expected:", PorkChopSha512, "got:", chal)
+	expectedSeed := fmt.Sprintf("%x", cannedSeed())
+	s.Assert(seed == expectedSeed, "expected:", expectedSeed, "got:", seed)
+}
+
+// TestDeviceReadTimeout tests that a stalled producer fails the request rather than hanging it
+func TestDeviceReadTimeout(t *testing.T) {
+	s, producer := NewFIFOSuite(t)
+	defer s.TearDown()
+	defer producer.Close()
+	s.pollen.deviceReadTimeout = 50 * time.Millisecond
+
+	start := time.Now()
+	res, err := http.Get(s.URL + "?challenge=pork+chop+sandwiches")
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusInternalServerError, "expected 500, got:", res.Status)
+	s.Assert(time.Since(start) < 5*time.Second, "the read wasn't timed out:", time.Since(start))
+}
@@ -0,0 +1,205 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// responseFormat encodes the challenge response and seed in one media type
+type responseFormat struct {
+	name        string
+	contentType string
+	encode      func(w io.Writer, challengeResponse, seed []byte) error
+}
+
+var (
+	textFormat    = responseFormat{"text", "text/plain; charset=utf-8", encodeText}
+	labeledFormat = responseFormat{"labeled", "text/plain; charset=utf-8", encodeLabeled}
+	jsonFormat    = responseFormat{"json", "application/json", encodeJSON}
+	cborFormat    = responseFormat{"cbor", "application/cbor", encodeCBOR}
+)
+
+// formatNames are the formats a request may ask for with its format parameter
+var formatNames = map[string]responseFormat{
+	"text":    textFormat,
+	"labeled": labeledFormat,
+	"json":    jsonFormat,
+	"cbor":    cborFormat,
+}
+
+// negotiateFormat picks the format named by the format parameter, or else
+// the first format in the Accept header that pollen speaks, falling back to
+// the two line text format.
+func negotiateFormat(r *http.Request) responseFormat {
+	if format, ok := formatNames[r.FormValue("format")]; ok {
+		return format
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil || params["q"] == "0" {
+			continue
+		}
+		switch mediaType {
+		case "text/plain":
+			return textFormat
+		case "application/json":
+			return jsonFormat
+		case "application/cbor":
+			return cborFormat
+		}
+	}
+	return textFormat
+}
+
+// errDeviceRead is the JSON error code of a failed read of the device
+const errDeviceRead = "device_read_failed"
+
+// writeError responds with message as plain text, or, to a client that
+// negotiated JSON, with {"error":code}, so that it need not parse prose.
+func writeError(w http.ResponseWriter, r *http.Request, status int, message, code string) {
+	if negotiateFormat(r).name != jsonFormat.name {
+		http.Error(w, message, status)
+		return
+	}
+	w.Header().Set("Content-Type", jsonFormat.contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+// multiSeedFormats are the formats that can carry several seeds
+var multiSeedFormats = map[string]bool{"text": true, "labeled": true, "json": true}
+
+// encodeSeeds encodes a challenge response with several seeds: as a line
+// of hex for each in the text formats, or as a list of seeds in JSON.  The
+// lines of the text format are encoded by hexText, which may group them.
+func encodeSeeds(w io.Writer, format responseFormat, challengeResponse []byte, seeds [][]byte, hexText func([]byte) string) error {
+	hexSeeds := make([]string, len(seeds))
+	for i, seed := range seeds {
+		hexSeeds[i] = hex.EncodeToString(seed)
+	}
+	switch format.name {
+	case "json":
+		return json.NewEncoder(w).Encode(map[string]interface{}{
+			"challenge_response": hex.EncodeToString(challengeResponse),
+			"seeds":              hexSeeds,
+			"algorithm":          hashName,
+		})
+	case "labeled":
+		_, err := fmt.Fprintf(w, "challenge-response: %x\nseed: %s\nalgorithm: %s\n", challengeResponse, strings.Join(hexSeeds, "\nseed: "), hashName)
+		return err
+	}
+	lines := []string{hexText(challengeResponse)}
+	for _, seed := range seeds {
+		lines = append(lines, hexText(seed))
+	}
+	_, err := fmt.Fprintf(w, "%s\n", strings.Join(lines, "\n"))
+	return err
+}
+
+func encodeText(w io.Writer, challengeResponse, seed []byte) error {
+	_, err := fmt.Fprintf(w, "%x\n%x\n", challengeResponse, seed)
+	return err
+}
+
+// groupedText returns the text format with its hex split into groups of
+// size bytes, joined by separator, such as ab:cd:ef
+func groupedText(size int, separator string) func(w io.Writer, challengeResponse, seed []byte) error {
+	return func(w io.Writer, challengeResponse, seed []byte) error {
+		_, err := fmt.Fprintf(w, "%s\n%s\n", groupHex(challengeResponse, size, separator), groupHex(seed, size, separator))
+		return err
+	}
+}
+
+// hexText returns the hex of b, in groups of hexGroup bytes if set, as the
+// text format and /batch carry it
+func (p *PollenServer) hexText(b []byte) string {
+	if p.hexGroup > 0 {
+		return groupHex(b, p.hexGroup, p.hexSeparator)
+	}
+	return hex.EncodeToString(b)
+}
+
+func groupHex(b []byte, size int, separator string) string {
+	groups := make([]string, 0, len(b)/size+1)
+	for len(b) > size {
+		groups = append(groups, hex.EncodeToString(b[:size]))
+		b = b[size:]
+	}
+	groups = append(groups, hex.EncodeToString(b))
+	return strings.Join(groups, separator)
+}
+
+// encodeLabeled is the text format, with each line labeled, for debugging,
+// and a third line naming the hash
+func encodeLabeled(w io.Writer, challengeResponse, seed []byte) error {
+	_, err := fmt.Fprintf(w, "challenge-response: %x\nseed: %x\nalgorithm: %s\n", challengeResponse, seed, hashName)
+	return err
+}
+
+func encodeJSON(w io.Writer, challengeResponse, seed []byte) error {
+	return json.NewEncoder(w).Encode(map[string]string{
+		"challenge_response": hex.EncodeToString(challengeResponse),
+		"seed":               hex.EncodeToString(seed),
+		"algorithm":          hashName,
+	})
+}
+
+// CBOR major types, from RFC 8949
+const (
+	cborBytes = 2 << 5
+	cborText  = 3 << 5
+	cborMap   = 5 << 5
+)
+
+// cborHead appends the head of a CBOR data item of the given major type and
+// argument, such as a length.
+func cborHead(b []byte, major byte, n int) []byte {
+	switch {
+	case n < 24:
+		return append(b, major|byte(n))
+	case n < 1<<8:
+		return append(b, major|24, byte(n))
+	default:
+		return append(b, major|25, byte(n>>8), byte(n))
+	}
+}
+
+func encodeCBOR(w io.Writer, challengeResponse, seed []byte) error {
+	b := cborHead(nil, cborMap, 2)
+	b = cborHead(b, cborText, len("challenge_response"))
+	b = append(b, "challenge_response"...)
+	b = cborHead(b, cborBytes, len(challengeResponse))
+	b = append(b, challengeResponse...)
+	b = cborHead(b, cborText, len("seed"))
+	b = append(b, "seed"...)
+	b = cborHead(b, cborBytes, len(seed))
+	b = append(b, seed...)
+	_, err := w.Write(b)
+	return err
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestJSONContent tests the JSON encoding of a canned response
+func TestJSONContent(t *testing.T) {
+	s := NewSuiteWithDev(t, bytes.NewBufferString(DilbertRandom))
+	defer s.TearDown()
+
+	res := s.GetAccepting("application/json")
+	defer res.Body.Close()
+	s.Assert(res.Header.Get("Content-Type") == "application/json", "wrong content type:", res.Header.Get("Content-Type"))
+	var body map[string]string
+	err := json.NewDecoder(res.Body).Decode(&body)
+	s.Assert(err == nil, "json error:", err)
+	s.Assert(body["challenge_response"] == PorkChopSha512, "expected:", PorkChopSha512, "got:", body["challenge_response"])
+	expectedSeed := fmt.Sprintf("%x", cannedSeed())
+	s.Assert(body["seed"] == expectedSeed, "expected:", expectedSeed, "got:", body["seed"])
+}
+
+// decodeCBORMap decodes a CBOR map of text keys to byte strings, of the
+// sizes pollen sends.
+func decodeCBORMap(b []byte) (map[string][]byte, error) {
+	next := func(major byte) (int, error) {
+		if len(b) == 0 || b[0]&0xe0 != major {
+			return 0, fmt.Errorf("expected major type %d", major>>5)
+		}
+		n := int(b[0] & 0x1f)
+		b = b[1:]
+		if n == 24 {
+			n = int(b[0])
+			b = b[1:]
+		}
+		return n, nil
+	}
+	pairs, err := next(cborMap)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string][]byte)
+	for i := 0; i < pairs; i++ {
+		n, err := next(cborText)
+		if err != nil {
+			return nil, err
+		}
+		key := string(b[:n])
+		b = b[n:]
+		if n, err = next(cborBytes); err != nil {
+			return nil, err
+		}
+		m[key] = b[:n]
+		b = b[n:]
+	}
+	if len(b) != 0 {
+		return nil, fmt.Errorf("%d trailing bytes", len(b))
+	}
+	return m, nil
+}
+
+// TestCBORContent tests the CBOR encoding of a canned response matches the hex encoding
+func TestCBORContent(t *testing.T) {
+	s := NewSuiteWithDev(t, bytes.NewBufferString(DilbertRandom))
+	defer s.TearDown()
+
+	res := s.GetAccepting("text/html;q=0.9, application/cbor")
+	defer res.Body.Close()
+	s.Assert(res.Header.Get("Content-Type") == "application/cbor", "wrong content type:", res.Header.Get("Content-Type"))
+	raw, err := ioutil.ReadAll(res.Body)
+	s.Assert(err == nil, "read error:", err)
+	body, err := decodeCBORMap(raw)
+	s.Assert(err == nil, "cbor error:", err)
+	chal := fmt.Sprintf("%x", body["challenge_response"])
+	s.Assert(chal == PorkChopSha512, "expected:", PorkChopSha512, "got:", chal)
+	s.Assert(bytes.Equal(body["seed"], cannedSeed()), "expected:", cannedSeed(), "got:", body["seed"])
+}
+
+// TestDefaultContent tests that unknown media types get the two line text format
+func TestDefaultContent(t *testing.T) {
+	s := NewSuiteWithDev(t, bytes.NewBufferString(DilbertRandom))
+	defer s.TearDown()
+
+	res := s.GetAccepting("text/html")
+	defer res.Body.Close()
+	chal, seed, err := ReadResp(res.Body)
+	s.Assert(err == nil, "response error:", err)
+	s.Assert(chal == PorkChopSha512, "expected:", PorkChopSha512, "got:", chal)
+	s.Assert(seed == fmt.Sprintf("%x", cannedSeed()), "got the wrong seed:", seed)
+}
+
+// TestLabeledContent tests that the labeled format carries the same values as the default format
+func TestLabeledContent(t *testing.T) {
+	s := NewSuiteWithDev(t, bytes.NewBufferString(DilbertRandom))
+	defer s.TearDown()
+
+	res, err := http.Get(s.URL + "?challenge=pork+chop+sandwiches&format=labeled")
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	chal, seed, err := ReadResp(res.Body)
+	s.Assert(err == nil, "response error:", err)
+	s.Assert(strings.HasPrefix(chal, "challenge-response: "), "missing challenge response label:", chal)
+	s.Assert(strings.HasPrefix(seed, "seed: "), "missing seed label:", seed)
+	chal = strings.TrimPrefix(chal, "challenge-response: ")
+	seed = strings.TrimPrefix(seed, "seed: ")
+	s.Assert(chal == PorkChopSha512, "expected:", PorkChopSha512, "got:", chal)
+	s.Assert(seed == fmt.Sprintf("%x", cannedSeed()), "got the wrong seed:", seed)
+}
+
+// TestHashAlgorithm tests that each format names the hash in use
+func TestHashAlgorithm(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+
+	for _, format := range []string{"text", "labeled", "json", "cbor"} {
+		res, err := http.Get(s.URL + "?challenge=pork+chop+sandwiches&format=" + format)
+		s.Assert(err == nil, "http client error:", err)
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		s.Assert(err == nil, "read error:", err)
+		s.Assert(res.Header.Get("X-Pollen-Hash") == hashName, format, "expected X-Pollen-Hash:", hashName, "got:", res.Header.Get("X-Pollen-Hash"))
+		switch format {
+		case "labeled":
+			lines := strings.Split(string(body), "\n")
+			s.Assert(len(lines) == 4 && lines[2] == "algorithm: "+hashName, "expected the algorithm line, got:", lines)
+		case "json":
+			var fields map[string]string
+			s.Assert(json.Unmarshal(body, &fields) == nil, "json error:", string(body))
+			s.Assert(fields["algorithm"] == hashName, "expected the algorithm field, got:", fields)
+		}
+	}
+}
+
+// TestFormatParameter tests that the format parameter overrides the Accept header
+func TestFormatParameter(t *testing.T) {
+	s := NewSuiteWithDev(t, bytes.NewBufferString(DilbertRandom))
+	defer s.TearDown()
+
+	req, err := http.NewRequest("GET", s.URL+"?challenge=pork+chop+sandwiches&format=text", nil)
+	s.Assert(err == nil, "request error:", err)
+	req.Header.Set("Accept", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	chal, _, err := ReadResp(res.Body)
+	s.Assert(err == nil, "response error:", err)
+	s.Assert(chal == PorkChopSha512, "expected:", PorkChopSha512, "got:", chal)
+}
+
+// TestGroupedHex tests that grouped hex carries the same bytes as plain hex
+func TestGroupedHex(t *testing.T) {
+	s := NewSuiteWithDev(t, bytes.NewBufferString(DilbertRandom))
+	defer s.TearDown()
+
+	s.pollen.hexGroup = 1
+	s.pollen.hexSeparator = ":"
+	res, err := http.Get(s.URL + "?challenge=pork+chop+sandwiches")
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	chal, seed, err := ReadResp(res.Body)
+	s.Assert(err == nil, "response error:", err)
+	s.Assert(strings.HasPrefix(chal, "a7:57:51:cc:"), "expected grouped hex, got:", chal)
+	s.Assert(CheckHex(chal) != nil, "expected the separators to break plain hex")
+	chal = strings.Replace(chal, ":", "", -1)
+	seed = strings.Replace(seed, ":", "", -1)
+	s.Assert(chal == PorkChopSha512, "expected:", PorkChopSha512, "got:", chal)
+	s.Assert(seed == fmt.Sprintf("%x", cannedSeed()), "got the wrong seed:", seed)
+}
+
+// TestGroupedHexCount tests that every seed of a count is grouped, as the
+// single seed is
+func TestGroupedHexCount(t *testing.T) {
+	s := NewSuiteWithDev(t, &counterSource{})
+	defer s.TearDown()
+	s.pollen.maxCount = 2
+	s.pollen.hexGroup = 4
+	s.pollen.hexSeparator = " "
+
+	res, err := http.Get(s.URL + "?challenge=pork+chop+sandwiches&count=2")
+	s.Assert(err == nil, "http client error:", err)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	s.Assert(err == nil, "response error:", err)
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	if len(lines) != 3 {
+		t.Fatal("expected a challenge response and 2 seeds, got:", string(body))
+	}
+	for i, line := range lines {
+		s.Assert(strings.Count(line, " ") == 15, "line", i, "expected 16 groups of 4 bytes, got:", line)
+	}
+	s.Assert(strings.Replace(lines[0], " ", "", -1) == PorkChopSha512, "expected:", PorkChopSha512, "got:", lines[0])
+}
+
+// TestGroupHex tests grouping with a remainder
+func TestGroupHex(t *testing.T) {
+	grouped := groupHex([]byte{0xab, 0xcd, 0xef, 0x01, 0x23}, 2, " ")
+	if grouped != "abcd ef01 23" {
+		t.Error("expected abcd ef01 23, got:", grouped)
+	}
+}
+
+// TestSeedBytes tests that X-Seed-Bytes gives the length of the seed, which
+// is the digest's, whatever the number of device bytes read
+func TestSeedBytes(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+	s.pollen.sizeRoutes = map[string]int{"/32": 32}
+	s.Config.Handler = s.pollen.mux()
+
+	for _, path := range []string{"/", "/32"} {
+		res, err := http.Get(s.URL + path + "?challenge=pork+chop+sandwiches")
+		s.Assert(err == nil, "http client error:", err)
+		_, seed, err := ReadResp(res.Body)
+		res.Body.Close()
+		s.Assert(err == nil, "response error:", err)
+		s.Assert(res.Header.Get("X-Seed-Bytes") == strconv.Itoa(len(seed)/2), path, "expected X-Seed-Bytes of the seed's", len(seed)/2, "bytes, got:", res.Header.Get("X-Seed-Bytes"))
+		s.Assert(res.Header.Get("X-Seed-Bytes") == "64", path, "expected 64 seed bytes, got:", res.Header.Get("X-Seed-Bytes"))
+	}
+}
+
+// TestKeyBits tests that keybits cuts the seed to the key length, and that
+// unsupported key sizes are refused
+func TestKeyBits(t *testing.T) {
+	s := NewSuiteWithDev(t, bytes.NewBufferString(DilbertRandom))
+	defer s.TearDown()
+
+	res, err := http.Get(s.URL + "?challenge=pork+chop+sandwiches&keybits=256")
+	s.Assert(err == nil, "http client error:", err)
+	chal, seed, err := ReadResp(res.Body)
+	res.Body.Close()
+	s.Assert(err == nil, "response error:", err)
+	s.Assert(chal == PorkChopSha512, "expected:", PorkChopSha512, "got:", chal)
+	_, full := mix("pork chop sandwiches", []byte(DilbertRandom))
+	s.Assert(len(seed) == 64 && seed == fmt.Sprintf("%x", full[:32]), "expected the first 32 bytes of the seed, got:", seed)
+	s.Assert(res.Header.Get("X-Seed-Bytes") == "32", "expected X-Seed-Bytes of 32, got:", res.Header.Get("X-Seed-Bytes"))
+
+	for _, bits := range []string{"255", "100", "1024", "aes"} {
+		res, err := http.Get(s.URL + "?challenge=pork+chop+sandwiches&keybits=" + bits)
+		s.Assert(err == nil, "http client error:", err)
+		res.Body.Close()
+		s.Assert(res.StatusCode == http.StatusBadRequest, bits, "expected Bad Request, got:", res.Status)
+	}
+}
+
+// TestSeedCount tests that count=3 answers with three seeds, each mixing
+// the challenge with its own slice of a single device read
+func TestSeedCount(t *testing.T) {
+	device := make([]byte, 3*64+10)
+	(&counterSource{}).Read(device)
+	dev := bytes.NewBuffer(append([]byte(nil), device...))
+	s := NewSuiteWithDev(t, dev)
+	defer s.TearDown()
+	s.pollen.maxCount = 16
+
+	res, err := http.Get(s.URL + "?challenge=pork+chop+sandwiches&count=3")
+	s.Assert(err == nil, "http client error:", err)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	s.Assert(err == nil, "response error:", err)
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	if len(lines) != 4 {
+		t.Fatal("expected a challenge response and 3 seeds, got:", string(body))
+	}
+	s.Assert(lines[0] == PorkChopSha512, "expected:", PorkChopSha512, "got:", lines[0])
+	seen := map[string]bool{}
+	for i, seed := range lines[1:] {
+		_, expected := mix("pork chop sandwiches", device[i*64:(i+1)*64])
+		s.Assert(seed == fmt.Sprintf("%x", expected), "seed", i, "unexpected:", seed)
+		s.Assert(!seen[seed], "seed", i, "repeats:", seed)
+		seen[seed] = true
+	}
+	/* The device holds what was not read, and the 64 stirred bytes */
+	s.Assert(dev.Len() == 10+64, "expected 192 bytes read from the device, left:", dev.Len())
+
+	for _, query := range []string{"count=0", "count=17", "count=x", "count=2&format=cbor"} {
+		res, err := http.Get(s.URL + "?challenge=xxx&" + query)
+		s.Assert(err == nil, "http client error:", err)
+		res.Body.Close()
+		s.Assert(res.StatusCode == http.StatusBadRequest, query, "expected Bad Request, got:", res.Status)
+	}
+}
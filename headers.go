@@ -0,0 +1,69 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+var responseHeaders = headerList{}
+
+func init() {
+	flag.Var(&responseHeaders, "response-header", "A header, as \"Name: value\", to send with every response, errors included; may be repeated")
+}
+
+// headerList is a flag of response headers, taken from each of its uses
+type headerList http.Header
+
+func (h headerList) String() string {
+	var headers []string
+	for name, values := range h {
+		for _, value := range values {
+			headers = append(headers, name+": "+value)
+		}
+	}
+	return strings.Join(headers, ",")
+}
+
+func (h headerList) Set(value string) error {
+	name, val, ok := strings.Cut(value, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" || strings.ContainsAny(name, " \t\r\n") || strings.ContainsAny(val, "\r\n") {
+		return fmt.Errorf("invalid header %q, expected \"Name: value\"", value)
+	}
+	http.Header(h).Add(textproto.CanonicalMIMEHeaderKey(name), strings.TrimSpace(val))
+	return nil
+}
+
+// addHeaders sets the -response-header headers ahead of any handler, so
+// that they are sent however the response ends.
+func (p *PollenServer) addHeaders(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, values := range p.responseHeaders {
+			w.Header()[name] = append([]string(nil), values...)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
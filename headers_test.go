@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestHeadersOnError tests that the configured and common headers are sent
+// with an error, which is written without a superfluous WriteHeader
+func TestHeadersOnError(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+	var serverLog bytes.Buffer
+	s.Config.ErrorLog = log.New(&serverLog, "", 0)
+	headers := headerList{}
+	s.Assert(headers.Set("x-frame-options: DENY") == nil, "cannot set header")
+	s.Assert(headers.Set("no value") != nil, "expected an invalid header to fail")
+	s.pollen.responseHeaders = http.Header(headers)
+	s.Config.Handler = s.pollen.mux()
+
+	res, err := http.Get(s.URL + "?challenge=")
+	s.Assert(err == nil, "http client error:", err)
+	res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusBadRequest, "expected Bad Request, got:", res.Status)
+	s.Assert(res.Header.Get("X-Frame-Options") == "DENY", "expected the configured header, got:", res.Header)
+	s.Assert(res.Header.Get("Cache-Control") == "no-store", "expected no-store, got:", res.Header)
+	s.Assert(res.Header.Get("X-Request-Id") != "" && res.Header.Get("X-Pollen-Hash") == hashName, "expected the common headers, got:", res.Header)
+	s.Assert(!strings.Contains(serverLog.String(), "superfluous"), "unexpected server log:", serverLog.String())
+}
@@ -0,0 +1,97 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// maxHMACKeyBytes bounds a key posted to /admin/rotate-hmac
+const maxHMACKeyBytes = 1 << 10
+
+// loadHMACKey reads the whole of the file at path as a seed key
+func loadHMACKey(path string) ([]byte, error) {
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+	return key, nil
+}
+
+// keySeed returns the HMAC of the seed under the current key, if any, so
+// that only holders of the key could recompute a seed from its inputs.
+func (p *PollenServer) keySeed(seed []byte) []byte {
+	key := p.hmacKey.Load()
+	if key == nil {
+		return seed
+	}
+	mac := hmac.New(newHash, *key)
+	mac.Write(seed)
+	return mac.Sum(nil)
+}
+
+// serveRotateHMAC swaps in a new seed key, posted as the body, or else
+// reloaded from the -hmac-key-file, without a restart.  Seeds read from
+// then on use the new key, while challenge responses are unchanged.
+func (p *PollenServer) serveRotateHMAC(w http.ResponseWriter, r *http.Request) {
+	if !p.authorized(w, r) {
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, err := ioutil.ReadAll(io.LimitReader(r.Body, maxHMACKeyBytes+1))
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	if len(key) > maxHMACKeyBytes {
+		http.Error(w, fmt.Sprintf("A key must be at most %d bytes", maxHMACKeyBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	source := "the request"
+	if len(key) == 0 {
+		if p.hmacKeyFile == "" {
+			http.Error(w, "Post the new key, since there is no key file to reload", http.StatusBadRequest)
+			return
+		}
+		source = p.hmacKeyFile
+		if key, err = loadHMACKey(p.hmacKeyFile); err != nil {
+			p.log.ErrKV("Cannot reload HMAC key", "path", p.hmacKeyFile, "error", err, "at", time.Now().UnixNano())
+			http.Error(w, "Failed to reload the key file", http.StatusInternalServerError)
+			return
+		}
+	}
+	p.hmacKey.Store(&key)
+	/* The key itself is never logged */
+	p.log.InfoKV("Server rotated the HMAC key", "bytes", len(key), "source", source, "remote_addr", p.clientIP(r), "user_agent", r.UserAgent(), "at", time.Now().UnixNano())
+	w.WriteHeader(http.StatusNoContent)
+}
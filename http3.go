@@ -0,0 +1,68 @@
+//go:build http3
+
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+var http3Port = flag.String("http3-port", "", "The UDP port on which to serve HTTP/3, with the -cert and -key of HTTPS, or empty not to")
+
+func init() {
+	bindHTTP3 = func() (net.PacketConn, error) {
+		if *http3Port == "" {
+			return nil, nil
+		}
+		return net.ListenPacket("udp", fmt.Sprintf(":%s", *http3Port))
+	}
+	listenHTTP3 = func(p *PollenServer, mux http.Handler, config *tls.Config, bound *net.PacketConn) error {
+		if *http3Port == "" {
+			return nil
+		}
+		addr := fmt.Sprintf(":%s", *http3Port)
+		return p.supervise("http3", func() error {
+			conn := takeListener(bound)
+			if conn == nil {
+				var err error
+				if conn, err = net.ListenPacket("udp", addr); err != nil {
+					return err
+				}
+			}
+			defer conn.Close()
+			return newHTTP3Server(mux, config).Serve(conn)
+		}, *listenRetries, *listenRetryDelay)
+	}
+}
+
+// newHTTP3Server returns a server of mux over HTTP/3 with the certificate
+// of config, which must not be shared with HTTPS; each handshake then gets
+// a copy of it, since QUIC negotiates its own protocols.
+func newHTTP3Server(mux http.Handler, config *tls.Config) *http3.Server {
+	return &http3.Server{Handler: mux, TLSConfig: http3.ConfigureTLSConfig(config)}
+}
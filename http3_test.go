@@ -0,0 +1,140 @@
+//go:build http3
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+// memPacketConn is one end of an in-memory datagram pipe, which drops
+// datagrams when the other end falls behind, just as UDP would.
+type memPacketConn struct {
+	local, remote memAddr
+	in            <-chan []byte
+	out           chan<- []byte
+	closed        chan struct{}
+	closeOnce     sync.Once
+	mu            sync.Mutex
+	deadline      time.Time
+	wake          chan struct{}
+}
+
+// memPacketPipe returns both ends of an in-memory datagram pipe
+func memPacketPipe(a, b memAddr) (*memPacketConn, *memPacketConn) {
+	ab, ba := make(chan []byte, 256), make(chan []byte, 256)
+	return &memPacketConn{local: a, remote: b, in: ba, out: ab, closed: make(chan struct{}), wake: make(chan struct{})},
+		&memPacketConn{local: b, remote: a, in: ab, out: ba, closed: make(chan struct{}), wake: make(chan struct{})}
+}
+
+func (c *memPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		deadline, wake := c.deadline, c.wake
+		c.mu.Unlock()
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case datagram := <-c.in:
+			return copy(p, datagram), c.remote, nil
+		case <-c.closed:
+			return 0, nil, net.ErrClosed
+		case <-timeout:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-wake:
+		}
+	}
+}
+
+func (c *memPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case c.out <- bytes.Clone(p):
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	return len(p), nil
+}
+
+func (c *memPacketConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *memPacketConn) LocalAddr() net.Addr { return c.local }
+
+func (c *memPacketConn) SetDeadline(t time.Time) error { return c.SetReadDeadline(t) }
+
+func (c *memPacketConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	close(c.wake)
+	c.wake = make(chan struct{})
+	return nil
+}
+
+func (c *memPacketConn) SetWriteDeadline(time.Time) error { return nil }
+
+// TestHTTP3 tests that a challenge is answered over HTTP/3, across an
+// in-memory QUIC transport
+func TestHTTP3(t *testing.T) {
+	s := NewSuiteWithDev(t, bytes.NewBufferString(DilbertRandom))
+	defer s.TearDown()
+	/* Borrow httptest's certificate, which is good for example.com */
+	tlsServer := httptest.NewTLSServer(http.NotFoundHandler())
+	defer tlsServer.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(tlsServer.Certificate())
+
+	clientConn, serverConn := memPacketPipe("client", "server")
+	defer clientConn.Close()
+	config := newTLSConfig(false)
+	config.Certificates = tlsServer.TLS.Certificates
+	server := newHTTP3Server(s.pollen.mux(), config)
+	go server.Serve(serverConn)
+	defer server.Close()
+
+	transport := &http3.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+		Dial: func(ctx context.Context, addr string, tlsConfig *tls.Config, config *quic.Config) (*quic.Conn, error) {
+			return quic.DialEarly(ctx, clientConn, serverConn.LocalAddr(), tlsConfig, config)
+		},
+	}
+	defer transport.Close()
+	client := &http.Client{Transport: transport, Timeout: 10 * time.Second}
+	res, err := client.Get("https://example.com/?challenge=pork+chop+sandwiches")
+	s.Assert(err == nil, "http3 client error:", err)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	s.Assert(res.ProtoMajor == 3, "expected HTTP/3, got:", res.Proto)
+	chal, seed, err := ReadResp(res.Body)
+	s.Assert(err == nil, "response error:", err)
+	s.Assert(chal == PorkChopSha512, "expected:", PorkChopSha512, "got:", chal)
+	expectedSeed := fmt.Sprintf("%x", cannedSeed())
+	s.Assert(seed == expectedSeed, "expected:", expectedSeed, "got:", seed)
+}
@@ -0,0 +1,275 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// listen opens the TCP listener for addr, wrapped as the flags require
+func listen(addr string, log logger) (net.Listener, error) {
+	var ln net.Listener
+	var err error
+	if *listenBacklog > 0 {
+		ln, err = listenWithBacklog(addr, *listenBacklog, *reusePort)
+	} else {
+		ln, err = listenConfig(*reusePort).Listen(context.Background(), "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ln = &acceptLogListener{Listener: ln, log: log}
+	if *maxConnections > 0 {
+		ln = newLimitListener(ln, *maxConnections)
+	}
+	if *proxyProtocol {
+		ln = &proxyListener{Listener: ln}
+	}
+	return ln, nil
+}
+
+// listenConfig returns the configuration of the service sockets, setting
+// SO_REUSEPORT if reusePort, so that several processes may share a port
+func listenConfig(reusePort bool) *net.ListenConfig {
+	if !reusePort {
+		return &net.ListenConfig{}
+	}
+	return &net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		if soReusePort == 0 {
+			return errors.New("SO_REUSEPORT is not supported on this platform")
+		}
+		var err error
+		if controlErr := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+		}); controlErr != nil {
+			return controlErr
+		}
+		return os.NewSyscallError("setsockopt", err)
+	}}
+}
+
+// maxAcceptDelay bounds the backoff after a transient accept error
+const maxAcceptDelay = time.Second
+
+// acceptLogListener retries transient accept errors, such as running out of
+// file descriptors, as the http package would, but logs each one as an error
+// rather than leaving them silent.
+type acceptLogListener struct {
+	net.Listener
+	log logger
+}
+
+func (l *acceptLogListener) Accept() (net.Conn, error) {
+	var delay time.Duration
+	for {
+		conn, err := l.Listener.Accept()
+		if err == nil {
+			return conn, nil
+		}
+		var transient interface{ Temporary() bool }
+		if !errors.As(err, &transient) || !transient.Temporary() {
+			return nil, err
+		}
+		if delay == 0 {
+			delay = 5 * time.Millisecond
+		} else if delay *= 2; delay > maxAcceptDelay {
+			delay = maxAcceptDelay
+		}
+		l.log.ErrKV("Cannot accept connection", "addr", l.Addr(), "reason", err, "retry", delay, "at", time.Now().UnixNano())
+		time.Sleep(delay)
+	}
+}
+
+// limitListener accepts at most a fixed number of simultaneous connections,
+// leaving any more waiting in the kernel's listen queue until one closes.
+type limitListener struct {
+	net.Listener
+	slots chan struct{}
+}
+
+func newLimitListener(ln net.Listener, n int) *limitListener {
+	return &limitListener{Listener: ln, slots: make(chan struct{}, n)}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	l.slots <- struct{}{}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+	return &limitConn{Conn: conn, release: func() { <-l.slots }}, nil
+}
+
+// limitConn frees its listener slot when first closed
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// proxyHeaderTimeout bounds how long a new connection may take to send its
+// PROXY protocol header
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV2Signature starts every version 2 PROXY protocol header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyListener accepts connections from a load balancer that begins each
+// one with a PROXY protocol (version 1 or 2) header, naming the real client.
+type proxyListener struct {
+	net.Listener
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyConn reads its PROXY protocol header on first use, rather than in
+// Accept, so that a slow load balancer cannot stall the accept loop.
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+	c.remote, c.err = readProxyHeader(c.reader)
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address from the PROXY protocol header, or
+// the load balancer's address if the header does not carry one.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a version 1 or 2 PROXY protocol header, returning
+// the source address it carries, or nil for a LOCAL or UNKNOWN connection.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(len(proxyV2Signature))
+	if err != nil && !(err == io.EOF && len(start) > 0) {
+		return nil, err
+	}
+	if bytes.Equal(start, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if bytes.HasPrefix(start, []byte("PROXY ")) {
+		return readProxyV1(r)
+	}
+	return nil, fmt.Errorf("proxy protocol: missing header")
+}
+
+// readProxyV1 reads a header like "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, fmt.Errorf("proxy protocol: %s", err)
+	}
+	/* The longest version 1 header is 107 bytes */
+	if len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("proxy protocol: malformed header")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("proxy protocol: malformed header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("proxy protocol: malformed source address")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a binary header, after its signature
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("proxy protocol: %s", err)
+	}
+	versionCommand, family := header[12], header[13]
+	addrs := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, addrs); err != nil {
+		return nil, fmt.Errorf("proxy protocol: %s", err)
+	}
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("proxy protocol: unsupported version %d", versionCommand>>4)
+	}
+	/* A LOCAL command is the load balancer itself, such as a health check */
+	if versionCommand&0xf == 0 {
+		return nil, nil
+	}
+	switch family >> 4 {
+	case 1:
+		if len(addrs) < 12 {
+			return nil, fmt.Errorf("proxy protocol: short IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[0:4]), Port: int(binary.BigEndian.Uint16(addrs[8:]))}, nil
+	case 2:
+		if len(addrs) < 36 {
+			return nil, fmt.Errorf("proxy protocol: short IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[0:16]), Port: int(binary.BigEndian.Uint16(addrs[32:]))}, nil
+	}
+	return nil, nil
+}
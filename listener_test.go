@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// NewProxySuite starts the suite's server behind a PROXY protocol listener
+func NewProxySuite(t *testing.T) *Suite {
+	s := NewSuite(t)
+	s.Server.Close()
+	logger := s.logger
+	s.Server = httptest.NewUnstartedServer(s.pollen.mux())
+	s.Server.Listener = &proxyListener{Listener: s.Server.Listener}
+	s.Server.Start()
+	s.logger = logger
+	return s
+}
+
+// TestProxyProtocolV1 tests that the handler sees the client address from a version 1 header
+func TestProxyProtocolV1(t *testing.T) {
+	s := NewProxySuite(t)
+	defer s.TearDown()
+
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\nGET /?challenge=xxx HTTP/1.0\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	chal, seed, err := ReadResp(res.Body)
+	s.Assert(err == nil, "response err:", err)
+	s.SanityCheck(chal, seed)
+	s.Assert(len(s.logger.logs) == 2, "expected 2 log messages, got:", len(s.logger.logs))
+	for _, entry := range s.logger.logs {
+		s.Assert(strings.Contains(entry.message, " remote_addr=192.0.2.1:56324 "), "expected the proxied address, got:", entry.message)
+	}
+}
+
+// TestProxyProtocolMissing tests that a connection without a header never reaches the handler
+func TestProxyProtocolMissing(t *testing.T) {
+	s := NewProxySuite(t)
+	defer s.TearDown()
+
+	res, err := http.Get(s.URL + "?challenge=xxx")
+	if err == nil {
+		res.Body.Close()
+		s.Assert(res.StatusCode == http.StatusBadRequest, "didn't get Bad Request, got:", res.Status)
+	}
+	s.Assert(len(s.logger.logs) == 0, "expected no log messages, got:", s.logger.logs)
+}
+
+// TestProxyProtocolV2 tests parsing the binary version 2 header
+func TestProxyProtocolV2(t *testing.T) {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x21, 0x11, 0, 12)
+	header = append(header, 192, 0, 2, 1, 192, 0, 2, 2, 0xdc, 0x04, 0x01, 0xbb)
+	r := bufio.NewReader(bytes.NewReader(append(header, "GET"...)))
+	addr, err := readProxyHeader(r)
+	if err != nil || addr.String() != "192.0.2.1:56324" {
+		t.Error("expected 192.0.2.1:56324, got:", addr, err)
+	}
+	rest, _ := r.ReadString(0)
+	if rest != "GET" {
+		t.Error("header not fully consumed, got:", rest)
+	}
+
+	local := append([]byte{}, proxyV2Signature...)
+	local = append(local, 0x20, 0x00, 0, 0)
+	addr, err = readProxyHeader(bufio.NewReader(bytes.NewReader(local)))
+	if err != nil || addr != nil {
+		t.Error("expected no address for a LOCAL command, got:", addr, err)
+	}
+}
+
+// TestLimitListener tests that connections beyond the limit wait until others close
+func TestLimitListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen error:", err)
+	}
+	ln := newLimitListener(inner, 2)
+	defer ln.Close()
+	accepted := make(chan net.Conn, 3)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal("dial error:", err)
+		}
+		defer conn.Close()
+	}
+	first, second := <-accepted, <-accepted
+	select {
+	case <-accepted:
+		t.Fatal("accepted a connection beyond the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+	first.Close()
+	select {
+	case third := <-accepted:
+		third.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("the waiting connection was not accepted after another closed")
+	}
+	second.Close()
+	/* A second close must not free another slot */
+	first.Close()
+	/* Only the next pending Accept may hold a slot */
+	if len(ln.slots) > 1 {
+		t.Error("expected the slots freed, got:", len(ln.slots))
+	}
+}
+
+// transientError is an accept error worth retrying, like EMFILE
+type transientError struct{}
+
+func (transientError) Error() string   { return "too many open files" }
+func (transientError) Temporary() bool { return true }
+
+// flakyListener fails its first Accept with a transient error
+type flakyListener struct {
+	net.Listener
+	failed bool
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if !l.failed {
+		l.failed = true
+		return nil, transientError{}
+	}
+	return l.Listener.Accept()
+}
+
+// TestAcceptErrorLogged tests that a transient accept error is logged and serving continues
+func TestAcceptErrorLogged(t *testing.T) {
+	s := NewSuite(t)
+	s.Server.Close()
+	logger := s.logger
+	s.Server = httptest.NewUnstartedServer(s.pollen.mux())
+	s.Server.Listener = &acceptLogListener{Listener: &flakyListener{Listener: s.Server.Listener}, log: logger}
+	s.Server.Start()
+	defer s.TearDown()
+
+	res, err := http.Get(s.URL + "?challenge=xxx")
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	chal, seed, err := ReadResp(res.Body)
+	s.Assert(err == nil, "response err:", err)
+	s.SanityCheck(chal, seed)
+	start := "Cannot accept connection addr="
+	s.Assert(len(s.logger.logs) == 3, "expected 3 log messages, got:", len(s.logger.logs))
+	s.Assert(s.logger.logs[0].severity == "err" && strings.HasPrefix(s.logger.logs[0].message, start),
+		"didn't get the expected error message, got:", s.logger.logs[0])
+}
+
+// TestListenBacklog tests listening with an explicit backlog
+func TestListenBacklog(t *testing.T) {
+	ln, err := listenWithBacklog("127.0.0.1:0", 16, false)
+	if err != nil {
+		t.Fatal("listen error:", err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Write([]byte("ok"))
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer conn.Close()
+	reply := make([]byte, 2)
+	if _, err := conn.Read(reply); err != nil || string(reply) != "ok" {
+		t.Error("expected ok, got:", string(reply), err)
+	}
+}
+
+// TestReusePort tests that two listeners with SO_REUSEPORT share a port,
+// with and without an explicit backlog
+func TestReusePort(t *testing.T) {
+	if soReusePort == 0 {
+		t.Skip("SO_REUSEPORT is not supported on this platform")
+	}
+	first, err := listenConfig(true).Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen error:", err)
+	}
+	defer first.Close()
+	second, err := listenConfig(true).Listen(context.Background(), "tcp", first.Addr().String())
+	if err != nil {
+		t.Fatal("cannot share the port:", err)
+	}
+	defer second.Close()
+	third, err := listenWithBacklog(first.Addr().String(), 16, true)
+	if err != nil {
+		t.Fatal("cannot share the port with a backlog:", err)
+	}
+	defer third.Close()
+	if _, err := net.Listen("tcp", first.Addr().String()); err == nil {
+		t.Error("expected a listener without SO_REUSEPORT to be refused the port")
+	}
+}
+
+// TestMaxHeaderBytes tests that oversized request headers are refused
+func TestMaxHeaderBytes(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+	server := httptest.NewUnstartedServer(s.pollen.mux())
+	server.Config.MaxHeaderBytes = 1024
+	server.Start()
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "?challenge=xxx")
+	s.Assert(err == nil, "http client error:", err)
+	res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusOK, "expected a small request to succeed, got:", res.Status)
+	/* The server allows some slack beyond the limit */
+	req, err := http.NewRequest("GET", server.URL+"?challenge=xxx", nil)
+	s.Assert(err == nil, "request error:", err)
+	req.Header.Set("X-Padding", strings.Repeat("x", 16*1024))
+	res, err = http.DefaultClient.Do(req)
+	s.Assert(err == nil, "http client error:", err)
+	res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusRequestHeaderFieldsTooLarge, "expected 431, got:", res.Status)
+}
@@ -0,0 +1,182 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	loadTestURL      = flag.String("loadtest", "", "Instead of serving, send challenges to this pollen URL for -loadtest-duration, and report the throughput, latency and errors")
+	loadTestWorkers  = flag.Int("loadtest-workers", 8, "The clients sending challenges at once for -loadtest")
+	loadTestDuration = flag.Duration("loadtest-duration", 10*time.Second, "How long -loadtest sends challenges")
+)
+
+// errSeedLength means a seed that is not the size of a SHA-512 sum
+var errSeedLength = errors.New("wrong seed length")
+
+// parseResponse parses the default text response, the challenge response
+// and the seed, each a line of hex.  It is a re-implementation of the
+// parsing of pollinate, the shell client, which shares no code with the
+// server, so a change to the response format must be made in both.
+func parseResponse(body io.Reader) (challengeResponse, seed []byte, err error) {
+	scanner := bufio.NewScanner(body)
+	lines := make([][]byte, 2)
+	for i := range lines {
+		if !scanner.Scan() {
+			if err = scanner.Err(); err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, nil, err
+		}
+		if lines[i], err = hex.DecodeString(scanner.Text()); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(lines[1]) != sha512.Size {
+		return nil, nil, errSeedLength
+	}
+	return lines[0], lines[1], nil
+}
+
+// loadTestReport sums up a load test
+type loadTestReport struct {
+	requests int
+	failures int
+	elapsed  time.Duration
+	// latencies are those of the successful requests, sorted
+	latencies []time.Duration
+}
+
+// percentile returns the latency that p of the successful requests took
+// at most
+func (r *loadTestReport) percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	return r.latencies[int(p*float64(len(r.latencies)-1))]
+}
+
+func (r *loadTestReport) write(w io.Writer) {
+	errorRate := 0.0
+	if r.requests > 0 {
+		errorRate = 100 * float64(r.failures) / float64(r.requests)
+	}
+	fmt.Fprintf(w, "requests: %d\nfailures: %d (%.2f%%)\nthroughput: %.1f requests/s\n", r.requests, r.failures, errorRate, float64(r.requests-r.failures)/r.elapsed.Seconds())
+	fmt.Fprintf(w, "latency: p50 %s, p90 %s, p99 %s, max %s\n", r.percentile(0.5), r.percentile(0.9), r.percentile(0.99), r.percentile(1))
+}
+
+// loadTest sends random challenges to target from workers clients at once,
+// until ctx is done, checking each response as a client would.  Requests
+// cut short by ctx are not counted.
+func loadTest(ctx context.Context, client *http.Client, target string, workers int) *loadTestReport {
+	report := &loadTestReport{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < max(workers, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				requestStart := time.Now()
+				err := loadTestRequest(ctx, client, target)
+				latency := time.Since(requestStart)
+				if ctx.Err() != nil {
+					return
+				}
+				mu.Lock()
+				report.requests++
+				if err != nil {
+					report.failures++
+				} else {
+					report.latencies = append(report.latencies, latency)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	report.elapsed = time.Since(start)
+	sort.Slice(report.latencies, func(i, j int) bool { return report.latencies[i] < report.latencies[j] })
+	return report
+}
+
+// loadTestRequest sends one random challenge, failing unless the response
+// answers it
+func loadTestRequest(ctx context.Context, client *http.Client, target string) error {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+	challenge := hex.EncodeToString(random)
+	req, err := http.NewRequestWithContext(ctx, "GET", target+"?challenge="+url.QueryEscape(challenge), nil)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", res.Status)
+	}
+	challengeResponse, _, err := parseResponse(res.Body)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(challengeResponse, mixChallenge(challenge).Sum(nil)) {
+		return errors.New("wrong challenge response")
+	}
+	return nil
+}
+
+// runLoadTest runs -loadtest, reporting to w
+func runLoadTest(w io.Writer) error {
+	if _, err := url.ParseRequestURI(*loadTestURL); err != nil {
+		return fmt.Errorf("Invalid -loadtest URL: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *loadTestDuration)
+	defer cancel()
+	/* Each worker keeps its connection alive between requests */
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: max(*loadTestWorkers, 1)}}
+	report := loadTest(ctx, client, *loadTestURL, *loadTestWorkers)
+	report.write(w)
+	if report.requests == report.failures {
+		return errors.New("No request succeeded")
+	}
+	return nil
+}
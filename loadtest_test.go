@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLoadTest tests a short burst of the load generator against a server
+func TestLoadTest(t *testing.T) {
+	s := NewSuiteWithDev(t, &counterSource{})
+	defer s.TearDown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	report := loadTest(ctx, &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 4}}, s.URL+"/", 4)
+	s.Assert(report.requests > 0, "expected requests sent, got:", report.requests)
+	s.Assert(report.failures == 0, "expected no failures, got:", report.failures)
+	s.Assert(len(report.latencies) == report.requests, "expected a latency for each request, got:", len(report.latencies))
+	var out bytes.Buffer
+	report.write(&out)
+	s.Assert(strings.HasPrefix(out.String(), "requests: ") && strings.Contains(out.String(), "latency: p50 "), "unexpected report:", out.String())
+
+	/* A server answering the wrong challenge fails every request */
+	wrong := NewSuiteWithDev(t, &counterSource{})
+	defer wrong.TearDown()
+	wrong.pollen.challengePrefix = "wrong"
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	report = loadTest(ctx, http.DefaultClient, wrong.URL+"/", 1)
+	s.Assert(report.requests > 0 && report.failures == report.requests, "expected every request to fail, got:", report.failures, "of", report.requests)
+}
+
+// TestParseResponse tests that the load generator refuses malformed responses
+func TestParseResponse(t *testing.T) {
+	seed := strings.Repeat("ab", 64)
+	for body, want := range map[string]error{
+		"00\n" + seed + "\n":                     nil,
+		"00\n":                                   io.ErrUnexpectedEOF,
+		"00\n" + seed[:126] + "\n":               errSeedLength,
+		"00\n" + strings.Repeat("ab", 65) + "\n": errSeedLength,
+	} {
+		if _, _, err := parseResponse(strings.NewReader(body)); err != want {
+			t.Errorf("parsing %q, expected %v, got: %v", body, want, err)
+		}
+	}
+	if _, _, err := parseResponse(strings.NewReader("00\nxyz\n")); err == nil {
+		t.Error("expected a bad hex seed to fail")
+	}
+}
@@ -0,0 +1,241 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// openLog connects to the local syslog, or to a remote one at addr over
+// network.  If syslog cannot be reached, it logs to fallback instead,
+// beginning with an error saying why.
+func openLog(network, addr string, priority syslog.Priority, tag string, fallback io.Writer) logger {
+	var w *syslog.Writer
+	var err error
+	if addr != "" {
+		w, err = syslog.Dial(network, addr, priority, tag)
+	} else {
+		w, err = syslog.New(priority, tag)
+	}
+	if err == nil {
+		return &syslogLogger{w: w, network: network, addr: addr, priority: priority, tag: tag}
+	}
+	log := &writerLogger{w: fallback, tag: tag}
+	log.Err(fmt.Sprintf("Cannot open syslog, logging here instead: %s", err))
+	return log
+}
+
+// flattenKV renders a structured message as text, as
+// "msg key=value key=value", quoting any value that needs it.
+func flattenKV(msg string, kv []interface{}) string {
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i < len(kv); i += 2 {
+		var value interface{} = "?"
+		if i+1 < len(kv) {
+			value = kv[i+1]
+		}
+		text := fmt.Sprint(value)
+		if text == "" || strings.ContainsAny(text, " \t\n\"=") {
+			text = strconv.Quote(text)
+		}
+		fmt.Fprintf(&b, " %v=%s", kv[i], text)
+	}
+	return b.String()
+}
+
+// sampleLog reports whether to log the next request served, being 1 in
+// every logSampling
+func (p *PollenServer) sampleLog() bool {
+	if p.logSampling <= 1 {
+		return true
+	}
+	return p.logCount.Add(1)%uint64(p.logSampling) == 1
+}
+
+// openLogFile logs to the file at path, appending to it, and reopening it
+// on Reopen, for log rotation.
+func openLogFile(path, tag string) (logger, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &writerLogger{w: f, tag: tag, path: path}, nil
+}
+
+// reopenLogOnHangup reopens the log on each SIGHUP, so that pollen lets go
+// of a log file, or syslog connection, that has been rotated away.
+func reopenLogOnHangup(log logger) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	for range hangups {
+		if err := log.Reopen(); err != nil {
+			/* The old log is kept, so this may yet be seen */
+			log.Err(fmt.Sprintf("Cannot reopen the log: %s", err))
+			continue
+		}
+		log.Info("Reopened the log")
+	}
+}
+
+// syslogLogger flattens structured messages into syslog's text.  The
+// connection is swapped on Reopen, so every write holds mu.
+type syslogLogger struct {
+	mu            sync.RWMutex
+	w             *syslog.Writer
+	network, addr string
+	priority      syslog.Priority
+	tag           string
+}
+
+func (l *syslogLogger) Close() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.w.Close()
+}
+
+func (l *syslogLogger) Info(msg string) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.w.Info(msg)
+}
+
+func (l *syslogLogger) Err(msg string) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.w.Err(msg)
+}
+
+func (l *syslogLogger) Crit(msg string) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.w.Crit(msg)
+}
+
+func (l *syslogLogger) Emerg(msg string) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.w.Emerg(msg)
+}
+
+// Reopen connects to syslog afresh, closing the old connection only once
+// the new one is in place
+func (l *syslogLogger) Reopen() error {
+	var w *syslog.Writer
+	var err error
+	if l.addr != "" {
+		w, err = syslog.Dial(l.network, l.addr, l.priority, l.tag)
+	} else {
+		w, err = syslog.New(l.priority, l.tag)
+	}
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	old := l.w
+	l.w = w
+	l.mu.Unlock()
+	return old.Close()
+}
+
+func (l *syslogLogger) InfoKV(msg string, kv ...interface{}) error {
+	return l.Info(flattenKV(msg, kv))
+}
+
+func (l *syslogLogger) ErrKV(msg string, kv ...interface{}) error {
+	return l.Err(flattenKV(msg, kv))
+}
+
+// writerLogger logs a line per message to a writer, such as stderr, or to
+// the file at path, if set
+type writerLogger struct {
+	mu   sync.Mutex
+	w    io.Writer
+	tag  string
+	path string
+}
+
+func (l *writerLogger) write(severity, msg string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := fmt.Fprintf(l.w, "%s %s[%s]: %s\n", time.Now().Format(time.RFC3339), l.tag, severity, msg)
+	return err
+}
+
+func (l *writerLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if closer, ok := l.w.(io.Closer); ok && l.path != "" {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Reopen opens the file at path afresh, such as once it has been renamed
+// by log rotation.  A logger to a writer it did not open has nothing to
+// reopen.
+func (l *writerLogger) Reopen() error {
+	if l.path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	old := l.w.(io.Closer)
+	l.w = f
+	l.mu.Unlock()
+	return old.Close()
+}
+
+func (l *writerLogger) Info(msg string) error {
+	return l.write("info", msg)
+}
+
+func (l *writerLogger) Err(msg string) error {
+	return l.write("err", msg)
+}
+
+func (l *writerLogger) Crit(msg string) error {
+	return l.write("crit", msg)
+}
+
+func (l *writerLogger) Emerg(msg string) error {
+	return l.write("emerg", msg)
+}
+
+func (l *writerLogger) InfoKV(msg string, kv ...interface{}) error {
+	return l.Info(flattenKV(msg, kv))
+}
+
+func (l *writerLogger) ErrKV(msg string, kv ...interface{}) error {
+	return l.Err(flattenKV(msg, kv))
+}
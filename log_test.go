@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"log/syslog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRemoteSyslog tests logging to a syslog server over UDP
+func TestRemoteSyslog(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen error:", err)
+	}
+	defer server.Close()
+	var fallback bytes.Buffer
+	log := openLog("udp", server.LocalAddr().String(), syslog.LOG_LOCAL3|syslog.LOG_ERR, "pollen-test", &fallback)
+	defer log.Close()
+	log.Info("pork chop sandwiches")
+
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	packet := make([]byte, 1024)
+	n, _, err := server.ReadFrom(packet)
+	if err != nil {
+		t.Fatal("read error:", err)
+	}
+	msg := string(packet[:n])
+	// local3 is facility 19, and info is severity 6
+	if !strings.HasPrefix(msg, "<158>") || !strings.Contains(msg, "pollen-test") || !strings.Contains(msg, "pork chop sandwiches") {
+		t.Error("unexpected syslog message:", msg)
+	}
+	if fallback.Len() != 0 {
+		t.Error("unexpected fallback logging:", fallback.String())
+	}
+}
+
+// TestSyslogFallback tests logging to the fallback when syslog is unreachable
+func TestSyslogFallback(t *testing.T) {
+	/* Find a port that nothing listens on */
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen error:", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	var fallback bytes.Buffer
+	log := openLog("tcp", addr, syslog.LOG_ERR, "pollen-test", &fallback)
+	log.Info("pork chop sandwiches")
+	lines := strings.Split(strings.TrimSpace(fallback.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], "pollen-test[err]: Cannot open syslog") ||
+		!strings.Contains(lines[1], "pollen-test[info]: pork chop sandwiches") {
+		t.Error("unexpected fallback logging:", fallback.String())
+	}
+}
+
+// TestFlattenKV tests rendering structured messages as text
+func TestFlattenKV(t *testing.T) {
+	msg := flattenKV("Server sent response", []interface{}{"remote_addr", "192.0.2.1:56324", "user_agent", "curl/7.0 (x86)", "duration", 0.25, "empty", ""})
+	expected := `Server sent response remote_addr=192.0.2.1:56324 user_agent="curl/7.0 (x86)" duration=0.25 empty=""`
+	if msg != expected {
+		t.Error("expected:", expected, "got:", msg)
+	}
+	if msg = flattenKV("odd", []interface{}{"key"}); msg != "odd key=?" {
+		t.Error("expected a placeholder for a missing value, got:", msg)
+	}
+}
+
+// TestLogSampling tests that only 1 in -log-sampling requests is logged,
+// while every error is
+func TestLogSampling(t *testing.T) {
+	b := &OnlyReader{bytes.NewBufferString(strings.Repeat(DilbertRandom, 20))}
+	s := NewSuiteWithDev(t, b)
+	defer s.TearDown()
+	s.pollen.logSampling = 10
+
+	for i := 0; i < 20; i++ {
+		res, err := http.Get(s.URL + "?challenge=xxx")
+		if err != nil {
+			t.Fatal("http client error:", err)
+		}
+		res.Body.Close()
+	}
+	infos, errs := 0, 0
+	for _, log := range s.logger.Logs() {
+		switch log.severity {
+		case "info":
+			infos++
+		case "err":
+			errs++
+		}
+	}
+	/* Each sampled request logs its challenge and its response */
+	s.Assert(infos == 4, "expected 2 of 20 requests logged, got info lines:", infos)
+	s.Assert(errs == 20, "expected every write failure logged, got:", errs)
+}
+
+// TestReopenLogFile tests that a file logger reopens its file once it has
+// been renamed away, as by log rotation
+func TestReopenLogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pollen.log")
+	log, err := openLogFile(path, "pollen-test")
+	if err != nil {
+		t.Fatal("cannot open log file:", err)
+	}
+	defer log.Close()
+	log.Info("before rotation")
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	log.Info("still to the rotated file")
+	if err := log.Reopen(); err != nil {
+		t.Fatal("cannot reopen:", err)
+	}
+	log.Info("after rotation")
+
+	rotated, _ := os.ReadFile(path + ".1")
+	reopened, _ := os.ReadFile(path)
+	if !strings.Contains(string(rotated), "still to the rotated file") || strings.Contains(string(rotated), "after rotation") {
+		t.Error("expected the rotated file to end at the reopen, got:", string(rotated))
+	}
+	if !strings.Contains(string(reopened), "pollen-test[info]: after rotation") || strings.Contains(string(reopened), "before rotation") {
+		t.Error("expected the reopened file to begin at the reopen, got:", string(reopened))
+	}
+}
@@ -0,0 +1,83 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lru remembers the most recently seen keys, up to size of them, and how
+// many times each has been seen while remembered, or a value kept for each.
+type lru struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	items map[string]*list.Element
+}
+
+type lruEntry struct {
+	key   string
+	count int
+	value interface{}
+}
+
+func newLRU(size int) *lru {
+	return &lru{size: size, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+// see records key, returning how many times it has now been seen
+func (l *lru) see(key string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if elem, ok := l.items[key]; ok {
+		l.order.MoveToFront(elem)
+		entry := elem.Value.(*lruEntry)
+		entry.count++
+		return entry.count
+	}
+	l.push(&lruEntry{key: key, count: 1})
+	return 1
+}
+
+// fetch returns the value kept for key, or keeps and returns a new one from
+// create, forgetting the least recently used key to make room
+func (l *lru) fetch(key string, create func() interface{}) interface{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if elem, ok := l.items[key]; ok {
+		l.order.MoveToFront(elem)
+		return elem.Value.(*lruEntry).value
+	}
+	entry := &lruEntry{key: key, count: 1, value: create()}
+	l.push(entry)
+	return entry.value
+}
+
+// push remembers a new entry, forgetting the oldest beyond size
+func (l *lru) push(entry *lruEntry) {
+	l.items[entry.key] = l.order.PushFront(entry)
+	if l.order.Len() > l.size {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.items, oldest.Value.(*lruEntry).key)
+	}
+}
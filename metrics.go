@@ -0,0 +1,112 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// metrics are the counters and gauges served on /stats and /metrics
+type metrics struct {
+	activeConnections   atomic.Int64
+	activeStreams       atomic.Int64
+	duplicateChallenges atomic.Int64
+	qualityFailures     atomic.Int64
+	responseWriteErrors atomic.Int64
+	dnsDropped          atomic.Int64
+	deviceReadSeconds   histogram
+}
+
+// deviceReadBuckets are the upper bounds, in seconds, of the device read
+// histogram buckets
+var deviceReadBuckets = []float64{0.0001, 0.001, 0.01, 0.1, 1, 10}
+
+// histogram counts observed durations into deviceReadBuckets
+type histogram struct {
+	buckets [7]atomic.Int64
+	count   atomic.Int64
+	sumNano atomic.Int64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := sort.SearchFloat64s(deviceReadBuckets, d.Seconds())
+	h.buckets[i].Add(1)
+	h.count.Add(1)
+	h.sumNano.Add(int64(d))
+}
+
+// writePrometheus writes the histogram, with its cumulative buckets
+func (h *histogram) writePrometheus(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var cumulative int64
+	for i, le := range deviceReadBuckets {
+		cumulative += h.buckets[i].Load()
+		fmt.Fprintf(w, "%s_bucket{le=\"%v\"} %d\n", name, le, cumulative)
+	}
+	cumulative += h.buckets[len(deviceReadBuckets)].Load()
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, cumulative)
+	fmt.Fprintf(w, "%s_sum %v\n%s_count %d\n", name, time.Duration(h.sumNano.Load()).Seconds(), name, h.count.Load())
+}
+
+// stats returns the metrics by their /stats names
+func (m *metrics) stats() map[string]interface{} {
+	return map[string]interface{}{
+		"active_connections":          m.activeConnections.Load(),
+		"active_streams":              m.activeStreams.Load(),
+		"duplicate_challenge_total":   m.duplicateChallenges.Load(),
+		"quality_failure_total":       m.qualityFailures.Load(),
+		"response_write_errors_total": m.responseWriteErrors.Load(),
+		"dns_dropped_total":           m.dnsDropped.Load(),
+		"device_read_seconds_count":   m.deviceReadSeconds.count.Load(),
+		"device_read_seconds_sum":     time.Duration(m.deviceReadSeconds.sumNano.Load()).Seconds(),
+	}
+}
+
+// writePrometheus writes the metrics in the Prometheus text format
+func (m *metrics) writePrometheus(w io.Writer) {
+	writeMetric(w, "pollen_active_connections", "gauge", "Challenges currently being served.", m.activeConnections.Load())
+	writeMetric(w, "pollen_active_streams", "gauge", "Streams currently open.", m.activeStreams.Load())
+	writeMetric(w, "pollen_duplicate_challenge_total", "counter", "Challenges repeating a recently seen challenge.", m.duplicateChallenges.Load())
+	writeMetric(w, "pollen_quality_failure_total", "counter", "Samples of the random device that failed a quality check.", m.qualityFailures.Load())
+	writeMetric(w, "pollen_response_write_errors_total", "counter", "Responses that could not be written in full, mostly as the client went away.", m.responseWriteErrors.Load())
+	writeMetric(w, "pollen_dns_dropped_total", "counter", "DNS queries over UDP dropped beyond -dns-max-inflight.", m.dnsDropped.Load())
+	m.deviceReadSeconds.writePrometheus(w, "pollen_device_read_seconds", "Time spent reading the random device for each seed.")
+}
+
+func writeMetric(w io.Writer, name, kind, help string, value interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+}
+
+func (p *PollenServer) serveStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.metrics.stats())
+}
+
+func (p *PollenServer) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	p.metrics.writePrometheus(w)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// BlockingReader blocks reads until released, then serves nines
+type BlockingReader struct {
+	release chan struct{}
+}
+
+func NewBlockingReader() *BlockingReader {
+	return &BlockingReader{make(chan struct{})}
+}
+
+func (b *BlockingReader) Read(p []byte) (int, error) {
+	<-b.release
+	for i := range p {
+		p[i] = '9'
+	}
+	return len(p), nil
+}
+
+func (b *BlockingReader) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// Stats fetches and decodes /stats
+func (s *Suite) Stats() map[string]float64 {
+	res, err := http.Get(s.URL + "/stats")
+	if err != nil {
+		s.t.Fatal("http client error:", err)
+	}
+	defer res.Body.Close()
+	var stats map[string]float64
+	if err := json.NewDecoder(res.Body).Decode(&stats); err != nil {
+		s.t.Fatal("json error:", err)
+	}
+	return stats
+}
+
+// Metrics fetches /metrics
+func (s *Suite) Metrics() string {
+	res, err := http.Get(s.URL + "/metrics")
+	if err != nil {
+		s.t.Fatal("http client error:", err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		s.t.Fatal("read error:", err)
+	}
+	return string(body)
+}
+
+// TestActiveConnections tests the gauge of challenges being served
+func TestActiveConnections(t *testing.T) {
+	source := NewBlockingReader()
+	s := NewSuiteWithDev(t, source)
+	defer s.TearDown()
+
+	done := make(chan error)
+	go func() {
+		res, err := http.Get(s.URL + "?challenge=xxx")
+		if err == nil {
+			_, _, err = ReadResp(res.Body)
+			res.Body.Close()
+		}
+		done <- err
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Stats()["active_connections"] != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Assert(s.Stats()["active_connections"] == 1, "expected 1 active connection, got:", s.Stats())
+	s.Assert(strings.Contains(s.Metrics(), "\npollen_active_connections 1\n"), "expected the gauge at 1, got:", s.Metrics())
+	close(source.release)
+	err := <-done
+	s.Assert(err == nil, "response error:", err)
+	s.Assert(s.Stats()["active_connections"] == 0, "expected 0 active connections, got:", s.Stats())
+	s.Assert(strings.Contains(s.Metrics(), "\npollen_active_connections 0\n"), "expected the gauge at 0, got:", s.Metrics())
+}
+
+// SlowReader serves nines after a delay, like a failing hardware generator
+type SlowReader struct {
+	delay time.Duration
+}
+
+func (s SlowReader) Read(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	for i := range p {
+		p[i] = '9'
+	}
+	return len(p), nil
+}
+
+func (s SlowReader) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// TestSlowRead tests that slow device reads are logged and timed
+func TestSlowRead(t *testing.T) {
+	s := NewSuiteWithDev(t, SlowReader{20 * time.Millisecond})
+	defer s.TearDown()
+	s.pollen.slowReadThreshold = 10 * time.Millisecond
+
+	res, err := http.Get(s.URL + "?challenge=xxx")
+	s.Assert(err == nil, "http client error:", err)
+	_, _, err = ReadResp(res.Body)
+	res.Body.Close()
+	s.Assert(err == nil, "response err:", err)
+	found := false
+	for _, log := range s.logger.logs {
+		found = found || log.severity == "err" && strings.HasPrefix(log.message, "Slow read from random device duration=")
+	}
+	s.Assert(found, "didn't log the slow read, got:", s.logger.logs)
+	metrics := s.Metrics()
+	s.Assert(strings.Contains(metrics, "\npollen_device_read_seconds_bucket{le=\"0.01\"} 0\n") &&
+		strings.Contains(metrics, "\npollen_device_read_seconds_bucket{le=\"0.1\"} 1\n") &&
+		strings.Contains(metrics, "\npollen_device_read_seconds_count 1\n"),
+		"expected one read between 10ms and 100ms, got:", metrics)
+}
+
+// disconnectedWriter is a ResponseWriter whose client has gone away
+type disconnectedWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (disconnectedWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+// TestResponseWriteError tests that a response that cannot be written is
+// logged and counted
+func TestResponseWriteError(t *testing.T) {
+	s := NewSuiteWithDev(t, bytes.NewBufferString(DilbertRandom))
+	defer s.TearDown()
+
+	r := httptest.NewRequest("GET", "/?challenge=xxx", nil)
+	s.pollen.ServeHTTP(disconnectedWriter{httptest.NewRecorder()}, r)
+	found := false
+	for _, log := range s.logger.Logs() {
+		found = found || log.severity == "info" && strings.HasPrefix(log.message, "Client disconnected before response completed") && strings.Contains(log.message, "broken pipe")
+	}
+	s.Assert(found, "expected the failed write logged, got:", s.logger.Logs())
+	s.Assert(s.pollen.metrics.responseWriteErrors.Load() == 1, "expected 1 write error counted, got:", s.pollen.metrics.responseWriteErrors.Load())
+}
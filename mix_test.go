@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// MixVectors are golden challenge responses and seeds for DilbertRandom, so
+// that any reordering or double hashing in the mix is caught
+var MixVectors = []struct {
+	challenge         string
+	challengeResponse string
+	seed              string
+}{
+	{" ",
+		"f90ddd77e400dfe6a3fcf479b00b1ee29e7015c5bb8cd70f5f15b4886cc339275ff553fc8a053f8ddc7324f45168cffaf81f8c3ac93996f6536eef38e5e40768",
+		"7a48cf1e1abc74268dcd91fb3def7f2dc48799fea4c88755bdff3c3fdac916bc2ebc1392c6158fdad28950b8b701aafb5f5dce75b76f2865d68297e7dedc7856"},
+	{"0",
+		"31bca02094eb78126a517b206a88c73cfa9ec6f704c7030d18212cace820f025f00bf0ea68dbf3f3a5436ca63b53bf7bf80ad8d5de7d8359d0b7fed9dbc3ab99",
+		"4ca837d0d168f4364cd51da8f6ed79cc849454842d4dfca02f09b83101450a73f8bb0f89dee56faa7f085d0687febebae29c7644c5653b85ef91c6d8636e46a1"},
+	{"pollen \U0001F33C über",
+		"32bb3340e811b2bed63db1531e1c9ef007d1a983865dd4e8b6a9f66e2c164693c55fc98ea7da449f13e523d9dc039d30a3fda8ff240a9205336d910279099114",
+		"b8650850d9a0407b88cf1ba79100b93a68bff35e76ca7de2922b14633732547e9898d33469e7d97fe3bc1be47dbad5178f965f51d95db306f2194683547b11e3"},
+	{"pork chop sandwiches",
+		PorkChopSha512,
+		"587fe3be8ac396bc2a7be1254f8d87239bb7417ed36905c0bac9967c990e82fda102b3809eb69017315602022df7da60faeb7772dbae03d8be6f72faf552d9de"},
+}
+
+// TestMixGolden tests the mix against the golden vectors
+func TestMixGolden(t *testing.T) {
+	for _, vector := range MixVectors {
+		challengeResponse, seed := mix(vector.challenge, []byte(DilbertRandom))
+		if fmt.Sprintf("%x", challengeResponse) != vector.challengeResponse {
+			t.Errorf("%q expected challenge response %s, got: %x", vector.challenge, vector.challengeResponse, challengeResponse)
+		}
+		if fmt.Sprintf("%x", seed) != vector.seed {
+			t.Errorf("%q expected seed %s, got: %x", vector.challenge, vector.seed, seed)
+		}
+	}
+}
+
+// TestServedMixGolden tests that requests are mixed just as the golden vectors
+func TestServedMixGolden(t *testing.T) {
+	for _, vector := range MixVectors {
+		s := NewSuiteWithDev(t, bytes.NewBufferString(DilbertRandom))
+		res, err := http.Get(s.URL + "?challenge=" + url.QueryEscape(vector.challenge))
+		s.Assert(err == nil, "http client error:", err)
+		chal, seed, err := ReadResp(res.Body)
+		res.Body.Close()
+		s.Assert(err == nil, "response error:", err)
+		s.Assert(chal == vector.challengeResponse, vector.challenge, "expected:", vector.challengeResponse, "got:", chal)
+		s.Assert(seed == vector.seed, vector.challenge, "expected:", vector.seed, "got:", seed)
+		s.TearDown()
+	}
+}
+
+// TestMixDescription tests that the description names the hash in use
+func TestMixDescription(t *testing.T) {
+	expected := "challenge_response = sha512(challenge); seed = sha512(challenge || device bytes)"
+	if MixDescription() != expected {
+		t.Error("expected:", expected, "got:", MixDescription())
+	}
+}
+
+// TestDomainTag tests that the domain tag changes the seed, and only with
+// -domain-tag-challenge the challenge response, deterministically
+func TestDomainTag(t *testing.T) {
+	vector := MixVectors[3]
+	serve := func(tag string, challenge bool) (string, string) {
+		s := NewSuiteWithDev(t, bytes.NewBufferString(DilbertRandom))
+		defer s.TearDown()
+		s.pollen.domainTag = tag
+		s.pollen.domainTagChallenge = challenge
+		res, err := http.Get(s.URL + "?challenge=" + url.QueryEscape(vector.challenge))
+		s.Assert(err == nil, "http client error:", err)
+		defer res.Body.Close()
+		chal, seed, err := ReadResp(res.Body)
+		s.Assert(err == nil, "response error:", err)
+		return chal, seed
+	}
+	chal, seed := serve("", false)
+	if chal != vector.challengeResponse || seed != vector.seed {
+		t.Error("an empty tag changed the mix, got:", chal, seed)
+	}
+	chal, seed = serve("staging", false)
+	checksum := newHash()
+	fmt.Fprintf(checksum, "%s%s7:staging,", vector.challenge, DilbertRandom)
+	if chal != vector.challengeResponse {
+		t.Error("the tag changed the challenge response, got:", chal)
+	}
+	if seed != fmt.Sprintf("%x", checksum.Sum(nil)) {
+		t.Errorf("expected seed %x, got: %s", checksum.Sum(nil), seed)
+	}
+	if _, other := serve("production", false); other == seed {
+		t.Error("different tags served the same seed:", seed)
+	}
+	chal, seed = serve("staging", true)
+	checksum = newHash()
+	fmt.Fprintf(checksum, "7:staging,%s", vector.challenge)
+	if chal != fmt.Sprintf("%x", checksum.Sum(nil)) {
+		t.Errorf("expected challenge response %x, got: %s", checksum.Sum(nil), chal)
+	}
+	fmt.Fprintf(checksum, "%s7:staging,", DilbertRandom)
+	if seed != fmt.Sprintf("%x", checksum.Sum(nil)) {
+		t.Errorf("expected seed %x, got: %s", checksum.Sum(nil), seed)
+	}
+}
@@ -0,0 +1,112 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/bits"
+	"time"
+)
+
+// qualitySampleBytes is the 20000 bit sample of the FIPS 140-2 statistical tests
+const qualitySampleBytes = 2500
+
+// fipsRunBounds are the FIPS 140-2 bounds on the number of runs of each
+// length, 1 to 6 and longer, of both zeros and ones in a sample
+var fipsRunBounds = [6][2]int{{2315, 2685}, {1114, 1386}, {527, 723}, {240, 384}, {103, 209}, {103, 209}}
+
+// checkQuality runs the FIPS 140-2 monobit, runs and long run tests on a
+// sample, returning an error naming the first that fails.  Even good
+// randomness fails them now and then.
+func checkQuality(sample []byte) error {
+	ones := 0
+	for _, b := range sample {
+		ones += bits.OnesCount8(b)
+	}
+	if ones <= 9725 || ones >= 10275 {
+		return fmt.Errorf("monobit test failed with %d ones", ones)
+	}
+	var runs [2][6]int
+	run, last := 0, -1
+	for i := 0; i <= len(sample)*8; i++ {
+		bit := -1
+		if i < len(sample)*8 {
+			bit = int(sample[i/8]>>(7-i%8)) & 1
+		}
+		if bit == last {
+			run++
+			continue
+		}
+		if last >= 0 {
+			if run >= 26 {
+				return fmt.Errorf("long run test failed with a run of %d", run)
+			}
+			runs[last][min(run, 6)-1]++
+		}
+		run, last = 1, bit
+	}
+	for bit := range runs {
+		for length, count := range runs[bit] {
+			if count < fipsRunBounds[length][0] || count > fipsRunBounds[length][1] {
+				return fmt.Errorf("runs test failed with %d runs of %d %ds", count, length+1, bit)
+			}
+		}
+	}
+	return nil
+}
+
+// monitorEntropy checks a sample of the device every interval, even
+// without traffic, holding the server out of readiness while the last
+// failures samples have all failed, until ctx is done.
+func (p *PollenServer) monitorEntropy(ctx context.Context, interval time.Duration, failures int) {
+	failed := 0
+	sample := make([]byte, qualitySampleBytes)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		_, err := io.ReadFull(p.randomSource, sample)
+		if err == nil {
+			err = checkQuality(sample)
+		}
+		if err != nil {
+			failed++
+			p.metrics.qualityFailures.Add(1)
+			p.log.ErrKV("Random device failed a quality check", "reason", err, "at", time.Now().UnixNano())
+			if failed == failures {
+				p.log.Crit(flattenKV("Random device failed quality checks in a row, reporting not ready", []interface{}{"failures", failed, "at", time.Now().UnixNano()}))
+				p.failingQuality.Store(true)
+			}
+			continue
+		}
+		if failed >= failures {
+			p.log.InfoKV("Random device passed a quality check, reporting ready", "at", time.Now().UnixNano())
+			p.failingQuality.Store(false)
+		}
+		failed = 0
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/binary"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// RepeatingReader reads its pattern over and over, never running out
+type RepeatingReader struct {
+	pattern string
+	offset  int
+}
+
+func (r *RepeatingReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = r.pattern[r.offset%len(r.pattern)]
+		r.offset++
+	}
+	return len(p), nil
+}
+
+func (r *RepeatingReader) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// goodSample returns a sample of SHA-512 in counter mode, which passes the quality checks
+func goodSample() []byte {
+	var sample []byte
+	for counter := uint64(0); len(sample) < qualitySampleBytes; counter++ {
+		block := sha512.Sum512(binary.BigEndian.AppendUint64(nil, counter))
+		sample = append(sample, block[:]...)
+	}
+	return sample[:qualitySampleBytes]
+}
+
+// TestCheckQuality tests the statistical checks against good and degenerate samples
+func TestCheckQuality(t *testing.T) {
+	if err := checkQuality(goodSample()); err != nil {
+		t.Error("expected a good sample to pass, got:", err)
+	}
+	nines := make([]byte, qualitySampleBytes)
+	(&RepeatingReader{pattern: DilbertRandom}).Read(nines)
+	if err := checkQuality(nines); err == nil || !strings.HasPrefix(err.Error(), "monobit test failed") {
+		t.Error("expected all nines to fail the monobit test, got:", err)
+	}
+	/* Balanced, but in long runs */
+	runs := make([]byte, qualitySampleBytes)
+	for i := range runs {
+		if i/4%2 == 0 {
+			runs[i] = 0xff
+		}
+	}
+	if err := checkQuality(runs); err == nil || !strings.HasPrefix(err.Error(), "long run test failed") {
+		t.Error("expected long runs to fail, got:", err)
+	}
+}
+
+// TestEntropyMonitor tests that a degenerate device is flagged and marked not ready
+func TestEntropyMonitor(t *testing.T) {
+	s := NewSuiteWithDev(t, &RepeatingReader{pattern: DilbertRandom})
+	defer s.TearDown()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.pollen.monitorEntropy(ctx, time.Millisecond, 2)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !s.pollen.failingQuality.Load() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	res, err := http.Get(s.URL + "/ready")
+	s.Assert(err == nil, "http client error:", err)
+	res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusServiceUnavailable, "expected not ready, got:", res.Status)
+	s.Assert(s.pollen.metrics.qualityFailures.Load() >= 2, "expected the failures counted, got:", s.pollen.metrics.qualityFailures.Load())
+	found := false
+	for _, log := range s.logger.Logs() {
+		found = found || log.severity == "crit" && strings.HasPrefix(log.message, "Random device failed quality checks in a row, reporting not ready failures=2 ")
+	}
+	s.Assert(found, "expected the failures to be logged, got:", s.logger.Logs())
+}
+
+// TestStuckDetection tests that /ready fails once the device returns the
+// configured number of identical reads in a row, and recovers after
+func TestStuckDetection(t *testing.T) {
+	s := NewSuiteWithDev(t, &RepeatingReader{pattern: DilbertRandom})
+	defer s.TearDown()
+	s.pollen.stuck = newStuckDetector(3)
+
+	get := func() {
+		res, err := http.Get(s.URL + "?challenge=xxx")
+		if err != nil {
+			t.Fatal("http client error:", err)
+		}
+		res.Body.Close()
+	}
+	for i := 1; i < 3; i++ {
+		get()
+		s.Assert(s.ReadyStatus() == http.StatusOK, "expected ready after", i, "identical reads")
+	}
+	get()
+	s.Assert(s.ReadyStatus() == http.StatusServiceUnavailable, "expected not ready after 3 identical reads")
+	crit := false
+	for _, log := range s.logger.Logs() {
+		crit = crit || log.severity == "crit"
+	}
+	s.Assert(crit, "expected a crit log message, got:", s.logger.Logs())
+
+	s.pollen.randomSource = &counterSource{}
+	get()
+	s.Assert(s.ReadyStatus() == http.StatusOK, "expected ready once the reads differ")
+}
@@ -0,0 +1,100 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// paddingWriter holds a response back, so that its body can be padded
+// with spaces before it is written.
+type paddingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *paddingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *paddingWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(p)
+}
+
+// Unwrap lets an http.ResponseController reach the underlying connection
+func (w *paddingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// finish writes the held response, its body padded by padBody.  Responses
+// that may not have a body are written as they are.
+func (w *paddingWriter) finish(p *PollenServer, r *http.Request) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	body := w.body.Bytes()
+	if r.Method != http.MethodHead && w.status != http.StatusNoContent && w.status != http.StatusNotModified {
+		if len(body) > p.padLength {
+			/* Its size sets it apart, so the operator should raise -pad-responses */
+			p.log.ErrKV("Response longer than -pad-responses", "path", r.URL.Path, "status", w.status, "length", len(body), "pad_length", p.padLength, "at", time.Now().UnixNano())
+		}
+		body = p.padBody(body, w.Header().Get("Content-Type"))
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(body)
+}
+
+// padBody returns body padded with spaces to exactly padLength bytes, if
+// set.  A longer body is left as it is, as is CBOR, which strict decoders
+// refuse with anything after its one item.
+func (p *PollenServer) padBody(body []byte, contentType string) []byte {
+	if p.padLength <= 0 || len(body) >= p.padLength || strings.HasPrefix(contentType, cborFormat.contentType) {
+		return body
+	}
+	return append(body, bytes.Repeat([]byte{' '}, p.padLength-len(body))...)
+}
+
+// padResponses pads every response, errors included, to the same length,
+// so that an observer cannot tell them apart by size.  Streams never end,
+// so they are left alone.  Challenge responses are padded as they are
+// built, so that X-Body-SHA256 and X-Pollen-MAC cover the padding.
+func (p *PollenServer) padResponses(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p.padLength <= 0 || r.URL.Path == "/stream" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		padded := &paddingWriter{ResponseWriter: w}
+		h.ServeHTTP(padded, r)
+		padded.finish(p, r)
+	})
+}
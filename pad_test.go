@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestPadResponses tests that seeds, several seeds, batches, errors and
+// other responses all have the same length once padded, and still parse
+func TestPadResponses(t *testing.T) {
+	s := NewSuiteWithDev(t, &counterSource{})
+	defer s.TearDown()
+	s.pollen.padLength = 1024
+	s.pollen.maxCount = 4
+	s.pollen.maxBatch = 4
+	s.pollen.bodyChecksum = true
+	s.Config.Handler = s.pollen.mux()
+
+	check := func(name string, res *http.Response, err error) []byte {
+		s.Assert(err == nil, name, "http client error:", err)
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		s.Assert(err == nil, name, "response error:", err)
+		s.Assert(len(body) == 1024, name, "expected 1024 bytes, got:", len(body))
+		s.Assert(res.ContentLength == 1024, name, "expected a Content-Length of 1024, got:", res.ContentLength)
+		if sum := res.Header.Get("X-Body-SHA256"); sum != "" {
+			s.Assert(sum == fmt.Sprintf("%x", sha256.Sum256(body)), name, "expected X-Body-SHA256 of the padded body, got:", sum)
+		}
+		return body
+	}
+	for _, path := range []string{"/?challenge=xxx", "/?challenge=xxx&format=json", "/?challenge=xxx&count=3", "/", "/robots.txt", "/?challenge=xxx&keybits=100"} {
+		res, err := http.Get(s.URL + path)
+		check(path, res, err)
+	}
+	res, err := http.Post(s.URL+"/batch", "application/json", strings.NewReader(`["xxx","yyy"]`))
+	check("batch", res, err)
+
+	res, err = http.Get(s.URL + "?challenge=xxx")
+	body := check("text", res, err)
+	chal, seed, err := ReadResp(bytes.NewReader(body))
+	s.Assert(err == nil, "response error:", err)
+	s.SanityCheck(chal, seed)
+
+	/* CBOR may carry nothing after its one item */
+	res, err = http.Get(s.URL + "?challenge=xxx&format=cbor")
+	s.Assert(err == nil, "http client error:", err)
+	body, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	s.Assert(len(body) < 1024 && body[len(body)-1] != ' ', "expected CBOR unpadded, got:", len(body))
+	s.Assert(res.Header.Get("X-Body-SHA256") == fmt.Sprintf("%x", sha256.Sum256(body)), "unexpected X-Body-SHA256:", res.Header.Get("X-Body-SHA256"))
+
+	/* A response too long to pad is sent, and logged */
+	s.pollen.padLength = 64
+	res, err = http.Get(s.URL + "?challenge=xxx")
+	s.Assert(err == nil, "http client error:", err)
+	res.Body.Close()
+	found := false
+	for _, log := range s.logger.Logs() {
+		found = found || log.severity == "err" && strings.HasPrefix(log.message, "Response longer than -pad-responses")
+	}
+	s.Assert(found, "expected the long response logged, got:", s.logger.Logs())
+}
@@ -0,0 +1,96 @@
+//go:build linux
+
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"syscall"
+)
+
+var devicePoll = flag.Bool("device-poll", false, "Open the device non-blocking, and poll for it to become readable before reading")
+
+func init() {
+	open := sources["device"]
+	sources["device"] = func() (io.ReadWriteCloser, error) {
+		if !*devicePoll {
+			return open()
+		}
+		f, err := os.OpenFile(*device, os.O_RDWR|syscall.O_NONBLOCK, 0)
+		if err != nil {
+			return nil, err
+		}
+		return newPollSource(f)
+	}
+}
+
+// pollSource reads a non-blocking character device, such as a hardware RNG
+// that signals readiness through poll(2), waiting whenever a read would
+// block.  The wait is left to the runtime's poller, through a RawConn, so
+// that no poll structures are laid out by hand.
+type pollSource struct {
+	conn syscall.RawConn
+	read func(fd int, p []byte) (int, error)
+	file *os.File
+}
+
+func newPollSource(f *os.File) (*pollSource, error) {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &pollSource{conn: conn, read: syscall.Read, file: f}, nil
+}
+
+func (s *pollSource) Read(p []byte) (int, error) {
+	var n int
+	var err error
+	/* Returning false waits for the descriptor to become readable */
+	if connErr := s.conn.Read(func(fd uintptr) bool {
+		for {
+			n, err = s.read(int(fd), p)
+			if err != syscall.EINTR {
+				return err != syscall.EAGAIN
+			}
+		}
+	}); connErr != nil {
+		return 0, connErr
+	}
+	if n < 0 {
+		n = 0
+	}
+	if err == nil && n == 0 && len(p) > 0 {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (s *pollSource) Write(p []byte) (int, error) {
+	return s.file.Write(p)
+}
+
+func (s *pollSource) Close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,69 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// waitingConn is a RawConn counting the waits for readability of its Read
+type waitingConn struct {
+	syscall.RawConn
+	waits int
+}
+
+func (c *waitingConn) Read(f func(fd uintptr) bool) error {
+	for !f(0) {
+		c.waits++
+	}
+	return nil
+}
+
+// TestPollSourceWaits tests that a read that would block waits, then returns the data
+func TestPollSourceWaits(t *testing.T) {
+	reads := 0
+	read := func(fd int, p []byte) (int, error) {
+		reads++
+		switch reads {
+		case 1, 3:
+			return -1, syscall.EAGAIN
+		case 2:
+			return -1, syscall.EINTR
+		}
+		return copy(p, DilbertRandom), nil
+	}
+	conn := &waitingConn{}
+	source := &pollSource{conn: conn, read: read}
+	data := make([]byte, 64)
+	n, err := io.ReadFull(source, data)
+	if err != nil || n != 64 || !bytes.Equal(data, []byte(DilbertRandom)) {
+		t.Fatal("expected the canned data, got:", n, err, data)
+	}
+	if conn.waits != 2 {
+		t.Error("expected 2 waits, retrying EINTR without one, got:", conn.waits)
+	}
+}
+
+// TestPollSourcePipe tests polling a real non-blocking descriptor
+func TestPollSourcePipe(t *testing.T) {
+	var fds [2]int
+	if err := syscall.Pipe2(fds[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		t.Fatal(err)
+	}
+	source, err := newPollSource(os.NewFile(uintptr(fds[0]), "pipe"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	writer := os.NewFile(uintptr(fds[1]), "pipe")
+	defer writer.Close()
+	go writer.Write([]byte(DilbertRandom))
+	data := make([]byte, 64)
+	if _, err := io.ReadFull(source, data); err != nil || !bytes.Equal(data, []byte(DilbertRandom)) {
+		t.Fatal("expected the canned data, got:", err, data)
+	}
+}
@@ -21,17 +21,35 @@ pollen: Entropy-as-a-Server web server
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"crypto/sha512"
 	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"log/syslog"
+	"mime"
+	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -42,15 +60,164 @@ var (
 	size      = flag.Int("bytes", 64, "The size in bytes to read from the random device")
 	cert      = flag.String("cert", "/etc/pollen/cert.pem", "The full path to cert.pem")
 	key       = flag.String("key", "/etc/pollen/key.pem", "The full path to key.pem")
+
+	sizeRoutes = flag.String("size-routes", "", "A comma separated list of path=bytes, such as /32=32, serving challenges at each path with that many bytes read")
+
+	tlsPreferServerCiphers = flag.Bool("tls-prefer-server-ciphers", false, "Ignored, since Go orders TLS cipher suites itself; kept so that existing command lines still parse")
+	sessionTicketKeysFile  = flag.String("session-ticket-keys-file", "", "A file of hex TLS session ticket keys shared by all instances, reloaded on SIGHUP; without one, session tickets are disabled")
+	source                 = flag.String("source", "device", "The random source to use: device, counter for load testing only, or any source compiled in, such as tpm")
+
+	strictChallenge       = flag.Bool("strict-challenge", false, "Reject challenges that are not hex of the -strict-challenge-length")
+	strictChallengeLength = flag.Int("strict-challenge-length", sha512.Size*2, "The number of hex characters required by -strict-challenge")
+	maxChallengeBytes     = flag.Int("max-challenge-bytes", 1<<16, "The longest challenge accepted, in bytes, including one sent as a raw POST body, or 0 for no limit")
+	challengeSource       = flag.String("challenge-source", "any", "Where the challenge is read from: any, query, body or header")
+	challengeDecode       = flag.String("challenge-decode", "none", "Decode the challenge before hashing it: none, hex or base64")
+
+	allowFileDevice    = flag.Bool("allow-file-device", false, "Allow the -device to be a regular file, rather than refusing to start")
+	mixDevices         = flag.String("mix-devices", "", "A comma separated list of additional devices to read and mix into each seed after -device")
+	readWorkers        = flag.Int("read-workers", 1, "The number of devices to read at once for each seed")
+	randomBlockTimeout = flag.Duration("random-block-timeout", 0, "Read -fallback-device instead of a -device read that blocks for longer than this, or 0 to wait")
+	fallbackDevice     = flag.String("fallback-device", "/dev/urandom", "The device read when -device blocks for longer than -random-block-timeout")
+	domainTag          = flag.String("domain-tag", "", "A string hashed into every seed, so that servers with different tags never serve the same seeds")
+	domainTagChallenge = flag.Bool("domain-tag-challenge", false, "Hash the -domain-tag into the challenge response, too")
+	hmacKeyFile        = flag.String("hmac-key-file", "", "A file whose contents key every seed, as an HMAC, reloaded by /admin/rotate-hmac, or empty not to")
+	responseMACKeyFile = flag.String("response-mac-key-file", "", "A file whose contents key the HMAC-SHA256 of each response body, sent as X-Pollen-MAC, or empty not to")
+	standbyDevice      = flag.String("standby-device", "", "A device kept open, and read in place of -device should that fail")
+	standbyInterval    = flag.Duration("standby-check-interval", 10*time.Second, "The time between health checks of the -standby-device")
+	queueDepth         = flag.Int("queue-depth", 0, "Serialize device reads, letting this many requests wait their turn, or 0 not to")
+	queueTimeout       = flag.Duration("queue-timeout", 5*time.Second, "The longest a request waits in the -queue-depth queue")
+	retryAfter         = flag.Duration("retry-after", time.Second, "The Retry-After of requests refused by the -queue-depth queue or -max-streams, rounded up to whole seconds")
+	retryAfterJitter   = flag.Duration("retry-after-jitter", 2*time.Second, "The most whole seconds added at random to -retry-after, so refused clients do not retry in lockstep")
+	deviceBufferSize   = flag.Int("device-buffer-size", 0, "Read the random device through a buffer of this many bytes, shared across requests, or 0 not to")
+	deviceReadTimeout  = flag.Duration("device-read-timeout", 0, "Fail a request whose device reads take longer than this, or 0 to wait")
+	readChunks         = flag.Int("read-chunks", 1, "The number of reads to split each request's device read into")
+	whitening          = flag.String("whitening", "none", "The post-processing of random device bytes: none, vonneumann or aes-ctr")
+
+	egressBytesPerSecond = flag.Int("egress-bytes-per-second", 0, "The maximum rate at which to write each response, or 0 for no limit")
+	bindTLSSession       = flag.Bool("bind-tls-session", false, "Mix keying material exported from the TLS session of each HTTPS request, /batch and /stream included, and of each pollen/1 connection into its seeds, tying them to that session")
+	connectionChaining   = flag.Bool("connection-chaining", false, "Mix each seed served on a keep-alive connection into the next seed served on it")
+	padResponses         = flag.Int("pad-responses", 0, "Pad every response with spaces to exactly this many bytes, so they cannot be told apart by size, sending longer ones unpadded and logging them; 0 does not pad")
+
+	hexGroup        = flag.Int("hex-group", 0, "Split the hex of text responses, and of /batch, into groups of this many bytes, or 0 not to")
+	hexSeparator    = flag.String("hex-separator", ":", "The separator between the groups of -hex-group")
+	entropyEstimate = flag.Bool("entropy-estimate", false, "Send an estimate of the entropy of the device bytes, in bits per byte, in an X-Entropy-Estimate header")
+	bodyChecksum    = flag.Bool("body-checksum", false, "Send the SHA-256 of each response body in an X-Body-SHA256 header")
+	contentLength   = flag.Bool("content-length", false, "Send a Content-Length with every response, rather than only to HTTP/1.0 clients")
+
+	listenBacklog  = flag.Int("listen-backlog", 0, "The length of each listener's queue of pending connections, or 0 for the system default (Linux only)")
+	reusePort      = flag.Bool("reuseport", false, "Set SO_REUSEPORT on the service sockets, so that several pollen processes may share their ports (Linux and BSD only)")
+	maxHeaderBytes = flag.Int("max-header-bytes", http.DefaultMaxHeaderBytes, "The most bytes of request headers read, beyond which requests get 431")
+	maxConnections = flag.Int("max-connections", 0, "The most connections each listener accepts at once, or 0 for no limit")
+	clientIPHeader = flag.String("client-ip-header", "", "The header from which to take the client's address, as set by a trusted proxy, such as X-Forwarded-For")
+	proxyProtocol  = flag.Bool("proxy-protocol", false, "Expect each connection to begin with a PROXY protocol header naming the real client")
+
+	challengePrefix     = flag.String("require-challenge-prefix", "", "A prefix that every challenge must begin with, such as a tenant name")
+	hashChallengePrefix = flag.Bool("hash-challenge-prefix", false, "Hash the -require-challenge-prefix with the challenge, rather than removing it first")
+	requireUserAgent    = flag.String("require-user-agent", "", "A regular expression that the User-Agent of every challenge must match, such as ^pollinate/, or empty to accept any")
+
+	auditLogPath = flag.String("audit-log", "", "The file to log each challenge response hash to, for replay analysis")
+	auditLRUSize = flag.Int("audit-lru-size", 4096, "The number of recent challenge response hashes to check for replays, or 0 to disable")
+
+	seedRepeatCheck = flag.Bool("seed-repeat-check", true, "Refuse to serve a seed that repeats a recent one, which means the random device is broken")
+	seedLRUSize     = flag.Int("seed-lru-size", 1024, "The number of recent seeds to check for repeats")
+	stuckDetection  = flag.Int("stuck-detection", 0, "The identical device reads in a row after which /ready reports not ready, or 0 not to compare reads")
+
+	syslogTag      = flag.String("syslog-tag", "pollen", "The tag to log to syslog with")
+	logFile        = flag.String("log-file", "", "A file to log to, reopened on SIGHUP, rather than to syslog")
+	syslogFacility = flag.String("syslog-facility", "kern", "The syslog facility to log to, such as daemon or local0")
+	syslogAddr     = flag.String("syslog-addr", "", "The host:port of a remote syslog server to log to, rather than the local syslog")
+	syslogNetwork  = flag.String("syslog-network", "udp", "The network to reach the -syslog-addr over: udp or tcp")
+
+	minBootEntropy        = flag.Int("min-boot-entropy", 0, "The bits of kernel entropy to wait for before /ready reports ready, or 0 not to wait")
+	minBootEntropyTimeout = flag.Duration("min-boot-entropy-timeout", time.Minute, "The longest to wait for -min-boot-entropy")
+	startupGrace          = flag.Duration("startup-grace", 0, "How long after startup the JSON /health stays healthy while its critical checks fail, so a slow start is not mistaken for a dead server")
+	healthMinEntropy      = flag.Int("health-min-entropy", 0, "The bits of kernel entropy below which the JSON /health reports its entropy check failing")
+	entropyMonitor        = flag.Duration("entropy-monitor-interval", 0, "The time between statistical checks of a sample of the device, or 0 not to check")
+	entropyMonitorFails   = flag.Int("entropy-monitor-failures", 3, "The checks in a row that must fail before /ready reports not ready")
+
+	dnsPort        = flag.String("dns-port", "", "The port on which to answer DNS TXT queries for seeds, over UDP and TCP, or empty not to")
+	dnsZone        = flag.String("dns-zone", "", "The zone under which DNS query names encode the challenge, such as entropy.example.com")
+	dnsMaxInflight = flag.Int("dns-max-inflight", 64, "The most DNS queries over UDP answered at once, beyond which they are dropped")
+
+	streamInterval    = flag.Duration("stream-interval", time.Second, "The time between the seeds sent on /stream")
+	maxStreams        = flag.Int("max-streams", 0, "The most /stream clients served at once, beyond which they get 503, or 0 for no limit")
+	maxCount          = flag.Int("max-count", 16, "The most seeds one challenge may ask for with its count parameter")
+	maxBatch          = flag.Int("max-batch", 16, "The most challenges a /batch request may carry")
+	maxBatchBytes     = flag.Int("max-batch-bytes", 64*1024, "The most bytes read from the device for a /batch request, or 0 for no limit beyond -max-batch")
+	streamIdleTimeout = flag.Duration("stream-idle-timeout", 30*time.Second, "Close a /stream once nothing could be written to it for this long, or 0 never to")
+
+	webhookURL           = flag.String("webhook-url", "", "The URL to POST a JSON summary of each completed request to, or empty not to")
+	webhookQueue         = flag.Int("webhook-queue", 1024, "The most -webhook-url events waiting to be sent, beyond which they are dropped")
+	monitoringAddr       = flag.String("monitoring-addr", "", "The private host:port on which to serve the operational endpoints, rather than on the service ports")
+	disableEndpoints     = flag.String("disable-endpoints", "", "A comma separated list of endpoints not to serve, such as stir,stream; / is always served")
+	enableDebugEndpoints = flag.Bool("enable-debug-endpoints", false, "Serve the /debug endpoints, to holders of the -admin-token")
+	enablePprof          = flag.Bool("enable-pprof", false, "Serve the pprof profiles at /debug/pprof/ on the -monitoring-addr, and never on the service ports")
+	adminToken           = flag.String("admin-token", "", "The bearer token required by the /admin endpoints, which are disabled without one")
+
+	logDurationPrecision = flag.String("log-duration-precision", "full", "The precision of logged request durations, such as 1ms, or full, or none to omit them")
+	logSampling          = flag.Int("log-sampling", 1, "Log only 1 in this many requests served, while always logging errors")
+	slowReadThreshold    = flag.Duration("slow-read-threshold", 0, "Log device reads for a seed that take longer than this, or 0 not to")
+	stirBytes            = flag.Int("stir-bytes", sha512.Size, "The number of bytes stirred into the random device for each challenge, expanded from the challenge hash, or 0 not to stir")
+	stirMetadata         = flag.Bool("stir-metadata", false, "Also stir the client's address and the time into the random device with each challenge")
+	writeFailureSeverity = flag.String("write-failure-severity", "err", "The severity at which to log failures to stir the random device: err or info")
+
+	printConfigFlag  = flag.Bool("print-config", false, "Print the effective configuration as JSON and exit")
+	quiet            = flag.Bool("quiet", false, "Do not log the startup and shutdown messages")
+	listenRetries    = flag.Int("listen-retries", 0, "The number of times to restart a listener that fails, before giving up")
+	listenRetryDelay = flag.Duration("listen-retry-delay", time.Second, "The delay before the first listener restart, doubling with each retry")
+	runAsUser        = flag.String("user", "", "The user to run as, after opening the device and binding the ports as root, or empty to keep running as the starting user")
 )
 
-// this matches the syslog.Writer functions
+// sources maps the -source names to functions opening that random source.
+// Optional sources register themselves here from their own (build tagged) files.
+var sources = map[string]func() (io.ReadWriteCloser, error){
+	"device": func() (io.ReadWriteCloser, error) {
+		if isFIFO(*device) {
+			return openFIFO(*device)
+		}
+		return os.OpenFile(*device, os.O_RDWR, 0)
+	},
+}
+
+// challengeDecoders maps the -challenge-decode names to functions decoding
+// the challenge into the bytes to be hashed
+var challengeDecoders = map[string]func(string) ([]byte, error){
+	"none": func(challenge string) ([]byte, error) {
+		return []byte(challenge), nil
+	},
+	"hex":    hex.DecodeString,
+	"base64": base64.StdEncoding.DecodeString,
+}
+
+// challengeSources maps the -challenge-source names to functions reading the
+// challenge from where that allows
+var challengeSources = map[string]func(*http.Request) string{
+	"any": func(r *http.Request) string {
+		return r.FormValue("challenge")
+	},
+	"query": func(r *http.Request) string {
+		return r.URL.Query().Get("challenge")
+	},
+	"body": func(r *http.Request) string {
+		return r.PostFormValue("challenge")
+	},
+	"header": func(r *http.Request) string {
+		return r.Header.Get("X-Challenge")
+	},
+}
+
+// this matches the syslog.Writer functions, plus the structured InfoKV and
+// ErrKV, which take a message and then alternating keys and values
 type logger interface {
 	Close() error
 	Info(string) error
 	Err(string) error
 	Crit(string) error
 	Emerg(string) error
+	InfoKV(msg string, kv ...interface{}) error
+	ErrKV(msg string, kv ...interface{}) error
+	// Reopen reopens the log's file or connection, for log rotation
+	Reopen() error
 }
 
 type PollenServer struct {
@@ -58,96 +225,1298 @@ type PollenServer struct {
 	randomSource io.ReadWriter
 	log          logger
 	readSize     int
+	buffers      bufferPool
+	// sizeRoutes maps paths to the bytes read for their challenges, rather
+	// than readSize
+	sizeRoutes map[string]int
+	// strictChallenge rejects challenges that are not challengeLength hex characters
+	strictChallenge bool
+	challengeLength int
+	// challengePrefix must begin every challenge, and is only hashed with
+	// the rest of the challenge if hashChallengePrefix
+	challengePrefix     string
+	hashChallengePrefix bool
+	// userAgent, if set, must match the User-Agent of every challenge
+	userAgent *regexp.Regexp
+	// maxChallengeBytes, if set, is the longest challenge accepted
+	maxChallengeBytes int
+	// challengeSource names the challengeSources entry that reads the
+	// challenge, or is empty for any
+	challengeSource string
+	// challengeDecode names the challengeDecoders entry that decodes the
+	// challenge before it is hashed, or is empty to hash it as sent
+	challengeDecode string
+	// readChunks splits each device read into that many reads
+	readChunks int
+	// deviceReadTimeout fails the reads for a seed that take longer, if set
+	deviceReadTimeout time.Duration
+	// fallback, if set, is read in place of randomSource if a read of that
+	// blocks for longer than randomBlockTimeout
+	fallback           io.Reader
+	randomBlockTimeout time.Duration
+	// domainTag, if set, is hashed into each seed after the device bytes,
+	// and ahead of the challenge if domainTagChallenge, to separate the
+	// seeds of one deployment from another's
+	domainTag          string
+	domainTagChallenge bool
+	// hmacKey, if set, keys each seed, as an HMAC of the seed, so that
+	// only its holders could recompute one.  It may be rotated while
+	// serving, reloading hmacKeyFile.
+	hmacKey     atomic.Pointer[[]byte]
+	hmacKeyFile string
+	// responseMACKey, if set, keys the HMAC-SHA256 of each response body
+	// sent as X-Pollen-MAC
+	responseMACKey []byte
+	// webhook, if set, is sent a summary of each request completed
+	webhook *webhook
+	// disabledEndpoints are the names of the endpoints not served
+	disabledEndpoints map[string]bool
+	// standby, if set, is read in place of randomSource if that fails
+	standby *standbySource
+	// exposeSource names the source that served each seed, by its label
+	// in sourceLabels, in an X-Entropy-Source header
+	exposeSource bool
+	sourceLabels sourceLabels
+	// queue, if set, serializes the device reads of requests
+	queue *requestQueue
+	// retryAfter, plus up to retryAfterJitter, is the Retry-After of the
+	// requests refused by the queue, or for too many streams
+	retryAfter       time.Duration
+	retryAfterJitter time.Duration
+	// mixSources are read alongside randomSource, by up to readWorkers at
+	// once, and mixed in after it in order
+	mixSources  []io.Reader
+	readWorkers int
+	// egressRate limits the bytes per second written to each response
+	egressRate int
+	// padLength, if set, pads each response with spaces to exactly that many
+	// bytes; a longer response is sent as is, and logged
+	padLength int
+	// connectionChaining mixes each seed served on a connection into the
+	// next single seed served on it
+	connectionChaining bool
+	// bindTLSSession mixes keying material exported from the TLS session
+	// of each HTTPS request or pollen/1 connection into its seeds
+	bindTLSSession bool
+	// responseHeaders are sent with every response of the service mux
+	responseHeaders http.Header
+	// hexGroup, if set, splits the text format's hex into groups of that
+	// many bytes, joined by hexSeparator
+	hexGroup     int
+	hexSeparator string
+	// durationPrecision rounds the logged request durations, or omits
+	// them if negative, to avoid leaking timing through the logs
+	durationPrecision time.Duration
+	// logSampling logs only 1 in logSampling requests served, if more
+	// than 1, counting them in logCount, while errors are always logged
+	logSampling int
+	logCount    atomic.Uint64
+	// slowReadThreshold, if set, is the device read time beyond which the
+	// read is logged as slow
+	slowReadThreshold time.Duration
+	// stirBytes is the number of bytes stirred into the device for each
+	// challenge, or less than 0 to stir nothing, as setup makes the 0 of
+	// -stir-bytes.  Its zero value stirs the challenge response as is.
+	stirBytes int
+	// stirMetadata also stirs the client's address and the time into the
+	// device with each challenge
+	stirMetadata bool
+	// streamInterval is the time between the seeds sent on /stream, and a
+	// stream is closed once no bytes could be written for streamIdleTimeout
+	streamInterval    time.Duration
+	streamIdleTimeout time.Duration
+	// maxCount is the most seeds one challenge may ask for
+	maxCount int
+	// maxBatch is the most challenges a /batch request may carry
+	maxBatch int
+	// maxBatchBytes bounds the bytes read from each source for a /batch
+	// request, or 0 for no bound beyond maxBatch
+	maxBatchBytes int
+	// maxStreams is the most streams served at once, or 0 for no limit
+	maxStreams int
+	// dnsMaxInflight is the most DNS queries over UDP answered at once
+	dnsMaxInflight int
+	// writeFailureInfo logs failures to stir the device at info, rather
+	// than err, since stirring is best effort
+	writeFailureInfo bool
+	// bodyChecksum adds the SHA-256 of the response body as a header
+	bodyChecksum bool
+	// entropyEstimate adds the Shannon entropy of the device bytes as a header
+	entropyEstimate bool
+	// contentLength sends a Content-Length to HTTP/1.1 clients too
+	contentLength bool
+	metrics       metrics
+	// adminToken is the bearer token required by the /admin endpoints,
+	// which are disabled without one
+	adminToken string
+	// debugEndpoints enables the /debug endpoints, for admins
+	debugEndpoints bool
+	// pprof serves the profiles at /debug/pprof/, on the private listener
+	// only, since they leak memory contents and cost CPU
+	pprof bool
+	// awaitingEntropy holds the server out of readiness at boot
+	awaitingEntropy atomic.Bool
+	// failingQuality holds the server out of readiness while the device
+	// fails its quality checks
+	failingQuality atomic.Bool
+	// draining holds the server out of readiness, as asked by an admin
+	// ahead of shutting it down, while it carries on serving
+	draining atomic.Bool
+	// stuckSource holds the server out of readiness while the device
+	// repeats itself, as caught by stuck
+	stuckSource atomic.Bool
+	// restartingListeners counts the listeners waiting to be restarted
+	restartingListeners atomic.Int32
+	// healthMinEntropy is the bits of kernel entropy below which the JSON
+	// /health reports its entropy check failing
+	healthMinEntropy int
+	// graceUntil is the end of the startup grace period, before which the
+	// JSON /health reports failing critical checks as "starting", with 200
+	graceUntil time.Time
+	// audit, if set, tracks the challenge responses for replays
+	audit *auditLog
+	// recentSeeds, if set, holds the recent seeds, to catch a stuck device
+	recentSeeds *lru
+	// stuck, if set, compares each read of the device with the last, to
+	// catch a stuck device before its seeds repeat
+	stuck *stuckDetector
+	// allowCIDRs, if any, are the only clients served, while denyCIDRs
+	// are never served
+	allowCIDRs cidrList
+	denyCIDRs  cidrList
+	// rateLimit is the requests per second, beyond rateLimitBurst at once,
+	// that RateLimiter lets each client make
+	rateLimit      float64
+	rateLimitBurst int
+	// ClientIP, if set, extracts the client's address from a request, for
+	// logging and stirring, rather than taking the connection's address
+	ClientIP func(*http.Request) string
+	// RequestID, if set, generates the ID sent as X-Request-Id and logged
+	// with each challenge, rather than a random one
+	RequestID func() string
+	// Postprocessor, if set, whitens the bytes read from the random device
+	// before they are mixed with the challenge
+	Postprocessor func([]byte) []byte
+	// RateLimiter, if set, keeps the buckets of rateLimit
+	RateLimiter RateLimiter
+}
+
+// maxBufferPoolSizes bounds how many distinct read sizes get a buffer pool
+const maxBufferPoolSizes = 16
+
+// bufferPool reuses the buffers that device reads are made into, keyed by
+// their size.  Buffers are zeroed as they are returned, so that no entropy
+// outlives the request that read it.
+type bufferPool struct {
+	mu    sync.Mutex
+	pools map[int]*sync.Pool
+}
+
+func (b *bufferPool) pool(size int) *sync.Pool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if pool, ok := b.pools[size]; ok {
+		return pool
+	}
+	if b.pools == nil {
+		b.pools = make(map[int]*sync.Pool)
+	}
+	if len(b.pools) >= maxBufferPoolSizes {
+		return nil
+	}
+	pool := &sync.Pool{New: func() interface{} {
+		buf := make([]byte, size)
+		return &buf
+	}}
+	b.pools[size] = pool
+	return pool
+}
+
+func (b *bufferPool) get(size int) *[]byte {
+	if pool := b.pool(size); pool != nil {
+		return pool.Get().(*[]byte)
+	}
+	buf := make([]byte, size)
+	return &buf
+}
+
+func (b *bufferPool) put(buf *[]byte) {
+	for i := range *buf {
+		(*buf)[i] = 0
+	}
+	if pool := b.pool(len(*buf)); pool != nil {
+		pool.Put(buf)
+	}
+}
+
+// newHash is the hash that challenges and seeds are mixed with
+var newHash = sha512.New
+
+// hashName names newHash to clients
+const hashName = "sha512"
+
+// MixDescription describes how challenges and device bytes are mixed.  This
+// order is stable across versions, so that clients may verify responses.
+func MixDescription() string {
+	return "challenge_response = " + hashName + "(challenge); seed = " + hashName + "(challenge || device bytes)"
+}
+
+// mixChallenge returns the hash with the challenge mixed in, whose sum is
+// the challenge response, and into which the device bytes are then mixed
+func mixChallenge(challenge string) hash.Hash {
+	checksum := newHash()
+	io.WriteString(checksum, challenge)
+	return checksum
+}
+
+// writeDomainTag writes the domain tag as a netstring, so that no tag and
+// material can be mistaken for another tag and material.
+func writeDomainTag(checksum hash.Hash, tag string) {
+	fmt.Fprintf(checksum, "%d:%s,", len(tag), tag)
+}
+
+// hashChallenge returns mixChallenge(challenge), with the domain tag stamped
+// ahead of the challenge if domainTagChallenge.
+func (p *PollenServer) hashChallenge(challenge string) hash.Hash {
+	if p.domainTag == "" || !p.domainTagChallenge {
+		return mixChallenge(challenge)
+	}
+	checksum := newHash()
+	writeDomainTag(checksum, p.domainTag)
+	io.WriteString(checksum, challenge)
+	return checksum
+}
+
+// mix returns the challenge response and the seed for a challenge and the
+// device bytes read for it, just as a request mixes them
+func mix(challenge string, device []byte) (challengeResponse, seed []byte) {
+	checksum := mixChallenge(challenge)
+	challengeResponse = checksum.Sum(nil)
+	checksum.Write(device)
+	return challengeResponse, checksum.Sum(nil)
 }
 
 const usePollinateError = "Please use the pollinate client.  'sudo apt-get install pollinate' or download from: https://bazaar.launchpad.net/~pollinate/pollinate/trunk/view/head:/pollinate"
 
 func (p *PollenServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.serveChallenge(w, r, p.readSize)
+}
+
+// serveChallenge answers a challenge with a seed of size bytes read from
+// each source
+func (p *PollenServer) serveChallenge(w http.ResponseWriter, r *http.Request, size int) {
 	startTime := time.Now()
-	var avail []byte
-	challenge := r.FormValue("challenge")
-	if challenge == "" {
-		http.Error(w, usePollinateError, http.StatusBadRequest)
+	p.metrics.activeConnections.Add(1)
+	defer p.metrics.activeConnections.Add(-1)
+	requestID := p.requestID()
+	/* Headers not depending on the seed are set before anything, error or not, is written */
+	w.Header().Set("X-Request-Id", requestID)
+	/* So that clients can verify the challenge response, whatever the format */
+	w.Header().Set("X-Pollen-Hash", hashName)
+	/* Seeds must never be served twice, from a cache or otherwise */
+	w.Header().Set("Cache-Control", "no-store")
+	challenge, ok := p.challenge(w, r)
+	if !ok {
 		return
 	}
-	checksum := sha512.New()
-	io.WriteString(checksum, challenge)
+	keyLength, ok := keyBytes(w, r)
+	if !ok {
+		return
+	}
+	count, ok := p.seedCount(w, r)
+	if !ok {
+		return
+	}
+	var servedBy *string
+	if p.exposeSource {
+		var ctx context.Context
+		ctx, servedBy = withServedBy(r.Context())
+		r = r.WithContext(ctx)
+	}
+	binding, err := p.sessionBinding(r.TLS)
+	if err != nil {
+		p.log.ErrKV("Cannot export TLS keying material", "remote_addr", p.clientIP(r), "request_id", requestID, "error", err, "at", time.Now().UnixNano())
+		http.Error(w, "Cannot bind the seed to the TLS session", http.StatusInternalServerError)
+		return
+	}
+	/* A key is never given more bytes than were read for it */
+	size = max(size, keyLength)
+	checksum := p.hashChallenge(challenge)
 	challengeResponse := checksum.Sum(nil)
-	var err error
-	_, err = p.randomSource.Write(challengeResponse)
+	/* The seed, but not the challenge response, is bound to the session */
+	checksum.Write(binding)
+	p.stir(challengeResponse, p.clientIP(r))
+	if p.audit != nil && p.audit.record(challengeResponse) {
+		p.metrics.duplicateChallenges.Add(1)
+	}
+	/* Errors are always logged, but only a sample of the requests */
+	sampled := p.sampleLog()
+	if sampled {
+		/* Record entropy bits before */
+		kv := []interface{}{"remote_addr", p.clientIP(r), "user_agent", r.UserAgent(), "request_id", requestID, "at", time.Now().UnixNano()}
+		if r.TLS != nil {
+			/* For auditing what clients negotiate */
+			kv = append(kv, "tls_version", tls.VersionName(r.TLS.Version), "tls_cipher", tls.CipherSuiteName(r.TLS.CipherSuite))
+		}
+		p.log.InfoKV("Server received challenge", append(kv, "entropy_avail", p.entropyAvail())...)
+	}
+	var tally *byteTally
+	if p.entropyEstimate {
+		tally = &byteTally{}
+	}
+	var seeds [][]byte
+	if count == 1 {
+		var seed []byte
+		seed, err = p.readChainedSeed(r.Context(), checksum, size, tally)
+		seeds = [][]byte{seed}
+	} else {
+		seeds, err = p.readSeeds(r.Context(), challenge, binding, count, size, tally)
+	}
 	if err != nil {
-		/* Non-fatal error, but let's log this to syslog */
-		p.log.Err(fmt.Sprintf("Cannot write to random device at [%v]", time.Now().UnixNano()))
+		p.writeSeedError(w, r, requestID, err)
+		return
+	}
+	if keyLength > 0 {
+		for i := range seeds {
+			seeds[i] = seeds[i][:keyLength]
+		}
+	}
+	format := negotiateFormat(r)
+	if format.name == "text" && p.hexGroup > 0 {
+		format.encode = groupedText(p.hexGroup, p.hexSeparator)
+	}
+	w.Header().Set("Content-Type", format.contentType)
+	if servedBy != nil {
+		/* So that operators can tell which source served a request */
+		w.Header().Set("X-Entropy-Source", *servedBy)
+	}
+	/* So that clients can allocate for the seed before decoding it */
+	w.Header().Set("X-Seed-Bytes", strconv.Itoa(len(seeds[0])))
+	/* The body is built, and padded, first, so that its checksum can lead as a header */
+	var buf bytes.Buffer
+	if count == 1 {
+		format.encode(&buf, challengeResponse, seeds[0])
+	} else {
+		encodeSeeds(&buf, format, challengeResponse, seeds, p.hexText)
+	}
+	body := p.padBody(buf.Bytes(), format.contentType)
+	if p.bodyChecksum {
+		w.Header().Set("X-Body-SHA256", fmt.Sprintf("%x", sha256.Sum256(body)))
+	}
+	if p.responseMACKey != nil {
+		/* Clients sharing the key can tell a body tampered with in transit */
+		mac := hmac.New(sha256.New, p.responseMACKey)
+		mac.Write(body)
+		w.Header().Set("X-Pollen-MAC", fmt.Sprintf("%x", mac.Sum(nil)))
 	}
-	/* Record entropy bits before */
-	avail, err = ioutil.ReadFile("/proc/sys/kernel/random/entropy_avail")
+	if tally != nil {
+		w.Header().Set("X-Entropy-Estimate", strconv.FormatFloat(tally.shannon(), 'f', 3, 64))
+	}
+	if p.contentLength || !r.ProtoAtLeast(1, 1) {
+		/* HTTP/1.0 clients may not understand chunked responses */
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	p.writeResponse(w, r, requestID, body)
+	if !sampled {
+		return
+	}
+	kv := []interface{}{"remote_addr", p.clientIP(r), "user_agent", r.UserAgent(), "request_id", requestID, "at", time.Now().UnixNano()}
+	if p.durationPrecision >= 0 {
+		kv = append(kv, "duration", time.Since(startTime).Round(p.durationPrecision).Seconds())
+	}
+	/* Record entropy bits after */
+	p.log.InfoKV("Server sent response", append(kv, "entropy_avail", p.entropyAvail())...)
+}
+
+// writeResponse writes a response body, logging and counting a failed
+// write, since that mostly means the client went away before reading it
+// and would otherwise leave no trace.
+func (p *PollenServer) writeResponse(w http.ResponseWriter, r *http.Request, requestID string, body []byte) {
+	n, err := w.Write(body)
+	if err == nil {
+		return
+	}
+	p.metrics.responseWriteErrors.Add(1)
+	p.log.InfoKV("Client disconnected before response completed", "remote_addr", p.clientIP(r), "request_id", requestID, "written", n, "expected", len(body), "error", err, "at", time.Now().UnixNano())
+}
+
+// keySizes are the key lengths, in bits, that the keybits parameter may ask
+// for, each no longer than a seed
+var keySizes = []int{128, 192, 256, 384, 512}
+
+// keyBytes returns the bytes of seed asked for by the keybits parameter, to
+// fill a key of that many bits, or 0 for the whole seed.  It writes a Bad
+// Request response and returns false for an unsupported key size.
+func keyBytes(w http.ResponseWriter, r *http.Request) (int, bool) {
+	param := r.FormValue("keybits")
+	if param == "" {
+		return 0, true
+	}
+	bits, err := strconv.Atoi(param)
+	if err == nil && slices.Contains(keySizes, bits) {
+		return bits / 8, true
+	}
+	http.Error(w, fmt.Sprintf("keybits must be one of %v", keySizes), http.StatusBadRequest)
+	return 0, false
+}
+
+// seedCount returns the number of seeds asked for by the count parameter,
+// 1 without one.  It writes a Bad Request response and returns false for a
+// count beyond maxCount, or in a format that cannot carry several seeds.
+func (p *PollenServer) seedCount(w http.ResponseWriter, r *http.Request) (int, bool) {
+	param := r.FormValue("count")
+	if param == "" {
+		return 1, true
+	}
+	count, err := strconv.Atoi(param)
+	if err != nil || count < 1 || count > max(p.maxCount, 1) {
+		http.Error(w, fmt.Sprintf("count must be from 1 to %d", max(p.maxCount, 1)), http.StatusBadRequest)
+		return 0, false
+	}
+	if count > 1 && !multiSeedFormats[negotiateFormat(r).name] {
+		http.Error(w, "count needs the text, labeled or json format", http.StatusBadRequest)
+		return 0, false
+	}
+	return count, true
+}
+
+// writeSeedError logs err, from reading the seeds of a request, and
+// responds with it, unless the client has already gone away.
+func (p *PollenServer) writeSeedError(w http.ResponseWriter, r *http.Request, requestID string, err error) {
+	switch {
+	case err == r.Context().Err():
+		/* The client is gone, so don't spend entropy on it */
+		p.log.InfoKV("Client went away before its seed was read", "remote_addr", p.clientIP(r), "request_id", requestID, "at", time.Now().UnixNano())
+	case err == errQueueFull || err == errQueueTimeout:
+		p.log.InfoKV("Cannot queue for random device", "remote_addr", p.clientIP(r), "request_id", requestID, "reason", err, "at", time.Now().UnixNano())
+		p.setRetryAfter(w)
+		http.Error(w, "The random device is busy, please try again later", http.StatusServiceUnavailable)
+	case err == errSeedRepeated:
+		/* This should never happen, unless the random device is stuck */
+		p.log.Crit(flattenKV("Seed repeats a recent seed", []interface{}{"remote_addr", p.clientIP(r), "request_id", requestID, "at", time.Now().UnixNano()}))
+		writeError(w, r, http.StatusInternalServerError, "Failed to read from random device", errDeviceRead)
+	default:
+		/* Fatal error for this connection, if we can't read from device */
+		p.log.ErrKV("Cannot read from random device", "at", time.Now().UnixNano())
+		writeError(w, r, http.StatusInternalServerError, "Failed to read from random device", errDeviceRead)
+	}
+}
+
+// readSeeds reads count times size bytes from each source at once, and
+// returns count seeds, each mixing the challenge, and binding, with its own
+// slice of that read.
+func (p *PollenServer) readSeeds(ctx context.Context, challenge string, binding []byte, count, size int, tally *byteTally) ([][]byte, error) {
+	bufs, release, err := p.readSources(ctx, count*size)
 	if err != nil {
-		/* Non-fatal error */
-		p.log.Err(fmt.Sprintf("Cannot record entropy bits at [%v]", time.Now().UnixNano()))
-		avail = []byte{'?'}
+		return nil, err
+	}
+	defer release()
+	seeds := make([][]byte, count)
+	for i := range seeds {
+		checksum := p.hashChallenge(challenge)
+		checksum.Write(binding)
+		if seeds[i], err = p.mixSeed(checksum, sliceSources(bufs, i, size), tally); err != nil {
+			return nil, err
+		}
+	}
+	return seeds, nil
+}
+
+// sliceSources returns the ith slice of size bytes of each source's buffer
+func sliceSources(bufs []*[]byte, i, size int) [][]byte {
+	data := make([][]byte, len(bufs))
+	for j, buf := range bufs {
+		data[j] = (*buf)[i*size : (i+1)*size]
 	}
-	p.log.Info(fmt.Sprintf("Server received challenge from [%s, %s] at [%v] with [e%s] available", r.RemoteAddr, r.UserAgent(), time.Now().UnixNano(), strings.Split(string(avail), "\n")[0]))
-	data := make([]byte, p.readSize)
-	_, err = io.ReadFull(p.randomSource, data)
+	return data
+}
+
+// errSeedRepeated means a seed repeated a recent one, so the device is broken
+var errSeedRepeated = errors.New("seed repeats a recent seed")
+
+// readSeed reads the random device, mixing it into checksum after the
+// challenge, and returns the seed.  It returns ctx.Err() if ctx is done
+// before the read completes.
+func (p *PollenServer) readSeed(ctx context.Context, checksum hash.Hash) ([]byte, error) {
+	return p.readSeedOf(ctx, checksum, p.readSize, nil)
+}
+
+// readSeedOf is readSeed, reading size bytes from each source, and also
+// counting the bytes mixed into the seed in tally, if set.
+func (p *PollenServer) readSeedOf(ctx context.Context, checksum hash.Hash, size int, tally *byteTally) ([]byte, error) {
+	bufs, release, err := p.readSources(ctx, size)
 	if err != nil {
-		/* Fatal error for this connection, if we can't read from device */
-		p.log.Err(fmt.Sprintf("Cannot read from random device at [%v]", time.Now().UnixNano()))
-		http.Error(w, "Failed to read from random device", http.StatusInternalServerError)
-		return
+		return nil, err
+	}
+	defer release()
+	data := make([][]byte, len(bufs))
+	for i, buf := range bufs {
+		data[i] = *buf
+	}
+	return p.mixSeed(checksum, data, tally)
+}
+
+// readSources reads size bytes from the random device and from each of the
+// mixSources, into pooled buffers, which release returns to the pool once
+// they are mixed.
+func (p *PollenServer) readSources(ctx context.Context, size int) (bufs []*[]byte, release func(), err error) {
+	if p.queue != nil {
+		if err := p.queue.acquire(ctx); err != nil {
+			return nil, nil, err
+		}
+		defer p.queue.release()
+	}
+	if p.deviceReadTimeout > 0 {
+		/* A device fed by another process may stall, should that die */
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.deviceReadTimeout)
+		defer cancel()
+	}
+	sources := append([]io.Reader{p.randomSource}, p.mixSources...)
+	bufs = make([]*[]byte, len(sources))
+	errs := make([]error, len(sources))
+	for i := range sources {
+		bufs[i] = p.buffers.get(size)
+	}
+	readStart := time.Now()
+	/* Up to readWorkers sources are read at once */
+	workers := make(chan struct{}, max(p.readWorkers, 1))
+	var wg sync.WaitGroup
+	primaryBuf := bufs[0]
+	for i, source := range sources {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(i int, source io.Reader) {
+			defer wg.Done()
+			if i == 0 && p.fallback != nil {
+				errs[i] = p.readWithFallback(ctx, source, &bufs[i])
+			} else {
+				errs[i] = readAll(ctx, source, splitChunks(*bufs[i], p.readChunks))
+			}
+			<-workers
+		}(i, source)
+	}
+	wg.Wait()
+	if errs[0] != nil && errs[0] != ctx.Err() && p.standby != nil && p.standby.healthy.Load() {
+		/* The standby is already open and checked, so it can serve straight away */
+		p.log.ErrKV("Cannot read from random device, reading the standby", "at", time.Now().UnixNano())
+		errs[0] = readAll(ctx, p.standby.dev, splitChunks(*bufs[0], p.readChunks))
+		noteServedBy(ctx, p.sourceLabels.standby)
+	} else if bufs[0] != primaryBuf {
+		/* readWithFallback reads the fallback into a fresh buffer */
+		noteServedBy(ctx, p.sourceLabels.fallback)
+	} else {
+		noteServedBy(ctx, p.sourceLabels.device)
+	}
+	readTime := time.Since(readStart)
+	for _, err := range errs {
+		if err != nil {
+			for i, buf := range bufs {
+				/* An abandoned read may yet fill its buffer, so it cannot be reused */
+				if errs[i] == nil || errs[i] != ctx.Err() {
+					p.buffers.put(buf)
+				}
+			}
+			return nil, nil, err
+		}
+	}
+	p.metrics.deviceReadSeconds.observe(readTime)
+	if p.stuck != nil {
+		p.checkStuck(*bufs[0])
+	}
+	if p.slowReadThreshold > 0 && readTime > p.slowReadThreshold {
+		/* A hardware RNG slowing down may be failing */
+		p.log.ErrKV("Slow read from random device", "duration", readTime.Seconds(), "at", time.Now().UnixNano())
+	}
+	return bufs, func() {
+		for _, buf := range bufs {
+			p.buffers.put(buf)
+		}
+	}, nil
+}
+
+// mixSeed mixes the data read from each source into checksum, after the
+// challenge, and returns the seed.
+func (p *PollenServer) mixSeed(checksum hash.Hash, data [][]byte, tally *byteTally) ([]byte, error) {
+	/* Sources are mixed in order, however their reads finished */
+	for _, source := range data {
+		for _, chunk := range splitChunks(source, p.readChunks) {
+			if p.Postprocessor != nil {
+				chunk = p.Postprocessor(chunk)
+			}
+			if tally != nil {
+				tally.add(chunk)
+			}
+			checksum.Write(chunk)
+		}
+	}
+	if p.domainTag != "" {
+		/* Seeds from servers with different tags never coincide */
+		writeDomainTag(checksum, p.domainTag)
 	}
-	checksum.Write(data)
 	/* The checksum of the bytes from /dev/random is simply for print-ability, when debugging */
-	seed := checksum.Sum(nil)
-	fmt.Fprintf(w, "%x\n%x\n", challengeResponse, seed)
-	/* Record entropy bits after */
-	avail, err = ioutil.ReadFile("/proc/sys/kernel/random/entropy_avail")
+	seed := p.keySeed(checksum.Sum(nil))
+	if p.recentSeeds != nil && p.recentSeeds.see(string(seed)) > 1 {
+		return nil, errSeedRepeated
+	}
+	return seed, nil
+}
+
+// readWithFallback reads source into *buf, unless that blocks for longer
+// than randomBlockTimeout, when it reads the fallback into a fresh *buf.
+func (p *PollenServer) readWithFallback(ctx context.Context, source io.Reader, buf **[]byte) error {
+	blockCtx, cancel := context.WithTimeout(ctx, p.randomBlockTimeout)
+	defer cancel()
+	err := readAll(blockCtx, source, splitChunks(**buf, p.readChunks))
+	if err == nil || err != blockCtx.Err() || ctx.Err() != nil {
+		return err
+	}
+	p.log.ErrKV("Random device blocked, reading the fallback", "timeout", p.randomBlockTimeout.Seconds(), "at", time.Now().UnixNano())
+	/* The blocked read may yet fill the old buffer, so it is left behind */
+	*buf = p.buffers.get(len(**buf))
+	return readAll(ctx, p.fallback, splitChunks(**buf, p.readChunks))
+}
+
+// validateDevice refuses a regular file as a device, since reads would hit
+// its end and stirring would grow it.  Other errors are left to opening it.
+func validateDevice(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+	return checkDeviceMode(path, info.Mode())
+}
+
+func checkDeviceMode(path string, mode os.FileMode) error {
+	if mode.IsRegular() {
+		return fmt.Errorf("%s is a regular file, not a device; use -allow-file-device if that is intended", path)
+	}
+	return nil
+}
+
+// clientIP returns the client's address, as extracted by ClientIP if set
+func (p *PollenServer) clientIP(r *http.Request) string {
+	if p.ClientIP != nil {
+		return p.ClientIP(r)
+	}
+	return r.RemoteAddr
+}
+
+// headerClientIP returns a ClientIP taking the client's address from the
+// named header, as set by a trusted proxy, such as CF-Connecting-IP.  Of a
+// list, such as X-Forwarded-For, the last address, added by the proxy
+// nearest pollen, is taken, since the rest may be forged by the client.
+func headerClientIP(name string) func(*http.Request) string {
+	return func(r *http.Request) string {
+		values := r.Header.Values(name)
+		if len(values) == 0 {
+			return r.RemoteAddr
+		}
+		addrs := strings.Split(values[len(values)-1], ",")
+		return strings.TrimSpace(addrs[len(addrs)-1])
+	}
+}
+
+// readAll reads each chunk in turn, so that later chunks see a later
+// device state
+func readAll(ctx context.Context, source io.Reader, chunks [][]byte) error {
+	for _, data := range chunks {
+		if err := readFullContext(ctx, source, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseDurationPrecision parses -log-duration-precision, returning -1 for
+// "none", so that durations are not logged at all, and 0 for full precision.
+func parseDurationPrecision(precision string) (time.Duration, error) {
+	switch precision {
+	case "none":
+		return -1, nil
+	case "", "full":
+		return 0, nil
+	}
+	d, err := time.ParseDuration(precision)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("Invalid duration precision: %s", precision)
+	}
+	return d, nil
+}
+
+// entropyAvail returns the kernel's count of available entropy bits, or "?"
+func (p *PollenServer) entropyAvail() string {
+	avail, err := ioutil.ReadFile("/proc/sys/kernel/random/entropy_avail")
 	if err != nil {
 		/* Non-fatal error */
-		p.log.Err(fmt.Sprintf("Cannot record entropy bits at [%v]", time.Now().UnixNano()))
-		avail = []byte{'?'}
+		p.log.ErrKV("Cannot record entropy bits", "at", time.Now().UnixNano())
+		return "?"
+	}
+	return strings.Split(string(avail), "\n")[0]
+}
+
+// serveStir hashes the challenge into the random device, just as a request
+// to / does, but consumes no entropy and returns no content.
+func (p *PollenServer) serveStir(w http.ResponseWriter, r *http.Request) {
+	challenge, ok := p.challenge(w, r)
+	if !ok {
+		return
+	}
+	checksum := p.hashChallenge(challenge)
+	p.stir(checksum.Sum(nil), p.clientIP(r))
+	p.log.InfoKV("Server stirred challenge", "remote_addr", p.clientIP(r), "user_agent", r.UserAgent(), "at", time.Now().UnixNano())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// splitChunks splits data into n nearly equal chunks, the last taking any
+// remainder.  There is always at least one chunk, and no chunk is empty
+// unless data is.
+func splitChunks(data []byte, n int) [][]byte {
+	if n > len(data) {
+		n = len(data)
+	}
+	if n < 1 {
+		n = 1
+	}
+	chunks := make([][]byte, 0, n)
+	size := len(data) / n
+	for i := 0; i < n-1; i++ {
+		chunks = append(chunks, data[i*size:(i+1)*size])
+	}
+	return append(chunks, data[(n-1)*size:])
+}
+
+// readFullContext fills data from r, like io.ReadFull, unless ctx is done
+// first.  A read in progress when ctx is done is left to finish in the
+// background, and data must then not be reused.
+func readFullContext(ctx context.Context, r io.Reader, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ctx.Done() == nil {
+		_, err := io.ReadFull(r, data)
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(r, data)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// challenge returns the request's challenge, or writes a Bad Request
+// response and returns false if it is missing or invalid.
+func (p *PollenServer) challenge(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if p.userAgent != nil && !p.userAgent.MatchString(r.UserAgent()) {
+		http.Error(w, usePollinateError, http.StatusBadRequest)
+		return "", false
+	}
+	source := p.challengeSource
+	if source == "" {
+		source = "any"
+	}
+	challenge := challengeSources[source](r)
+	if challenge == "" && (source == "any" || source == "body") && r.Method == "POST" && rawBody(r) {
+		/* The whole body is the challenge, read no further than the cap, however it is sent */
+		var body io.Reader = r.Body
+		if p.maxChallengeBytes > 0 {
+			body = http.MaxBytesReader(w, r.Body, int64(p.maxChallengeBytes))
+		}
+		decoded, err := decodeBody(r.Header.Get("Content-Encoding"), body)
+		if err == errUnknownEncoding {
+			http.Error(w, fmt.Sprintf("Unsupported Content-Encoding: %s", r.Header.Get("Content-Encoding")), http.StatusUnsupportedMediaType)
+			return "", false
+		}
+		/* However small it is compressed, a challenge is bounded as it decompresses */
+		limit := p.maxChallengeBytes
+		if limit == 0 && decoded != body {
+			limit = maxDecodedChallengeBytes
+		}
+		if err == nil && limit > 0 {
+			decoded = io.LimitReader(decoded, int64(limit)+1)
+		}
+		var raw []byte
+		if err == nil {
+			raw, err = ioutil.ReadAll(decoded)
+		}
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) || limit > 0 && len(raw) > limit {
+			http.Error(w, fmt.Sprintf("The challenge must be at most %d bytes", limit), http.StatusRequestEntityTooLarge)
+			return "", false
+		}
+		if err != nil {
+			http.Error(w, "Cannot read the challenge", http.StatusBadRequest)
+			return "", false
+		}
+		challenge = string(raw)
+	}
+	if p.maxChallengeBytes > 0 && len(challenge) > p.maxChallengeBytes {
+		http.Error(w, fmt.Sprintf("The challenge must be at most %d bytes", p.maxChallengeBytes), http.StatusRequestEntityTooLarge)
+		return "", false
+	}
+	challenge, err := p.checkChallenge(challenge)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	return challenge, true
+}
+
+// maxDecodedChallengeBytes bounds a compressed challenge as it decompresses,
+// without a -max-challenge-bytes, so that a small bomb cannot fill memory
+const maxDecodedChallengeBytes = 1 << 20
+
+var errUnknownEncoding = errors.New("unknown content encoding")
+
+// decodeBody decompresses a body of the given Content-Encoding, gzip or
+// deflate, returning it as is without one.
+func decodeBody(encoding string, body io.Reader) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(body)
+	case "deflate":
+		return zlib.NewReader(body)
+	}
+	return nil, errUnknownEncoding
+}
+
+// rawBody reports whether a request's body is the challenge itself, rather
+// than a form holding it
+func rawBody(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType != "application/x-www-form-urlencoded" && mediaType != "multipart/form-data"
+}
+
+// checkChallenge returns the challenge to be hashed, or an error explaining
+// why it is missing or invalid.
+func (p *PollenServer) checkChallenge(challenge string) (string, error) {
+	if challenge == "" {
+		return "", errors.New(usePollinateError)
+	}
+	if !strings.HasPrefix(challenge, p.challengePrefix) {
+		return "", fmt.Errorf("The challenge must begin with %q", p.challengePrefix)
+	}
+	unprefixed := challenge[len(p.challengePrefix):]
+	if p.strictChallenge && !validChallenge(unprefixed, p.challengeLength) {
+		return "", fmt.Errorf("The challenge must be %d hex characters.  %s", p.challengeLength, usePollinateError)
+	}
+	if decode, ok := challengeDecoders[p.challengeDecode]; ok {
+		decoded, err := decode(unprefixed)
+		if err != nil {
+			return "", fmt.Errorf("The challenge must be %s", p.challengeDecode)
+		}
+		unprefixed = string(decoded)
+	}
+	if p.hashChallengePrefix {
+		return p.challengePrefix + unprefixed, nil
+	}
+	return unprefixed, nil
+}
+
+// validChallenge reports whether the challenge is hex of the given length,
+// as the pollinate client sends.
+func validChallenge(challenge string, length int) bool {
+	if len(challenge) != length {
+		return false
+	}
+	_, err := hex.DecodeString(challenge)
+	return err == nil
+}
+
+// serveVerify recomputes the response to a challenge, reporting whether it
+// matches the expected challenge_response, without touching the device.
+func (p *PollenServer) serveVerify(w http.ResponseWriter, r *http.Request) {
+	challenge, ok := p.challenge(w, r)
+	if !ok {
+		return
+	}
+	expected, err := hex.DecodeString(r.FormValue("challenge_response"))
+	if err != nil || len(expected) == 0 {
+		http.Error(w, "The expected challenge_response must be given in hex", http.StatusBadRequest)
+		return
+	}
+	checksum := p.hashChallenge(challenge)
+	if !hmac.Equal(checksum.Sum(nil), expected) {
+		http.Error(w, "mismatch", http.StatusConflict)
+		return
+	}
+	fmt.Fprintln(w, "match")
+}
+
+// stir writes the hashed challenge to the random device
+func (p *PollenServer) stir(challengeResponse []byte, remoteAddr string) {
+	if p.stirBytes < 0 {
+		return
+	}
+	data := challengeResponse
+	if p.stirBytes > 0 {
+		data = expandStir(challengeResponse, p.stirBytes)
+	}
+	if p.stirMetadata {
+		/* Only the device sees these, so the challenge response is unchanged */
+		data = append(append([]byte{}, data...), remoteAddr...)
+		data = binary.BigEndian.AppendUint64(data, uint64(time.Now().UnixNano()))
+	}
+	logKV := p.log.ErrKV
+	if p.writeFailureInfo {
+		logKV = p.log.InfoKV
+	}
+	written, err := p.randomSource.Write(data)
+	for err == nil && written < len(data) {
+		/* A short write stirs less than intended, so the rest is retried while that makes progress */
+		logKV("Short write to random device", "written", written, "expected", len(data), "at", time.Now().UnixNano())
+		var n int
+		n, err = p.randomSource.Write(data[written:])
+		if n == 0 && err == nil {
+			return
+		}
+		written += n
+	}
+	if err != nil {
+		/* Non-fatal error, but let's log this to syslog */
+		logKV("Cannot write to random device", "at", time.Now().UnixNano())
+	}
+}
+
+// expandStir returns n bytes of stirring material, the challenge response
+// truncated, or followed by the hashes of it and a counter.
+func expandStir(challengeResponse []byte, n int) []byte {
+	data := append([]byte{}, challengeResponse...)
+	for counter := uint32(0); len(data) < n; counter++ {
+		block := newHash()
+		block.Write(challengeResponse)
+		binary.Write(block, binary.BigEndian, counter)
+		data = block.Sum(data)
+	}
+	return data[:n]
+}
+
+// mux routes the challenge at / and all the other endpoints to the server
+func (p *PollenServer) mux() http.Handler {
+	return p.serviceMux(true)
+}
+
+// serviceMux routes the challenge at / and the client endpoints, and the
+// operational endpoints only if ops is set.  Otherwise those are not found,
+// rather than being taken for challenges.
+func (p *PollenServer) serviceMux(ops bool) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", p)
+	p.handle(mux, "stir", "/stir", p.serveStir)
+	p.handle(mux, "verify", "/verify", p.serveVerify)
+	p.handle(mux, "ready", "/ready", p.serveReady)
+	p.handle(mux, "stream", "/stream", p.serveStream)
+	p.handle(mux, "batch", "/batch", p.serveBatch)
+	p.handle(mux, "capabilities", "/capabilities", p.serveCapabilities(ops))
+	for path, size := range p.sizeRoutes {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			p.serveChallenge(w, r, size)
+		})
+	}
+	mux.HandleFunc("/favicon.ico", serveFavicon)
+	mux.HandleFunc("/robots.txt", serveRobots)
+	opsMux := p.monitoringMux()
+	for _, pattern := range opsPatterns {
+		if ops {
+			mux.Handle(pattern, opsMux)
+		} else {
+			mux.Handle(pattern, http.NotFoundHandler())
+		}
+	}
+	return p.notifyWebhook(p.limitEgress(p.padResponses(p.addHeaders(p.filterClients(p.limitRate(mux))))))
+}
+
+// serveFavicon answers browsers with no content, rather than with a
+// missing challenge error
+func serveFavicon(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveRobots asks crawlers to keep away, since there is nothing to index
+func serveRobots(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, "User-agent: *\nDisallow: /\n")
+}
+
+// opsPatterns are the operational endpoints of the monitoring mux
+var opsPatterns = []string{"/stats", "/metrics", "/health", "/admin/", "/debug/"}
+
+// monitoringMux routes only the operational endpoints, for a private listener
+func (p *PollenServer) monitoringMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	p.handle(mux, "stats", "/stats", p.serveStats)
+	p.handle(mux, "metrics", "/metrics", p.serveMetrics)
+	p.handle(mux, "health", "/health", p.serveHealth)
+	p.handle(mux, "ready", "/ready", p.serveReady)
+	p.handle(mux, "admin", "/admin/reseed", p.serveReseed)
+	p.handle(mux, "admin", "/admin/drain", p.serveDrain)
+	p.handle(mux, "admin", "/admin/rotate-hmac", p.serveRotateHMAC)
+	p.handle(mux, "debug", "/debug/raw", p.serveDebugRaw)
+	return mux
+}
+
+// privateMux is the monitoringMux, with the pprof profiles if enabled, for
+// the private listener alone.  The service ports never route to it.
+func (p *PollenServer) privateMux() *http.ServeMux {
+	mux := p.monitoringMux()
+	if p.pprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return mux
+}
+
+// supervise runs listen, restarting it with an exponential backoff each time
+// it fails, up to retries times.  It returns the final error.
+func (p *PollenServer) supervise(name string, listen func() error, retries int, delay time.Duration) error {
+	for attempt := 0; ; attempt++ {
+		err := listen()
+		if err == nil || attempt >= retries {
+			return err
+		}
+		p.log.ErrKV("Listener failed, restarting", "listener", name, "error", err, "delay", delay, "at", time.Now().UnixNano())
+		p.restartingListeners.Add(1)
+		time.Sleep(delay)
+		p.restartingListeners.Add(-1)
+		delay *= 2
 	}
-	p.log.Info(fmt.Sprintf("Server sent response to [%s, %s] at [%v] in [%.6fs] with [e%s] available",
-		r.RemoteAddr, r.UserAgent(), time.Now().UnixNano(), time.Since(startTime).Seconds(), strings.Split(string(avail), "\n")[0]))
 }
 
 func main() {
 	flag.Parse()
-	if *httpPort == "" && *httpsPort == "" {
-		fatal("Nothing to do if http and https are both disabled")
+	if err := applyEnv(flag.CommandLine, os.LookupEnv); err != nil {
+		fatalf("%s\n", err)
+	}
+	if *printConfigFlag {
+		printConfig(os.Stdout, flag.CommandLine)
+		return
+	}
+	if *loadTestURL != "" {
+		if err := runLoadTest(os.Stdout); err != nil {
+			fatalf("%s\n", err)
+		}
+		return
 	}
-	log, err := syslog.New(syslog.LOG_ERR, "pollen")
+	if *httpPort == "" && *httpsPort == "" && *dnsPort == "" {
+		fatal("Nothing to do if http, https and dns are all disabled")
+	}
+	facility, err := parseFacility(*syslogFacility)
 	if err != nil {
-		fatalf("Cannot open syslog: %s\n", err)
+		fatalf("%s\n", err)
+	}
+	var log logger
+	if *logFile != "" {
+		if log, err = openLogFile(*logFile, *syslogTag); err != nil {
+			fatalf("Cannot open log file: %s\n", err)
+		}
+	} else {
+		log = openLog(*syslogNetwork, *syslogAddr, facility|syslog.LOG_ERR, *syslogTag, os.Stderr)
 	}
 	defer log.Close()
-	log.Info(fmt.Sprintf("pollen starting at [%v]", time.Now().UnixNano()))
-	dev, err := os.OpenFile(*device, os.O_RDWR, 0)
+	go reopenLogOnHangup(log)
+	logLifecycle(log, *quiet, "starting")
+	handler, bound, cleanup, err := setup(log)
 	if err != nil {
-		fatalf("Cannot open device: %s\n", err)
+		log.Crit(err.Error())
+		fatalf("%s\n", err)
+	}
+	defer cleanup()
+	if *runAsUser != "" {
+		if err := dropPrivileges(*runAsUser); err != nil {
+			handler.fatalf("Cannot drop privileges to %s: %s\n", *runAsUser, err)
+		}
+	}
+	if handler.standby != nil {
+		go handler.monitorStandby(*standbyInterval)
+	}
+	if *clientIPHeader != "" {
+		handler.ClientIP = headerClientIP(*clientIPHeader)
+	}
+	if *minBootEntropy > 0 {
+		handler.awaitingEntropy.Store(true)
+		go handler.waitForEntropy(kernelEntropy, *minBootEntropy, time.Second, *minBootEntropyTimeout)
+	}
+	if *entropyMonitor > 0 {
+		go handler.monitorEntropy(context.Background(), *entropyMonitor, max(*entropyMonitorFails, 1))
 	}
-	defer dev.Close()
-	handler := &PollenServer{randomSource: dev, log: log, readSize: *size}
-	http.Handle("/", handler)
 	var httpListeners sync.WaitGroup
+	mux := handler.mux()
+	if *monitoringAddr != "" {
+		mux = handler.serviceMux(false)
+		httpListeners.Add(1)
+		go func() {
+			server := &http.Server{Addr: *monitoringAddr, Handler: handler.privateMux(), MaxHeaderBytes: *maxHeaderBytes}
+			handler.fatal(handler.supervise("monitoring", func() error {
+				ln := takeListener(&bound.monitoring)
+				if ln == nil {
+					var err error
+					if ln, err = net.Listen("tcp", *monitoringAddr); err != nil {
+						return err
+					}
+				}
+				return server.Serve(ln)
+			}, *listenRetries, *listenRetryDelay))
+			httpListeners.Done()
+		}()
+	}
+	if *dnsPort != "" {
+		dnsAddr := fmt.Sprintf(":%s", *dnsPort)
+		httpListeners.Add(2)
+		go func() {
+			handler.fatal(handler.supervise("dns", func() error {
+				conn := takeListener(&bound.dns)
+				if conn == nil {
+					var err error
+					if conn, err = listenConfig(*reusePort).ListenPacket(context.Background(), "udp", dnsAddr); err != nil {
+						return err
+					}
+				}
+				defer conn.Close()
+				return handler.serveDNSUDP(conn, *dnsZone)
+			}, *listenRetries, *listenRetryDelay))
+			httpListeners.Done()
+		}()
+		go func() {
+			handler.fatal(handler.supervise("dns-tcp", func() error {
+				ln := takeListener(&bound.dnsTCP)
+				if ln == nil {
+					var err error
+					if ln, err = listenConfig(*reusePort).Listen(context.Background(), "tcp", dnsAddr); err != nil {
+						return err
+					}
+				}
+				defer ln.Close()
+				return handler.serveDNSTCP(ln, *dnsZone)
+			}, *listenRetries, *listenRetryDelay))
+			httpListeners.Done()
+		}()
+	}
 	if *httpPort != "" {
 		httpAddr := fmt.Sprintf(":%s", *httpPort)
 		httpListeners.Add(1)
 		go func() {
-			handler.fatal(http.ListenAndServe(httpAddr, nil))
+			server := &http.Server{Addr: httpAddr, Handler: mux, MaxHeaderBytes: *maxHeaderBytes, ConnContext: handler.connContext}
+			handler.fatal(handler.supervise("http", func() error {
+				ln := takeListener(&bound.http)
+				if ln == nil {
+					var err error
+					if ln, err = listen(httpAddr, log); err != nil {
+						return err
+					}
+				}
+				return server.Serve(ln)
+			}, *listenRetries, *listenRetryDelay))
 			httpListeners.Done()
 		}()
 	}
 	if *httpsPort != "" {
 		httpsAddr := fmt.Sprintf(":%s", *httpsPort)
+		/* Without shared keys, each instance's tickets would outlive its restarts */
+		config := newTLSConfig(*sessionTicketKeysFile != "")
+		/* Loaded by setup, as restarts after dropping privileges may no longer read them */
+		config.Certificates = []tls.Certificate{bound.certificate}
+		if bound.ticketKeys != nil {
+			config.SetSessionTicketKeys(bound.ticketKeys)
+		}
+		configs := []*tls.Config{config}
+		/* HTTP/3 gets its own copy, as QUIC negotiates its own protocols */
+		var http3Config *tls.Config
+		if listenHTTP3 != nil {
+			http3Config = config.Clone()
+			configs = append(configs, http3Config)
+		}
+		if *sessionTicketKeysFile != "" {
+			go handler.reloadTicketKeysOnHangup(*sessionTicketKeysFile, configs...)
+		}
 		httpListeners.Add(1)
 		go func() {
-			config := &tls.Config{MinVersion: tls.VersionTLS10}
-			server := &http.Server{Addr: httpsAddr, Handler: handler, TLSConfig: config}
-			handler.fatal(server.ListenAndServeTLS(*cert, *key))
+			server := &http.Server{Addr: httpsAddr, Handler: mux, TLSConfig: config, MaxHeaderBytes: *maxHeaderBytes, ConnContext: handler.connContext}
+			handler.configureALPN(server)
+			handler.fatal(handler.supervise("https", func() error {
+				ln := takeListener(&bound.https)
+				if ln == nil {
+					var err error
+					if ln, err = listen(httpsAddr, log); err != nil {
+						return err
+					}
+				}
+				/* ServeTLS would serve a copy of config, which reloaded ticket keys wouldn't reach */
+				return server.Serve(tls.NewListener(ln, config))
+			}, *listenRetries, *listenRetryDelay))
 			httpListeners.Done()
 		}()
+		if listenHTTP3 != nil {
+			httpListeners.Add(1)
+			go func() {
+				if err := listenHTTP3(handler, mux, http3Config, &bound.http3); err != nil {
+					handler.fatal(err)
+				}
+				httpListeners.Done()
+			}()
+		}
 	}
 	httpListeners.Wait()
+	logLifecycle(log, *quiet, "stopping")
+}
+
+// bindHTTP3 and listenHTTP3, set only in builds with the http3 tag, bind the
+// UDP socket of -http3-port, if set, before privileges are dropped, and then
+// serve mux over HTTP/3 on it alongside HTTPS
+var (
+	bindHTTP3   func() (net.PacketConn, error)
+	listenHTTP3 func(p *PollenServer, mux http.Handler, config *tls.Config, bound *net.PacketConn) error
+)
+
+// syslogFacilities maps facility names, as syslog.conf(5) spells them, to their priorities
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// parseFacility returns the syslog facility of the given name
+func parseFacility(name string) (syslog.Priority, error) {
+	facility, ok := syslogFacilities[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("Unknown syslog facility: %s", name)
+	}
+	return facility, nil
+}
+
+// logLifecycle logs pollen starting or stopping, unless quiet
+func logLifecycle(log logger, quiet bool, event string) {
+	if quiet {
+		return
+	}
+	log.Info(fmt.Sprintf("pollen %s at [%v]", event, time.Now().UnixNano()))
 }
 
 func (p *PollenServer) fatal(args ...interface{}) {
@@ -3,15 +3,30 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"crypto/sha512"
+	"crypto/tls"
 	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log/syslog"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type logEntry struct {
@@ -20,32 +35,54 @@ type logEntry struct {
 }
 
 type localLogger struct {
+	mu   sync.Mutex
 	logs []logEntry
 }
 
-func (l *localLogger) Close() error {
-	l.logs = append(l.logs, logEntry{"close", ""})
+func (l *localLogger) log(severity, msg string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logs = append(l.logs, logEntry{severity, msg})
 	return nil
 }
 
-func (l *localLogger) Info(msg string) error {
-	l.logs = append(l.logs, logEntry{"info", msg})
+// Logs returns a copy of the logs, for reading while the server runs
+func (l *localLogger) Logs() []logEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]logEntry(nil), l.logs...)
+}
+
+func (l *localLogger) Reopen() error {
 	return nil
 }
 
+func (l *localLogger) Close() error {
+	return l.log("close", "")
+}
+
+func (l *localLogger) Info(msg string) error {
+	return l.log("info", msg)
+}
+
 func (l *localLogger) Err(msg string) error {
-	l.logs = append(l.logs, logEntry{"err", msg})
-	return nil
+	return l.log("err", msg)
 }
 
 func (l *localLogger) Crit(msg string) error {
-	l.logs = append(l.logs, logEntry{"crit", msg})
-	return nil
+	return l.log("crit", msg)
 }
 
 func (l *localLogger) Emerg(msg string) error {
-	l.logs = append(l.logs, logEntry{"emerg", msg})
-	return nil
+	return l.log("emerg", msg)
+}
+
+func (l *localLogger) InfoKV(msg string, kv ...interface{}) error {
+	return l.Info(flattenKV(msg, kv))
+}
+
+func (l *localLogger) ErrKV(msg string, kv ...interface{}) error {
+	return l.Err(flattenKV(msg, kv))
 }
 
 type Suite struct {
@@ -68,7 +105,7 @@ func NewSuite(t *testing.T) *Suite {
 func NewSuiteWithDev(t *testing.T, dev io.ReadWriter) *Suite {
 	logger := &localLogger{}
 	handler := &PollenServer{randomSource: dev, log: logger, readSize: 64}
-	return &Suite{httptest.NewServer(handler), t, dev, logger, handler}
+	return &Suite{httptest.NewServer(handler.mux()), t, dev, logger, handler}
 }
 
 func (s *Suite) Assert(v bool, args ...interface{}) {
@@ -156,6 +193,26 @@ func TestPorkChopSandwiches(t *testing.T) {
 	s.SanityCheck(chal, resp)
 }
 
+// TestDecodedChallenge tests that a hex challenge may be decoded before hashing
+func TestDecodedChallenge(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+	s.pollen.challengeDecode = "hex"
+
+	res, err := http.Get(s.URL + "?challenge=" + hex.EncodeToString([]byte("pork chop sandwiches")))
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	chal, resp, err := ReadResp(res.Body)
+	s.Assert(err == nil, "response error:", err)
+	s.Assert(chal == PorkChopSha512, "expected:", PorkChopSha512, "got:", chal)
+	s.SanityCheck(chal, resp)
+
+	res, err = http.Get(s.URL + "?challenge=pork+chop+sandwiches")
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusBadRequest, "expected a challenge that isn't hex to be rejected, got:", res.Status)
+}
+
 // TestPorkChopPost tests the pollen service when the
 // pork chop sandwiches are POSTed.
 func TestPostChopSandwiches(t *testing.T) {
@@ -171,6 +228,135 @@ func TestPostChopSandwiches(t *testing.T) {
 	s.SanityCheck(chal, resp)
 }
 
+// TestChallengeSource tests that each restricted source reads its challenge, and only that
+func TestChallengeSource(t *testing.T) {
+	query := func(s *Suite) (*http.Response, error) {
+		return http.Post(s.URL+"?challenge=pork+chop+sandwiches", "application/x-www-form-urlencoded", strings.NewReader(""))
+	}
+	form := func(s *Suite) (*http.Response, error) {
+		return http.PostForm(s.URL, url.Values{"challenge": []string{"pork chop sandwiches"}})
+	}
+	raw := func(s *Suite) (*http.Response, error) {
+		return http.Post(s.URL, "application/octet-stream", strings.NewReader("pork chop sandwiches"))
+	}
+	header := func(s *Suite) (*http.Response, error) {
+		req, _ := http.NewRequest("GET", s.URL, nil)
+		req.Header.Set("X-Challenge", "pork chop sandwiches")
+		return http.DefaultClient.Do(req)
+	}
+	for _, test := range []struct {
+		source  string
+		served  []func(*Suite) (*http.Response, error)
+		refused []func(*Suite) (*http.Response, error)
+	}{
+		{"query", []func(*Suite) (*http.Response, error){query}, []func(*Suite) (*http.Response, error){form, raw, header}},
+		{"body", []func(*Suite) (*http.Response, error){form, raw}, []func(*Suite) (*http.Response, error){query, header}},
+		{"header", []func(*Suite) (*http.Response, error){header}, []func(*Suite) (*http.Response, error){query, form, raw}},
+	} {
+		s := NewSuite(t)
+		s.pollen.challengeSource = test.source
+		for i, request := range test.served {
+			res, err := request(s)
+			s.Assert(err == nil, "http client error:", err)
+			chal, _, err := ReadResp(res.Body)
+			res.Body.Close()
+			s.Assert(err == nil, test.source, i, "response error:", err)
+			s.Assert(chal == PorkChopSha512, test.source, i, "expected:", PorkChopSha512, "got:", chal)
+		}
+		for i, request := range test.refused {
+			res, err := request(s)
+			s.Assert(err == nil, "http client error:", err)
+			res.Body.Close()
+			s.Assert(res.StatusCode == http.StatusBadRequest, test.source, i, "expected 400, got:", res.Status)
+		}
+		s.TearDown()
+	}
+}
+
+// PostChunked POSTs body as a raw, chunked challenge
+func (s *Suite) PostChunked(body string) *http.Response {
+	reader, writer := io.Pipe()
+	go func() {
+		/* Written in pieces of unknown total length, so the client must chunk it */
+		for len(body) > 0 {
+			n := len(body)
+			if n > 7 {
+				n = 7
+			}
+			io.WriteString(writer, body[:n])
+			body = body[n:]
+		}
+		writer.Close()
+	}()
+	res, err := http.Post(s.URL, "application/octet-stream", reader)
+	s.Assert(err == nil, "http client error:", err)
+	return res
+}
+
+// TestRawChallenge tests a challenge sent as a chunked raw body, under and over the cap
+func TestRawChallenge(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+	s.pollen.maxChallengeBytes = 32
+
+	res := s.PostChunked("pork chop sandwiches")
+	defer res.Body.Close()
+	chal, resp, err := ReadResp(res.Body)
+	s.Assert(err == nil, "response error:", err)
+	s.Assert(chal == PorkChopSha512, "expected:", PorkChopSha512, "got:", chal)
+	s.SanityCheck(chal, resp)
+
+	res = s.PostChunked(strings.Repeat("pork chop sandwiches", 10))
+	defer res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusRequestEntityTooLarge, "expected Request Entity Too Large, got:", res.Status)
+}
+
+// PostEncoded posts body as a raw challenge, compressed with the given
+// Content-Encoding, gzip or deflate
+func (s *Suite) PostEncoded(encoding, body string) *http.Response {
+	var compressed bytes.Buffer
+	var writer io.WriteCloser = gzip.NewWriter(&compressed)
+	if encoding == "deflate" {
+		writer = zlib.NewWriter(&compressed)
+	}
+	io.WriteString(writer, body)
+	writer.Close()
+	req, _ := http.NewRequest("POST", s.URL, &compressed)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", encoding)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		s.t.Fatal("http client error:", err)
+	}
+	return res
+}
+
+// TestEncodedChallenge tests that a compressed raw challenge is hashed as it
+// decompresses, and that a decompression bomb is refused
+func TestEncodedChallenge(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+	s.pollen.maxChallengeBytes = 64
+
+	for _, encoding := range []string{"gzip", "deflate"} {
+		res := s.PostEncoded(encoding, "pork chop sandwiches")
+		defer res.Body.Close()
+		chal, resp, err := ReadResp(res.Body)
+		s.Assert(err == nil, encoding, "response error:", err)
+		s.Assert(chal == PorkChopSha512, encoding, "expected:", PorkChopSha512, "got:", chal)
+		s.SanityCheck(chal, resp)
+	}
+
+	/* Far smaller compressed than the cap, but far larger decompressed */
+	res := s.PostEncoded("gzip", strings.Repeat("0", 1<<20))
+	res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusRequestEntityTooLarge, "expected Request Entity Too Large, got:", res.Status)
+	s.pollen.maxChallengeBytes = 0
+	res = s.PostEncoded("gzip", strings.Repeat("0", 2<<20))
+	res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusRequestEntityTooLarge, "expected Request Entity Too Large without a cap, got:", res.Status)
+}
+
 const UniqueChainRounds = 100
 
 // TestUniqueChaining tests the uniqueness of seeds and challenge responses
@@ -255,6 +441,32 @@ func TestCannedContent(t *testing.T) {
 	s.Assert(PorkChopSha512 == writtenBytesInHex, "expected:", PorkChopSha512, "got:", writtenBytesInHex)
 }
 
+// TestStirBytes tests that the configured number of bytes is stirred into a canned source
+func TestStirBytes(t *testing.T) {
+	for _, n := range []int{-1, 16, 64, 200} {
+		b := bytes.NewBufferString(DilbertRandom)
+		s := NewSuiteWithDev(t, b)
+		s.pollen.stirBytes = n
+		res, err := http.Get(s.URL + "?challenge=pork+chop+sandwiches")
+		s.Assert(err == nil, "http client error:", err)
+		res.Body.Close()
+		written := b.Bytes()
+		if n < 0 {
+			s.Assert(len(written) == 0, "expected nothing stirred, got:", len(written))
+		} else {
+			s.Assert(len(written) == n, "expected", n, "bytes stirred, got:", len(written))
+			s.Assert(strings.HasPrefix(PorkChopSha512, fmt.Sprintf("%x", written[:min(n, 64)])), "expected the challenge hash first, got:", written)
+		}
+		if n == 200 {
+			expected := sha512.New()
+			expected.Write(written[:64])
+			expected.Write([]byte{0, 0, 0, 1})
+			s.Assert(bytes.Equal(written[128:192], expected.Sum(nil)), "expected the hash of the challenge hash and counter 1, got:", written[128:192])
+		}
+		s.TearDown()
+	}
+}
+
 // TestSizeMatters asserts that changing 'size' changes how many bytes we read
 func TestSizeMatters(t *testing.T) {
 	b := bytes.NewBufferString(DilbertRandom)
@@ -318,20 +530,114 @@ func TestWriteFailure(t *testing.T) {
 	s.SanityCheck(chal, seed)
 	// Failing to write to the random device is logged
 	s.Assert(len(s.logger.logs) == 3, "expected 3 log messages, got:", len(s.logger.logs))
-	start := "Cannot write to random device at ["
+	start := "Cannot write to random device at="
 	s.Assert(s.logger.logs[0].severity == "err" &&
 		s.logger.logs[0].message[:len(start)] == start,
 		"didn't get the expected error message, got:", s.logger.logs[0])
-	start = "Server received challenge from ["
+	start = "Server received challenge remote_addr="
 	s.Assert(s.logger.logs[1].severity == "info" &&
 		s.logger.logs[1].message[:len(start)] == start,
 		"didn't get the expected error message, got:", s.logger.logs[1])
-	start = "Server sent response to ["
+	start = "Server sent response remote_addr="
 	s.Assert(s.logger.logs[2].severity == "info" &&
 		s.logger.logs[2].message[:len(start)] == start,
 		"didn't get the expected error message, got:", s.logger.logs[2])
 }
 
+// TestWriteFailureInfo tests that write failures may be logged at info instead
+func TestWriteFailureInfo(t *testing.T) {
+	b := &OnlyReader{bytes.NewBufferString(DilbertRandom)}
+	s := NewSuiteWithDev(t, b)
+	defer s.TearDown()
+	s.pollen.writeFailureInfo = true
+
+	res, err := http.Get(s.URL + "?challenge=xxx")
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	chal, seed, err := ReadResp(res.Body)
+	s.Assert(err == nil, "response err:", err)
+	s.SanityCheck(chal, seed)
+	s.Assert(len(s.logger.logs) == 3, "expected 3 log messages, got:", len(s.logger.logs))
+	start := "Cannot write to random device at="
+	s.Assert(s.logger.logs[0].severity == "info" &&
+		s.logger.logs[0].message[:len(start)] == start,
+		"didn't get the expected info message, got:", s.logger.logs[0])
+}
+
+// StuckReader serves nines on every read, like a broken random device
+type StuckReader struct{}
+
+func (StuckReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = '9'
+	}
+	return len(p), nil
+}
+
+func (StuckReader) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// TestSeedRepeat tests that a stuck random device is caught by its repeated seeds
+func TestSeedRepeat(t *testing.T) {
+	s := NewSuiteWithDev(t, StuckReader{})
+	defer s.TearDown()
+	s.pollen.recentSeeds = newLRU(16)
+
+	res, err := http.Get(s.URL + "?challenge=xxx")
+	s.Assert(err == nil, "http client error:", err)
+	chal, seed, err := ReadResp(res.Body)
+	res.Body.Close()
+	s.Assert(err == nil, "response err:", err)
+	s.SanityCheck(chal, seed)
+
+	res, err = http.Get(s.URL + "?challenge=xxx")
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusInternalServerError, "expected a repeated seed to fail, got:", res.Status)
+	last := s.logger.logs[len(s.logger.logs)-1]
+	start := "Seed repeats a recent seed remote_addr="
+	s.Assert(last.severity == "crit" && strings.HasPrefix(last.message, start),
+		"didn't get the expected crit message, got:", last)
+}
+
+// ShortWriter writes at most limit bytes at a time, or none if limit is 0
+type ShortWriter struct {
+	*bytes.Buffer
+	limit int
+}
+
+func (w *ShortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		p = p[:w.limit]
+	}
+	return w.Buffer.Write(p)
+}
+
+// TestShortWrite tests that short writes to our random device are logged and retried
+func TestShortWrite(t *testing.T) {
+	w := &ShortWriter{bytes.NewBufferString(DilbertRandom), 16}
+	s := NewSuiteWithDev(t, w)
+	defer s.TearDown()
+
+	res, err := http.PostForm(s.URL+"/stir", url.Values{"challenge": []string{"pork chop sandwiches"}})
+	s.Assert(err == nil, "http client error:", err)
+	res.Body.Close()
+	written := fmt.Sprintf("%x", w.Bytes()[len(DilbertRandom):])
+	s.Assert(written == PorkChopSha512, "expected the whole hash written, got:", written)
+	s.Assert(len(s.logger.logs) == 4, "expected 3 short writes and the stir logged, got:", s.logger.logs)
+	start := "Short write to random device written=16 expected=64 "
+	s.Assert(s.logger.logs[0].severity == "err" && strings.HasPrefix(s.logger.logs[0].message, start),
+		"didn't get the expected error message, got:", s.logger.logs[0])
+
+	/* A device that accepts nothing is not retried forever */
+	w.limit = 0
+	res, err = http.PostForm(s.URL+"/stir", url.Values{"challenge": []string{"pork chop sandwiches"}})
+	s.Assert(err == nil, "http client error:", err)
+	res.Body.Close()
+	s.Assert(len(s.logger.logs) == 6, "expected one more short write and the stir logged, got:", s.logger.logs)
+}
+
 type FailingReader struct {
 	*bytes.Buffer
 }
@@ -355,12 +661,629 @@ func TestReadFailure(t *testing.T) {
 	s.Assert(errMsg == "Failed to read from random device", "wrong error: ", errMsg)
 	s.Assert(res.StatusCode == http.StatusInternalServerError, "wrong status: ", res.Status)
 	s.Assert(len(s.logger.logs) == 2, "expected 2 log messages, got: ", len(s.logger.logs))
-	start := "Server received challenge from ["
+	start := "Server received challenge remote_addr="
 	s.Assert(s.logger.logs[0].severity == "info" &&
 		s.logger.logs[0].message[:len(start)] == start,
 		"didn't get the expected error message, got:", s.logger.logs[0])
-	start = "Cannot read from random device at ["
+	start = "Cannot read from random device at="
 	s.Assert(s.logger.logs[1].severity == "err" &&
 		s.logger.logs[1].message[:len(start)] == start,
 		"didn't get the expected error message, got:", s.logger.logs[1])
 }
+
+// TestReadFailureJSON tests that a client negotiating JSON gets a read
+// failure as a structured error
+func TestReadFailureJSON(t *testing.T) {
+	s := NewSuiteWithDev(t, &FailingReader{bytes.NewBufferString("")})
+	defer s.TearDown()
+
+	req, _ := http.NewRequest("GET", s.URL+"?challenge=xxx", nil)
+	req.Header.Set("Accept", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusInternalServerError, "wrong status: ", res.Status)
+	s.Assert(res.Header.Get("Content-Type") == "application/json", "wrong content type:", res.Header.Get("Content-Type"))
+	body, err := ioutil.ReadAll(res.Body)
+	s.Assert(err == nil, "response error:", err)
+	s.Assert(string(body) == `{"error":"device_read_failed"}`+"\n", "wrong error body:", string(body))
+}
+
+// TestClientGone tests that no entropy is read for a client that has gone away
+func TestClientGone(t *testing.T) {
+	b := bytes.NewBufferString(DilbertRandom)
+	s := NewSuiteWithDev(t, b)
+	defer s.TearDown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest("GET", "/?challenge=xxx", nil).WithContext(ctx)
+	s.pollen.ServeHTTP(httptest.NewRecorder(), req)
+	remaining := b.Bytes()
+	s.Assert(len(remaining) == len(DilbertRandom)+64, "expected no bytes read, got remaining:", len(remaining))
+	start := "Client went away before its seed was read remote_addr="
+	s.Assert(len(s.logger.logs) == 2 && s.logger.logs[1].severity == "info" &&
+		strings.HasPrefix(s.logger.logs[1].message, start),
+		"didn't get the expected message, got:", s.logger.logs)
+}
+
+// TestBrowserPaths tests that browsers and crawlers are answered quietly
+func TestBrowserPaths(t *testing.T) {
+	b := bytes.NewBufferString(DilbertRandom)
+	s := NewSuiteWithDev(t, b)
+	defer s.TearDown()
+
+	res, err := http.Get(s.URL + "/favicon.ico")
+	s.Assert(err == nil, "http client error:", err)
+	res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusNoContent, "didn't get No Content, got:", res.Status)
+	res, err = http.Get(s.URL + "/robots.txt")
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	robots, err := ioutil.ReadAll(res.Body)
+	s.Assert(err == nil && string(robots) == "User-agent: *\nDisallow: /\n", "didn't get robots.txt, got:", string(robots), err)
+	s.Assert(len(s.logger.logs) == 0, "expected no log messages, got:", s.logger.logs)
+	s.Assert(b.Len() == len(DilbertRandom), "expected the device untouched, got:", b.Len())
+	s.Assert(s.Stats()["device_read_seconds_count"] == 0, "expected no device reads, got:", s.Stats())
+}
+
+// TestValidateDevice tests that regular files are refused as devices
+func TestValidateDevice(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "random")
+	if err := ioutil.WriteFile(file, []byte(DilbertRandom), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateDevice(file); err == nil {
+		t.Error("expected a regular file to be refused")
+	}
+	if err := checkDeviceMode("/dev/hwrng", os.ModeDevice|os.ModeCharDevice|0600); err != nil {
+		t.Error("expected a character device to be accepted, got:", err)
+	}
+	if err := validateDevice(filepath.Join(t.TempDir(), "missing")); err != nil {
+		t.Error("expected a missing device to be left to opening it, got:", err)
+	}
+}
+
+// TestStir tests that /stir writes the hashed challenge without reading any entropy
+func TestStir(t *testing.T) {
+	b := bytes.NewBufferString(DilbertRandom)
+	s := NewSuiteWithDev(t, b)
+	defer s.TearDown()
+
+	res, err := http.PostForm(s.URL+"/stir", url.Values{"challenge": []string{"pork chop sandwiches"}})
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusNoContent, "didn't get No Content, got:", res.Status)
+	// Nothing was read, and the challenge hash was appended to our random device
+	remaining := b.Bytes()
+	s.Assert(len(remaining) == len(DilbertRandom)+64, "wrong number of bytes remaining, expected 128 got:", len(remaining))
+	writtenBytesInHex := fmt.Sprintf("%x", remaining[len(DilbertRandom):])
+	s.Assert(PorkChopSha512 == writtenBytesInHex, "expected:", PorkChopSha512, "got:", writtenBytesInHex)
+}
+
+// TestStirMetadata tests that identical challenges stir different bytes with metadata
+func TestStirMetadata(t *testing.T) {
+	b := bytes.NewBufferString(DilbertRandom)
+	s := NewSuiteWithDev(t, b)
+	defer s.TearDown()
+	s.pollen.stirMetadata = true
+
+	var stirred []string
+	for i := 0; i < 2; i++ {
+		before := b.Len()
+		res, err := http.PostForm(s.URL+"/stir", url.Values{"challenge": []string{"pork chop sandwiches"}})
+		s.Assert(err == nil, "http client error:", err)
+		res.Body.Close()
+		written := b.Bytes()[before:]
+		s.Assert(len(written) > 64+8, "expected metadata after the challenge hash, got:", len(written))
+		s.Assert(fmt.Sprintf("%x", written[:64]) == PorkChopSha512, "expected the challenge hash first, got:", written)
+		stirred = append(stirred, string(written))
+	}
+	s.Assert(stirred[0] != stirred[1], "identical challenges stirred identical bytes")
+}
+
+// TestStirBytesWithMetadata tests that the metadata follows the -stir-bytes
+// of stirring material, rather than replacing it with the challenge hash
+func TestStirBytesWithMetadata(t *testing.T) {
+	b := bytes.NewBufferString(DilbertRandom)
+	s := NewSuiteWithDev(t, b)
+	defer s.TearDown()
+	s.pollen.stirMetadata = true
+	s.pollen.stirBytes = 16
+
+	res, err := http.PostForm(s.URL+"/stir", url.Values{"challenge": []string{"pork chop sandwiches"}})
+	s.Assert(err == nil, "http client error:", err)
+	res.Body.Close()
+	written := b.Bytes()[len(DilbertRandom):]
+	s.Assert(fmt.Sprintf("%x", written[:16]) == PorkChopSha512[:32], "expected 16 bytes of the challenge hash first, got:", written)
+	s.Assert(strings.HasPrefix(string(written[16:]), "127.0.0.1:") && len(written) > 16+8, "expected the address after the stirred bytes, got:", written)
+}
+
+// TestStirNoChallenge tests /stir when no challenge is given
+func TestStirNoChallenge(t *testing.T) {
+	b := bytes.NewBufferString(DilbertRandom)
+	s := NewSuiteWithDev(t, b)
+	defer s.TearDown()
+
+	res, err := http.Post(s.URL+"/stir", "text/plain", nil)
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusBadRequest, "didn't get Bad Request, got:", res.Status)
+	s.Assert(b.Len() == len(DilbertRandom), "random device was modified")
+}
+
+// TestBufferPoolZeroes asserts that reused buffers carry no entropy from a previous request
+func TestBufferPoolZeroes(t *testing.T) {
+	var pool bufferPool
+	buf := pool.get(64)
+	copy(*buf, DilbertRandom)
+	pool.put(buf)
+	for i := 0; i < 10; i++ {
+		buf = pool.get(64)
+		if len(*buf) != 64 {
+			t.Fatal("wrong buffer size, expected 64 got:", len(*buf))
+		}
+		if !bytes.Equal(*buf, make([]byte, 64)) {
+			t.Fatal("reused buffer leaked data:", *buf)
+		}
+		pool.put(buf)
+	}
+	if len(*pool.get(32)) != 32 {
+		t.Error("buffers of another size must not be shared")
+	}
+}
+
+// BenchmarkBufferPool measures reusing read buffers through the pool
+func BenchmarkBufferPool(b *testing.B) {
+	var pool bufferPool
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf := pool.get(64)
+		pool.put(buf)
+	}
+}
+
+var benchmarkBuffer []byte
+
+// BenchmarkBufferMake measures allocating a fresh read buffer per request
+func BenchmarkBufferMake(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		benchmarkBuffer = make([]byte, 64)
+	}
+}
+
+// TestSuperviseRetries tests that a failing listener is restarted until it succeeds
+func TestSuperviseRetries(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+
+	attempts := 0
+	listen := func() error {
+		attempts++
+		if attempts <= 2 {
+			return fmt.Errorf("address already in use")
+		}
+		return nil
+	}
+	err := s.pollen.supervise("test", listen, 3, time.Millisecond)
+	s.Assert(err == nil, "expected the listener to recover, got:", err)
+	s.Assert(attempts == 3, "expected 3 attempts, got:", attempts)
+	s.Assert(len(s.logger.logs) == 2, "expected 2 log messages, got:", len(s.logger.logs))
+	for _, entry := range s.logger.logs {
+		s.Assert(entry.severity == "err", "expected restarts logged as errors, got:", entry)
+	}
+}
+
+// TestSuperviseGivesUp tests that a listener is not restarted beyond its retries
+func TestSuperviseGivesUp(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+
+	attempts := 0
+	listen := func() error {
+		attempts++
+		return fmt.Errorf("address already in use")
+	}
+	err := s.pollen.supervise("test", listen, 2, time.Millisecond)
+	s.Assert(err != nil, "expected the listener error")
+	s.Assert(attempts == 3, "expected 3 attempts, got:", attempts)
+}
+
+// cannedSeed is the seed expected for a pork chop sandwiches challenge and DilbertRandom
+func cannedSeed() []byte {
+	expectedSum := sha512.New()
+	io.WriteString(expectedSum, "pork chop sandwiches")
+	io.WriteString(expectedSum, DilbertRandom)
+	return expectedSum.Sum(nil)
+}
+
+// GetAccepting requests the pork chop sandwiches challenge accepting the given media type
+func (s *Suite) GetAccepting(accept string) *http.Response {
+	req, err := http.NewRequest("GET", s.URL+"?challenge=pork+chop+sandwiches", nil)
+	s.Assert(err == nil, "request error:", err)
+	req.Header.Set("Accept", accept)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		s.t.Fatal("http client error:", err)
+	}
+	return res
+}
+
+// TestQuietLifecycle tests that -quiet suppresses the startup and shutdown messages
+func TestQuietLifecycle(t *testing.T) {
+	logger := &localLogger{}
+	logLifecycle(logger, true, "starting")
+	logLifecycle(logger, true, "stopping")
+	if len(logger.logs) != 0 {
+		t.Error("expected no log messages, got:", logger.logs)
+	}
+	logLifecycle(logger, false, "starting")
+	if len(logger.logs) != 1 || logger.logs[0].severity != "info" ||
+		!strings.HasPrefix(logger.logs[0].message, "pollen starting at [") {
+		t.Error("expected the startup message, got:", logger.logs)
+	}
+}
+
+// TestStrictChallenge tests that strict mode accepts a pollinate style hex challenge
+func TestStrictChallenge(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+
+	s.pollen.strictChallenge = true
+	s.pollen.challengeLength = len(PorkChopSha512)
+	res, err := http.Get(s.URL + "?challenge=" + PorkChopSha512)
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusOK, "didn't get OK, got:", res.Status)
+	chal, seed, err := ReadResp(res.Body)
+	s.Assert(err == nil, "response error:", err)
+	s.SanityCheck(chal, seed)
+}
+
+// TestStrictChallengeRejected tests that strict mode rejects non-hex and short challenges
+func TestStrictChallengeRejected(t *testing.T) {
+	b := bytes.NewBufferString(DilbertRandom)
+	s := NewSuiteWithDev(t, b)
+	defer s.TearDown()
+
+	s.pollen.strictChallenge = true
+	s.pollen.challengeLength = len(PorkChopSha512)
+	for _, challenge := range []string{"pork+chop+sandwiches", PorkChopSha512[:64], "z" + PorkChopSha512[1:]} {
+		res, err := http.Get(s.URL + "?challenge=" + challenge)
+		s.Assert(err == nil, "http client error:", err)
+		res.Body.Close()
+		s.Assert(res.StatusCode == http.StatusBadRequest, "didn't get Bad Request for", challenge, "got:", res.Status)
+	}
+	s.Assert(b.Len() == len(DilbertRandom), "random device was used for a rejected challenge")
+}
+
+// TestReadChunks asserts that chunked reads mix the same bytes into the same seed
+func TestReadChunks(t *testing.T) {
+	expectedSeed := fmt.Sprintf("%x", cannedSeed())
+	for _, chunks := range []int{1, 2, 3, 7, 64, 100} {
+		b := bytes.NewBufferString(DilbertRandom)
+		s := NewSuiteWithDev(t, b)
+		s.pollen.readChunks = chunks
+		res, err := http.Get(s.URL + "?challenge=pork+chop+sandwiches")
+		s.Assert(err == nil, "http client error:", err)
+		chal, seed, err := ReadResp(res.Body)
+		res.Body.Close()
+		s.Assert(err == nil, "response error:", err)
+		s.Assert(chal == PorkChopSha512, "expected:", PorkChopSha512, "got:", chal)
+		s.Assert(seed == expectedSeed, chunks, "chunks expected:", expectedSeed, "got:", seed)
+		s.Assert(b.Len() == 64, "wrong number of bytes remaining, expected 64 got:", b.Len())
+		s.TearDown()
+	}
+}
+
+// DelayedReader serves its bytes after a delay
+type DelayedReader struct {
+	*bytes.Buffer
+	delay time.Duration
+}
+
+func (d *DelayedReader) Read(p []byte) (int, error) {
+	time.Sleep(d.delay)
+	return d.Buffer.Read(p)
+}
+
+// TestMixSources asserts that sources are mixed in order, whichever read finishes first
+func TestMixSources(t *testing.T) {
+	other := strings.Repeat("8", 64)
+	checksum := sha512.New()
+	io.WriteString(checksum, "pork chop sandwiches")
+	io.WriteString(checksum, DilbertRandom)
+	io.WriteString(checksum, other)
+	expectedSeed := fmt.Sprintf("%x", checksum.Sum(nil))
+	for _, delay := range []time.Duration{0, 20 * time.Millisecond} {
+		s := NewSuiteWithDev(t, &DelayedReader{bytes.NewBufferString(DilbertRandom), delay})
+		s.pollen.mixSources = []io.Reader{&DelayedReader{bytes.NewBufferString(other), 20*time.Millisecond - delay}}
+		s.pollen.readWorkers = 2
+		res, err := http.Get(s.URL + "?challenge=pork+chop+sandwiches")
+		s.Assert(err == nil, "http client error:", err)
+		_, seed, err := ReadResp(res.Body)
+		res.Body.Close()
+		s.Assert(err == nil, "response error:", err)
+		s.Assert(seed == expectedSeed, "expected:", expectedSeed, "got:", seed)
+		s.TearDown()
+	}
+}
+
+// TestBodyChecksum asserts the X-Body-SHA256 header matches the received body
+func TestBodyChecksum(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+
+	s.pollen.bodyChecksum = true
+	res, err := http.Get(s.URL + "?challenge=xxx")
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	s.Assert(err == nil, "response error:", err)
+	expected := fmt.Sprintf("%x", sha256.Sum256(body))
+	s.Assert(res.Header.Get("X-Body-SHA256") == expected, "expected:", expected, "got:", res.Header.Get("X-Body-SHA256"))
+}
+
+// TestResponseMAC tests that X-Pollen-MAC is the HMAC of the body under the
+// shared key
+func TestResponseMAC(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+
+	s.pollen.responseMACKey = []byte("pork chop sandwiches")
+	res, err := http.Get(s.URL + "?challenge=xxx")
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	s.Assert(err == nil, "response error:", err)
+	mac := hmac.New(sha256.New, []byte("pork chop sandwiches"))
+	mac.Write(body)
+	expected := fmt.Sprintf("%x", mac.Sum(nil))
+	s.Assert(res.Header.Get("X-Pollen-MAC") == expected, "expected:", expected, "got:", res.Header.Get("X-Pollen-MAC"))
+}
+
+// TestTLSLogged asserts the negotiated TLS version and cipher are logged
+func TestTLSLogged(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+	server := httptest.NewTLSServer(s.pollen.mux())
+	defer server.Close()
+
+	res, err := server.Client().Get(server.URL + "?challenge=xxx")
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	_, _, err = ReadResp(res.Body)
+	s.Assert(err == nil, "response error:", err)
+	version := fmt.Sprintf("tls_version=%q tls_cipher=", tls.VersionName(res.TLS.Version))
+	s.Assert(strings.Contains(s.logger.logs[0].message, version), "expected", version, "got:", s.logger.logs[0])
+}
+
+// TestClientIP asserts the logs use a custom client address extractor
+func TestClientIP(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+	s.pollen.ClientIP = func(r *http.Request) string {
+		return "client-" + r.Header.Get("X-Test-Client")
+	}
+
+	req, err := http.NewRequest("GET", s.URL+"?challenge=xxx", nil)
+	s.Assert(err == nil, "request error:", err)
+	req.Header.Set("X-Test-Client", "42")
+	res, err := http.DefaultClient.Do(req)
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	_, _, err = ReadResp(res.Body)
+	s.Assert(err == nil, "response error:", err)
+	for _, log := range s.logger.logs {
+		s.Assert(strings.Contains(log.message, "remote_addr=client-42 "), "expected the extracted address, got:", log)
+	}
+}
+
+// TestHeaderClientIP asserts the address is taken from the last proxy's header
+func TestHeaderClientIP(t *testing.T) {
+	req := httptest.NewRequest("GET", "/?challenge=xxx", nil)
+	extract := headerClientIP("X-Forwarded-For")
+	if addr := extract(req); addr != req.RemoteAddr {
+		t.Error("expected the connection's address without the header, got:", addr)
+	}
+	req.Header.Add("X-Forwarded-For", "198.51.100.7, 203.0.113.9")
+	if addr := extract(req); addr != "203.0.113.9" {
+		t.Error("expected the last address, got:", addr)
+	}
+}
+
+// TestHTTP10ContentLength asserts HTTP/1.0 clients are sent a Content-Length
+func TestHTTP10ContentLength(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	s.Assert(err == nil, "dial error:", err)
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /?challenge=pork+chop+sandwiches HTTP/1.0\r\n\r\n")
+	req := &http.Request{Method: "GET"}
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	s.Assert(err == nil, "response error:", err)
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	s.Assert(err == nil, "read error:", err)
+	length := res.Header.Get("Content-Length")
+	s.Assert(length == strconv.Itoa(len(body)), "expected a Content-Length of", len(body), "got:", length)
+	s.Assert(len(res.TransferEncoding) == 0, "expected no transfer encoding, got:", res.TransferEncoding)
+}
+
+// TestNoBodyChecksum asserts the X-Body-SHA256 header is opt-in
+func TestNoBodyChecksum(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+
+	res, err := http.Get(s.URL + "?challenge=xxx")
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	s.Assert(res.Header.Get("X-Body-SHA256") == "", "unexpected checksum:", res.Header.Get("X-Body-SHA256"))
+}
+
+// TestChallengePrefix tests that a required prefix is removed before hashing
+func TestChallengePrefix(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+
+	s.pollen.challengePrefix = "tenant1:"
+	res, err := http.Get(s.URL + "?challenge=tenant1:pork+chop+sandwiches")
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	chal, seed, err := ReadResp(res.Body)
+	s.Assert(err == nil, "response error:", err)
+	s.Assert(chal == PorkChopSha512, "expected:", PorkChopSha512, "got:", chal)
+	s.SanityCheck(chal, seed)
+}
+
+// TestHashedChallengePrefix tests that a required prefix may be hashed with the challenge
+func TestHashedChallengePrefix(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+
+	s.pollen.challengePrefix = "tenant1:"
+	s.pollen.hashChallengePrefix = true
+	res, err := http.Get(s.URL + "?challenge=tenant1:pork+chop+sandwiches")
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	chal, _, err := ReadResp(res.Body)
+	s.Assert(err == nil, "response error:", err)
+	expected := fmt.Sprintf("%x", sha512.Sum512([]byte("tenant1:pork chop sandwiches")))
+	s.Assert(chal == expected, "expected:", expected, "got:", chal)
+}
+
+// TestWrongChallengePrefix tests that challenges without the required prefix are rejected
+func TestWrongChallengePrefix(t *testing.T) {
+	b := bytes.NewBufferString(DilbertRandom)
+	s := NewSuiteWithDev(t, b)
+	defer s.TearDown()
+
+	s.pollen.challengePrefix = "tenant1:"
+	for _, challenge := range []string{"pork+chop+sandwiches", "tenant2:pork+chop+sandwiches"} {
+		res, err := http.Get(s.URL + "?challenge=" + challenge)
+		s.Assert(err == nil, "http client error:", err)
+		res.Body.Close()
+		s.Assert(res.StatusCode == http.StatusBadRequest, "didn't get Bad Request for", challenge, "got:", res.Status)
+	}
+	s.Assert(b.Len() == len(DilbertRandom), "random device was used for a rejected challenge")
+}
+
+// TestParseFacility tests parsing the -syslog-facility names
+func TestParseFacility(t *testing.T) {
+	for name, expected := range map[string]syslog.Priority{
+		"kern":   syslog.LOG_KERN,
+		"daemon": syslog.LOG_DAEMON,
+		"LOCAL3": syslog.LOG_LOCAL3,
+	} {
+		facility, err := parseFacility(name)
+		if err != nil || facility != expected {
+			t.Error("expected", name, "to be", expected, "got:", facility, err)
+		}
+	}
+	for _, name := range []string{"", "local8", "err"} {
+		if _, err := parseFacility(name); err == nil {
+			t.Error("expected an error for", name)
+		}
+	}
+}
+
+// Verify posts the challenge and expected challenge response to /verify
+func (s *Suite) Verify(challenge, expected string) (int, string) {
+	res, err := http.PostForm(s.URL+"/verify", url.Values{"challenge": {challenge}, "challenge_response": {expected}})
+	if err != nil {
+		s.t.Fatal("http client error:", err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	return res.StatusCode, string(body)
+}
+
+// TestVerifyMatch tests verifying a correct challenge response without using the device
+func TestVerifyMatch(t *testing.T) {
+	b := bytes.NewBufferString(DilbertRandom)
+	s := NewSuiteWithDev(t, b)
+	defer s.TearDown()
+
+	status, body := s.Verify("pork chop sandwiches", PorkChopSha512)
+	s.Assert(status == http.StatusOK, "didn't get OK, got:", status)
+	s.Assert(body == "match\n", "expected match, got:", body)
+	s.Assert(b.String() == DilbertRandom, "random device was used")
+}
+
+// TestVerifyMismatch tests verifying an incorrect challenge response
+func TestVerifyMismatch(t *testing.T) {
+	b := bytes.NewBufferString(DilbertRandom)
+	s := NewSuiteWithDev(t, b)
+	defer s.TearDown()
+
+	status, body := s.Verify("pork chop sandwich", PorkChopSha512)
+	s.Assert(status == http.StatusConflict, "didn't get Conflict, got:", status)
+	s.Assert(body == "mismatch\n", "expected mismatch, got:", body)
+	status, _ = s.Verify("pork chop sandwiches", "not hex")
+	s.Assert(status == http.StatusBadRequest, "didn't get Bad Request, got:", status)
+	s.Assert(b.String() == DilbertRandom, "random device was used")
+}
+
+// SentDuration requests a challenge and returns the duration logged for it
+func (s *Suite) SentDuration() (string, bool) {
+	res, err := http.Get(s.URL + "?challenge=xxx")
+	if err != nil {
+		s.t.Fatal("http client error:", err)
+	}
+	res.Body.Close()
+	last := s.logger.logs[len(s.logger.logs)-1].message
+	s.Assert(strings.HasPrefix(last, "Server sent response "), "expected the response log, got:", last)
+	for _, field := range strings.Fields(last) {
+		if strings.HasPrefix(field, "duration=") {
+			return strings.TrimPrefix(field, "duration="), true
+		}
+	}
+	return "", false
+}
+
+// TestLogDurationPrecision tests rounding and omitting the logged duration
+func TestLogDurationPrecision(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+
+	duration, ok := s.SentDuration()
+	s.Assert(ok, "expected a duration by default")
+	s.pollen.durationPrecision, _ = parseDurationPrecision("1s")
+	duration, ok = s.SentDuration()
+	s.Assert(ok && duration == "0", "expected the duration rounded to 0 seconds, got:", duration)
+	s.pollen.durationPrecision, _ = parseDurationPrecision("none")
+	duration, ok = s.SentDuration()
+	s.Assert(!ok, "expected no duration, got:", duration)
+	_, err := parseDurationPrecision("-1ms")
+	s.Assert(err != nil, "expected an invalid precision to fail")
+}
+
+// TestRequireUserAgent tests that only matching user agents are served under the requirement
+func TestRequireUserAgent(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+	s.pollen.userAgent = regexp.MustCompile("^pollinate/")
+
+	get := func(userAgent string) *http.Response {
+		req, _ := http.NewRequest("GET", s.URL+"?challenge=pork+chop+sandwiches", nil)
+		req.Header.Set("User-Agent", userAgent)
+		res, err := http.DefaultClient.Do(req)
+		s.Assert(err == nil, "http client error:", err)
+		return res
+	}
+	res := get("pollinate/4.33 curl/7.81.0")
+	defer res.Body.Close()
+	chal, seed, err := ReadResp(res.Body)
+	s.Assert(err == nil, "response error:", err)
+	s.Assert(chal == PorkChopSha512, "expected:", PorkChopSha512, "got:", chal)
+	s.SanityCheck(chal, seed)
+
+	res = get("Mozilla/5.0")
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	s.Assert(res.StatusCode == http.StatusBadRequest, "expected 400, got:", res.Status)
+	s.Assert(strings.HasPrefix(string(body), usePollinateError), "expected the pollinate guidance, got:", string(body))
+}
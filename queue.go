@@ -0,0 +1,87 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	errQueueFull    = errors.New("too many requests are waiting for the random device")
+	errQueueTimeout = errors.New("waited too long for the random device")
+)
+
+// requestQueue serializes reads of a slow random device, letting up to
+// depth requests wait their turn, first come first served, for at most
+// timeout each.
+type requestQueue struct {
+	waiting chan struct{}
+	device  chan struct{}
+	timeout time.Duration
+}
+
+func newRequestQueue(depth int, timeout time.Duration) *requestQueue {
+	return &requestQueue{waiting: make(chan struct{}, depth), device: make(chan struct{}, 1), timeout: timeout}
+}
+
+// acquire waits for the device, returning an error if the queue is full or
+// the wait times out, or ctx.Err() if ctx is done first
+func (q *requestQueue) acquire(ctx context.Context) error {
+	select {
+	case q.waiting <- struct{}{}:
+	default:
+		return errQueueFull
+	}
+	defer func() { <-q.waiting }()
+	timer := time.NewTimer(q.timeout)
+	defer timer.Stop()
+	/* Blocked senders are woken in the order they blocked */
+	select {
+	case q.device <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return errQueueTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release hands the device to the next request waiting
+func (q *requestQueue) release() {
+	<-q.device
+}
+
+// setRetryAfter asks a client refused for want of capacity to retry after
+// retryAfter, plus a random share of retryAfterJitter, so that clients
+// refused together do not all come back together.
+func (p *PollenServer) setRetryAfter(w http.ResponseWriter) {
+	seconds := int(math.Ceil(p.retryAfter.Seconds()))
+	if jitter := int(p.retryAfterJitter.Seconds()); jitter > 0 {
+		seconds += rand.Intn(jitter + 1)
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// GetStatus requests a challenge in the background, sending its status, or 0 on error
+func (s *Suite) GetStatus(statuses chan int) {
+	go func() {
+		res, err := http.Get(s.URL + "?challenge=xxx")
+		if err != nil {
+			statuses <- 0
+			return
+		}
+		ReadResp(res.Body)
+		res.Body.Close()
+		statuses <- res.StatusCode
+	}()
+}
+
+// WaitQueued waits until the device is held and n requests are waiting for it
+func (s *Suite) WaitQueued(n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for (len(s.pollen.queue.device) != 1 || len(s.pollen.queue.waiting) != n) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	s.Assert(len(s.pollen.queue.device) == 1 && len(s.pollen.queue.waiting) == n, "expected", n, "requests queued, got:", len(s.pollen.queue.waiting))
+}
+
+// TestQueueFull tests that requests beyond the queue depth are refused, and queued ones served
+func TestQueueFull(t *testing.T) {
+	source := NewBlockingReader()
+	s := NewSuiteWithDev(t, source)
+	defer s.TearDown()
+	s.pollen.queue = newRequestQueue(1, time.Minute)
+
+	statuses := make(chan int)
+	s.GetStatus(statuses)
+	s.WaitQueued(0)
+	s.GetStatus(statuses)
+	s.WaitQueued(1)
+	s.GetStatus(statuses)
+	status := <-statuses
+	s.Assert(status == http.StatusServiceUnavailable, "expected 503 beyond the queue depth, got:", status)
+	close(source.release)
+	for i := 0; i < 2; i++ {
+		status := <-statuses
+		s.Assert(status == http.StatusOK, "expected the queued requests to succeed, got:", status)
+	}
+}
+
+// TestQueueTimeout tests that requests waiting too long in the queue are refused
+func TestQueueTimeout(t *testing.T) {
+	source := NewBlockingReader()
+	s := NewSuiteWithDev(t, source)
+	defer s.TearDown()
+	defer close(source.release)
+	s.pollen.queue = newRequestQueue(1, 50*time.Millisecond)
+
+	statuses := make(chan int, 2)
+	s.GetStatus(statuses)
+	s.WaitQueued(0)
+	s.GetStatus(statuses)
+	status := <-statuses
+	s.Assert(status == http.StatusServiceUnavailable, "expected 503 after the queue timeout, got:", status)
+}
+
+// TestRetryAfterJitter tests that the Retry-After of refused requests
+// varies within -retry-after-jitter of -retry-after
+func TestRetryAfterJitter(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+	/* With no room to wait, every request is refused */
+	s.pollen.queue = newRequestQueue(0, time.Minute)
+	s.pollen.retryAfter = 2 * time.Second
+	s.pollen.retryAfterJitter = 5 * time.Second
+
+	seen := map[string]bool{}
+	for i := 0; i < 30; i++ {
+		res, err := http.Get(s.URL + "?challenge=xxx")
+		s.Assert(err == nil, "http client error:", err)
+		res.Body.Close()
+		s.Assert(res.StatusCode == http.StatusServiceUnavailable, "expected 503, got:", res.Status)
+		retry, err := strconv.Atoi(res.Header.Get("Retry-After"))
+		s.Assert(err == nil && retry >= 2 && retry <= 7, "expected a Retry-After from 2 to 7, got:", res.Header.Get("Retry-After"))
+		seen[res.Header.Get("Retry-After")] = true
+	}
+	s.Assert(len(seen) > 1, "expected the Retry-After to vary, got:", seen)
+}
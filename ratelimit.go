@@ -0,0 +1,131 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	rateLimit        = flag.Float64("rate-limit", 0, "The requests per second each client may make, by its address, or 0 for no limit")
+	rateLimitBurst   = flag.Int("rate-limit-burst", 10, "The requests a client may make at once, beyond -rate-limit")
+	rateLimitBackend = flag.String("ratelimit-backend", "memory", "Where the -rate-limit buckets are kept: memory, for each server alone, or redis, shared by a fleet")
+)
+
+// RateLimiter decides whether a client may make a request, spending one of
+// the tokens of its bucket, which refills at rate tokens a second up to
+// burst tokens.
+type RateLimiter interface {
+	Allow(key string, rate float64, burst int) (bool, error)
+}
+
+// rateLimiters open the -ratelimit-backend choices
+var rateLimiters = map[string]func() RateLimiter{
+	"memory": func() RateLimiter { return newMemoryLimiter() },
+	"redis":  func() RateLimiter { return newRedisLimiter(*redisAddr, *redisTimeout) },
+}
+
+// memoryLimiter keeps the buckets of one server, forgetting the least
+// recently used beyond maxMemoryBuckets, so that a scan from many addresses
+// costs no more than any other request.
+type memoryLimiter struct {
+	mu      sync.Mutex
+	buckets *lru
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// maxMemoryBuckets is the number of buckets kept; the one forgotten to make
+// room has been idle longest, so is the likeliest to be full anyway
+const maxMemoryBuckets = 65536
+
+func newMemoryLimiter() *memoryLimiter {
+	return &memoryLimiter{buckets: newLRU(maxMemoryBuckets)}
+}
+
+func (m *memoryLimiter) Allow(key string, rate float64, burst int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	b := m.buckets.fetch(key, func() interface{} {
+		return &tokenBucket{tokens: float64(burst), last: now}
+	}).(*tokenBucket)
+	b.tokens = min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, nil
+	}
+	b.tokens--
+	return true, nil
+}
+
+// errRateLimited refuses a client beyond its rateLimit
+var errRateLimited = errors.New("Too many requests, please try again later")
+
+// limiting reports whether clients are rate limited at all
+func (p *PollenServer) limiting() bool {
+	return p.RateLimiter != nil && p.rateLimit > 0
+}
+
+// overRateLimit reports whether a client, by its address, is beyond its
+// rateLimit.  Should the limiter fail, it is not, since refusing it would
+// take the whole fleet down with the limiter.
+func (p *PollenServer) overRateLimit(clientAddr string) bool {
+	if !p.limiting() {
+		return false
+	}
+	host, _, err := net.SplitHostPort(clientAddr)
+	if err != nil {
+		host = clientAddr
+	}
+	allowed, err := p.RateLimiter.Allow(host, p.rateLimit, p.rateLimitBurst)
+	if err != nil {
+		p.log.ErrKV("Cannot check rate limit", "remote_addr", clientAddr, "error", err, "at", time.Now().UnixNano())
+		return false
+	}
+	return !allowed
+}
+
+// limitRate refuses clients beyond their rateLimit with 429 Too Many
+// Requests, by their address as ClientIP extracts it.  /ready is never
+// limited, for the load balancers.
+func (p *PollenServer) limitRate(h http.Handler) http.Handler {
+	if !p.limiting() {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ready" && p.overRateLimit(p.clientIP(r)) {
+			p.log.InfoKV("Client over rate limit", "remote_addr", p.clientIP(r), "user_agent", r.UserAgent(), "path", r.URL.Path, "at", time.Now().UnixNano())
+			p.setRetryAfter(w)
+			http.Error(w, errRateLimited.Error(), http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis answers the rate limit script, as Redis would, from buckets of
+// its own, refusing EVALSHA until it has seen the script by EVAL
+type fakeRedis struct {
+	net.Listener
+	buckets *memoryLimiter
+	mu      sync.Mutex
+	scripts map[string]bool
+	conns   int
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("cannot listen:", err)
+	}
+	f := &fakeRedis{Listener: ln, buckets: newMemoryLimiter(), scripts: map[string]bool{}}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns++
+			f.mu.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+// serve answers the commands of one connection in turn; as they are only
+// EVAL and EVALSHA, each is of the script, 1, the key, the rate and burst
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		var n int
+		if _, err := fmt.Fscanf(r, "*%d\r\n", &n); err != nil {
+			return
+		}
+		args := make([]string, n)
+		for i := range args {
+			var size int
+			if _, err := fmt.Fscanf(r, "$%d\r\n", &size); err != nil {
+				return
+			}
+			arg := make([]byte, size+2)
+			if _, err := io.ReadFull(r, arg); err != nil {
+				return
+			}
+			args[i] = string(arg[:size])
+		}
+		f.mu.Lock()
+		if args[0] == "EVAL" {
+			f.scripts[tokenBucketSHA] = true
+		}
+		known := f.scripts[args[1]] || args[0] == "EVAL"
+		f.mu.Unlock()
+		if !known {
+			io.WriteString(conn, "-NOSCRIPT No matching script.\r\n")
+			continue
+		}
+		rate, _ := strconv.ParseFloat(args[4], 64)
+		burst, _ := strconv.Atoi(args[5])
+		allowed, _ := f.buckets.Allow(args[3], rate, burst)
+		if allowed {
+			io.WriteString(conn, ":1\r\n")
+		} else {
+			io.WriteString(conn, ":0\r\n")
+		}
+	}
+}
+
+// TestSharedRateLimit tests that two servers sharing a Redis backend
+// enforce a client's limit between them
+func TestSharedRateLimit(t *testing.T) {
+	redis := newFakeRedis(t)
+	defer redis.Close()
+	var suites []*Suite
+	for i := 0; i < 2; i++ {
+		s := NewSuiteWithDev(t, &counterSource{})
+		defer s.TearDown()
+		s.pollen.RateLimiter = newRedisLimiter(redis.Addr().String(), *redisTimeout)
+		s.pollen.rateLimit = 0.001
+		s.pollen.rateLimitBurst = 3
+		s.Config.Handler = s.pollen.mux()
+		suites = append(suites, s)
+	}
+
+	var statuses []int
+	for i := 0; i < 4; i++ {
+		res, err := http.Get(suites[i%2].URL + "?challenge=xxx")
+		suites[0].Assert(err == nil, "http client error:", err)
+		res.Body.Close()
+		statuses = append(statuses, res.StatusCode)
+	}
+	suites[0].Assert(fmt.Sprint(statuses) == "[200 200 200 429]", "expected the burst shared between the servers, got:", statuses)
+	suites[0].Assert(!strings.Contains(fmt.Sprint(suites[0].logger.Logs()), "Cannot check rate limit"), "unexpected limiter failure:", suites[0].logger.Logs())
+
+	res, err := http.Get(suites[1].URL + "/ready")
+	suites[0].Assert(err == nil, "http client error:", err)
+	res.Body.Close()
+	suites[0].Assert(res.StatusCode == http.StatusOK, "expected /ready never to be limited, got:", res.Status)
+}
+
+// TestRedisLimiterPool tests that concurrent checks share a bounded pool of
+// connections to Redis
+func TestRedisLimiterPool(t *testing.T) {
+	redis := newFakeRedis(t)
+	defer redis.Close()
+	limiter := newRedisLimiter(redis.Addr().String(), time.Second)
+	var wg sync.WaitGroup
+	errs := make(chan error, 4*redisPoolSize)
+	for i := 0; i < 4*redisPoolSize; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := limiter.Allow(strconv.Itoa(i), 1, 1); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error("unexpected limiter failure:", err)
+	}
+	redis.mu.Lock()
+	defer redis.mu.Unlock()
+	if redis.conns < 1 || redis.conns > redisPoolSize {
+		t.Error("expected from 1 to", redisPoolSize, "connections, got:", redis.conns)
+	}
+}
+
+// TestRedisLimiterRedial tests that checks fail at once while a failed dial
+// waits to be tried again, rather than each dialing a Redis that is down
+func TestRedisLimiterRedial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("cannot listen:", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	limiter := newRedisLimiter(addr, 100*time.Millisecond)
+	if _, err := limiter.Allow("client", 1, 1); err == nil || err == errRedisBackoff {
+		t.Fatal("expected a dial error, got:", err)
+	}
+	if _, err := limiter.Allow("client", 1, 1); err != errRedisBackoff {
+		t.Error("expected the redial to wait, got:", err)
+	}
+	if limiter.redialDelay != limiter.timeout {
+		t.Error("expected the first delay to be the timeout, got:", limiter.redialDelay)
+	}
+}
+
+// TestMemoryLimiterForgets tests that the least recently used bucket is
+// forgotten beyond maxMemoryBuckets
+func TestMemoryLimiterForgets(t *testing.T) {
+	limiter := newMemoryLimiter()
+	limiter.Allow("first", 0.001, 1)
+	for i := 0; i < maxMemoryBuckets; i++ {
+		limiter.Allow(strconv.Itoa(i), 0.001, 1)
+	}
+	if len(limiter.buckets.items) != maxMemoryBuckets || limiter.buckets.order.Len() != maxMemoryBuckets {
+		t.Fatal("expected", maxMemoryBuckets, "buckets, got:", len(limiter.buckets.items), limiter.buckets.order.Len())
+	}
+	if allowed, _ := limiter.Allow("first", 0.001, 1); !allowed {
+		t.Error("expected the oldest bucket forgotten, and refilled")
+	}
+	if allowed, _ := limiter.Allow(strconv.Itoa(maxMemoryBuckets-1), 0.001, 1); allowed {
+		t.Error("expected a recent bucket kept, and empty")
+	}
+}
+
+// TestRateLimitOtherProtocols tests that pollen/1 and DNS clients share the
+// limit of HTTP clients, and that a limited pollen/1 client may try again
+func TestRateLimitOtherProtocols(t *testing.T) {
+	s := NewSuiteWithDev(t, &counterSource{})
+	defer s.TearDown()
+	s.pollen.RateLimiter = newMemoryLimiter()
+	s.pollen.rateLimit = 0.001
+	s.pollen.rateLimitBurst = 1
+	server := httptest.NewUnstartedServer(s.pollen.mux())
+	s.pollen.configureALPN(server.Config)
+	server.TLS = newTLSConfig(false)
+	server.StartTLS()
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "example.com", NextProtos: []string{pollenProto}})
+	if err != nil {
+		t.Fatal("tls error:", err)
+	}
+	defer conn.Close()
+	var statuses []byte
+	for i := 0; i < 3; i++ {
+		_, err = conn.Write(appendFrame(nil, []byte("pork chop sandwiches")))
+		s.Assert(err == nil, "write error:", err)
+		status := make([]byte, 1)
+		_, err = conn.Read(status)
+		s.Assert(err == nil, "read error:", err)
+		_, err = readFrame(conn)
+		s.Assert(err == nil, "read error:", err)
+		if status[0] == pollenProtoOK {
+			_, err = readFrame(conn)
+			s.Assert(err == nil, "read error:", err)
+		}
+		statuses = append(statuses, status[0])
+	}
+	s.Assert(statuses[0] == pollenProtoOK && statuses[1] == pollenProtoError && statuses[2] == pollenProtoError, "expected one challenge answered, got:", statuses)
+
+	name := strings.ToLower(dnsChallengeEncoding.EncodeToString([]byte("pork chop sandwiches"))) + ".entropy.pollen"
+	query := DNSQuery(7, name)
+	resp, err := s.pollen.answerDNS(context.Background(), query, "entropy.pollen", "127.0.0.1:5353")
+	s.Assert(err == nil, "answer error:", err)
+	rcode, _ := DNSTXT(t, query, resp)
+	s.Assert(rcode == dnsRcodeRefused, "expected REFUSED, got:", rcode)
+	s.Assert(strings.Contains(fmt.Sprint(s.logger.Logs()), "Client over rate limit"), "expected the refusal logged:", s.logger.Logs())
+}
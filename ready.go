@@ -0,0 +1,153 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// waitForEntropy holds the server out of readiness until count reports at
+// least min bits of kernel entropy, polling every interval, or until
+// timeout passes.
+func (p *PollenServer) waitForEntropy(count func() (int, error), min int, interval, timeout time.Duration) {
+	p.awaitingEntropy.Store(true)
+	defer p.awaitingEntropy.Store(false)
+	deadline := time.Now().Add(timeout)
+	for {
+		bits, err := count()
+		if err != nil {
+			p.log.ErrKV("Cannot count kernel entropy, not waiting for it", "error", err, "at", time.Now().UnixNano())
+			return
+		}
+		if bits >= min {
+			p.log.InfoKV("Kernel entropy reached", "entropy_avail", bits, "at", time.Now().UnixNano())
+			return
+		}
+		if time.Now().After(deadline) {
+			p.log.ErrKV("Kernel entropy still below the minimum, serving anyway", "entropy_avail", bits, "min_boot_entropy", min, "waited", timeout, "at", time.Now().UnixNano())
+			return
+		}
+		time.Sleep(interval)
+	}
+}
+
+// serveReady reports whether the server should be sent traffic
+func (p *PollenServer) serveReady(w http.ResponseWriter, r *http.Request) {
+	if p.awaitingEntropy.Load() {
+		http.Error(w, "waiting for kernel entropy", http.StatusServiceUnavailable)
+		return
+	}
+	if p.draining.Load() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	if p.stuckSource.Load() {
+		http.Error(w, "the random device is stuck", http.StatusServiceUnavailable)
+		return
+	}
+	if p.failingQuality.Load() {
+		http.Error(w, "the random device is failing its quality checks", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ready")
+}
+
+// healthCheckTimeout bounds the read of the device by the JSON /health
+const healthCheckTimeout = time.Second
+
+// healthCheck is one sub-check of the JSON /health.  Only a failing
+// critical check fails the whole.
+type healthCheck struct {
+	Name     string `json:"name"`
+	Critical bool   `json:"critical"`
+	OK       bool   `json:"ok"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+// serveHealth reports that the server is alive, or, to a request for JSON,
+// the result of each of its sub-checks, which may fail only once the
+// startup grace period is over
+func (p *PollenServer) serveHealth(w http.ResponseWriter, r *http.Request) {
+	if negotiateFormat(r).name != jsonFormat.name {
+		fmt.Fprintln(w, "ok")
+		return
+	}
+	checks := []healthCheck{p.checkDevice(r.Context()), p.checkEntropy(), p.checkListeners()}
+	status := "ok"
+	for _, check := range checks {
+		if check.Critical && !check.OK {
+			status = "failing"
+		}
+	}
+	if status != "ok" && time.Now().Before(p.graceUntil) {
+		/* A slow start is not yet a reason to be restarted */
+		status = "starting"
+	}
+	w.Header().Set("Content-Type", jsonFormat.contentType)
+	if status == "failing" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(struct {
+		Status string        `json:"status"`
+		Checks []healthCheck `json:"checks"`
+	}{status, checks})
+}
+
+// checkDevice reads a little from the device, as a request would
+func (p *PollenServer) checkDevice(ctx context.Context) healthCheck {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	check := healthCheck{Name: "device", Critical: true, OK: true}
+	/* A timed out read may yet fill the sample, so it is never pooled */
+	if err := readFullContext(ctx, p.randomSource, make([]byte, 16)); err != nil {
+		check.OK = false
+		check.Detail = err.Error()
+	}
+	return check
+}
+
+// checkEntropy compares the kernel's entropy to -health-min-entropy.  Where
+// the kernel's entropy cannot be counted, it passes, so it is not critical.
+func (p *PollenServer) checkEntropy() healthCheck {
+	check := healthCheck{Name: "entropy", OK: true}
+	bits, err := kernelEntropy()
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	check.OK = bits >= p.healthMinEntropy
+	check.Detail = fmt.Sprintf("%d bits", bits)
+	return check
+}
+
+// checkListeners fails while any listener is waiting to be restarted
+func (p *PollenServer) checkListeners() healthCheck {
+	check := healthCheck{Name: "listeners", Critical: true, OK: true}
+	if restarting := p.restartingListeners.Load(); restarting > 0 {
+		check.OK = false
+		check.Detail = fmt.Sprintf("%d restarting", restarting)
+	}
+	return check
+}
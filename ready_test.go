@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// ReadyStatus fetches the status of /ready
+func (s *Suite) ReadyStatus() int {
+	res, err := http.Get(s.URL + "/ready")
+	if err != nil {
+		s.t.Fatal("http client error:", err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+// TestReadyAfterEntropy tests that /ready waits for kernel entropy to pass the threshold
+func TestReadyAfterEntropy(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+
+	s.Assert(s.ReadyStatus() == http.StatusOK, "expected ready without a boot entropy gate")
+	counts := make(chan int)
+	count := func() (int, error) {
+		return <-counts, nil
+	}
+	s.pollen.awaitingEntropy.Store(true)
+	done := make(chan bool)
+	go func() {
+		s.pollen.waitForEntropy(count, 256, time.Millisecond, time.Minute)
+		done <- true
+	}()
+	counts <- 64
+	s.Assert(s.ReadyStatus() == http.StatusServiceUnavailable, "expected not ready at 64 bits")
+	counts <- 128
+	s.Assert(s.ReadyStatus() == http.StatusServiceUnavailable, "expected not ready at 128 bits")
+	counts <- 300
+	<-done
+	s.Assert(s.ReadyStatus() == http.StatusOK, "expected ready at 300 bits")
+}
+
+// TestReadyEntropyTimeout tests that /ready gives up waiting for kernel entropy
+func TestReadyEntropyTimeout(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+
+	count := func() (int, error) {
+		return 0, nil
+	}
+	s.pollen.waitForEntropy(count, 256, time.Millisecond, 10*time.Millisecond)
+	s.Assert(s.ReadyStatus() == http.StatusOK, "expected ready after the timeout")
+	s.Assert(len(s.logger.logs) == 1 && s.logger.logs[0].severity == "err", "expected the timeout logged, got:", s.logger.logs)
+}
+
+// TestMonitoringListener tests that the operational endpoints move to the monitoring mux
+func TestMonitoringListener(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+
+	service := httptest.NewServer(s.pollen.serviceMux(false))
+	defer service.Close()
+	monitoring := httptest.NewServer(s.pollen.monitoringMux())
+	defer monitoring.Close()
+	for _, path := range []string{"/metrics", "/stats", "/health", "/ready"} {
+		res, err := http.Get(monitoring.URL + path)
+		s.Assert(err == nil, "http client error:", err)
+		res.Body.Close()
+		s.Assert(res.StatusCode == http.StatusOK, path, "didn't get OK on the monitoring listener, got:", res.Status)
+	}
+	for _, path := range []string{"/metrics", "/stats", "/health", "/admin/reseed"} {
+		res, err := http.Get(service.URL + path + "?challenge=xxx")
+		s.Assert(err == nil, "http client error:", err)
+		res.Body.Close()
+		s.Assert(res.StatusCode == http.StatusNotFound, path, "didn't get Not Found on the service listener, got:", res.Status)
+	}
+	res, err := http.Get(service.URL + "?challenge=xxx")
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	chal, seed, err := ReadResp(res.Body)
+	s.Assert(err == nil, "response error:", err)
+	s.SanityCheck(chal, seed)
+}
+
+// TestHealthJSON tests the sub-checks of the JSON /health, and that a
+// failing device fails the whole
+func TestHealthJSON(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+
+	get := func() (int, string, map[string]healthCheck) {
+		req, _ := http.NewRequest("GET", s.URL+"/health", nil)
+		req.Header.Set("Accept", "application/json")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("http client error:", err)
+		}
+		defer res.Body.Close()
+		var body struct {
+			Status string
+			Checks []healthCheck
+		}
+		if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+			t.Fatal("cannot decode health:", err)
+		}
+		checks := map[string]healthCheck{}
+		for _, check := range body.Checks {
+			checks[check.Name] = check
+		}
+		return res.StatusCode, body.Status, checks
+	}
+
+	code, status, checks := get()
+	s.Assert(code == http.StatusOK && status == "ok", "expected healthy, got:", code, status)
+	for _, name := range []string{"device", "entropy", "listeners"} {
+		s.Assert(checks[name].OK, "expected the", name, "check to pass, got:", checks[name])
+	}
+	s.Assert(checks["device"].Critical && !checks["entropy"].Critical, "unexpected criticality:", checks)
+
+	s.pollen.randomSource = &FailingReader{}
+	code, status, checks = get()
+	s.Assert(code == http.StatusServiceUnavailable && status == "failing", "expected 503 with a failing device, got:", code, status)
+	s.Assert(!checks["device"].OK && checks["device"].Detail != "", "expected the device check to fail, got:", checks["device"])
+
+	res, err := http.Get(s.URL + "/health")
+	s.Assert(err == nil, "http client error:", err)
+	res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusOK, "expected the plain /health to report alive, got:", res.Status)
+}
+
+// TestStartupGrace tests that the JSON /health stays healthy while the
+// device is unavailable during the startup grace period, and not after it
+func TestStartupGrace(t *testing.T) {
+	s := NewSuiteWithDev(t, &FailingReader{})
+	defer s.TearDown()
+	s.pollen.graceUntil = time.Now().Add(500 * time.Millisecond)
+
+	get := func() (int, string) {
+		req, _ := http.NewRequest("GET", s.URL+"/health", nil)
+		req.Header.Set("Accept", "application/json")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("http client error:", err)
+		}
+		defer res.Body.Close()
+		var body struct{ Status string }
+		if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+			t.Fatal("cannot decode health:", err)
+		}
+		return res.StatusCode, body.Status
+	}
+
+	code, status := get()
+	s.Assert(code == http.StatusOK && status == "starting", "expected healthy during the grace period, got:", code, status)
+	time.Sleep(time.Until(s.pollen.graceUntil))
+	code, status = get()
+	s.Assert(code == http.StatusServiceUnavailable && status == "failing", "expected 503 after the grace period, got:", code, status)
+}
+
+// TestPprof tests that the profiles are served on the private listener
+// only when enabled, and never on the service listener
+func TestPprof(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+
+	status := func(h http.Handler) int {
+		server := httptest.NewServer(h)
+		defer server.Close()
+		res, err := http.Get(server.URL + "/debug/pprof/")
+		if err != nil {
+			t.Fatal("http client error:", err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	s.Assert(status(s.pollen.privateMux()) == http.StatusNotFound, "expected no pprof unless enabled")
+	s.pollen.pprof = true
+	s.Assert(status(s.pollen.privateMux()) == http.StatusOK, "expected pprof on the private listener")
+	s.Assert(status(s.pollen.mux()) == http.StatusNotFound, "expected no pprof on the service listener")
+	s.Assert(status(s.pollen.serviceMux(false)) == http.StatusNotFound, "expected no pprof on the service listener")
+}
@@ -0,0 +1,225 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	redisAddr    = flag.String("redis-addr", "127.0.0.1:6379", "The host:port of the Redis server keeping the -ratelimit-backend redis buckets")
+	redisTimeout = flag.Duration("redis-timeout", 100*time.Millisecond, "The longest a rate limit check may wait for Redis")
+)
+
+// tokenBucketScript spends a token of the bucket at KEYS[1], refilled at
+// ARGV[1] tokens a second up to ARGV[2], returning 1 if there was one.  The
+// script runs atomically, on Redis' clock, so every server of a fleet sees
+// the same buckets.
+const tokenBucketScript = `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) + tonumber(time[2]) / 1000000
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(bucket[1]) or burst
+local last = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - last) * rate)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'last', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return allowed
+`
+
+var tokenBucketSHA = func() string {
+	sum := sha1.Sum([]byte(tokenBucketScript))
+	return hex.EncodeToString(sum[:])
+}()
+
+// redisKeyPrefix keeps pollen's buckets apart from other keys
+const redisKeyPrefix = "pollen:ratelimit:"
+
+// redisPoolSize is the most connections a redisLimiter opens at once, and
+// keeps open between checks
+const redisPoolSize = 8
+
+// maxRedisRedialDelay bounds the wait after a failed dial before the next,
+// which doubles with each failure in a row
+const maxRedisRedialDelay = 5 * time.Second
+
+// errRedisBackoff fails checks while a redial waits out its delay, rather
+// than each waiting out a dial of a Redis that is down
+var errRedisBackoff = errors.New("redis: waiting to redial")
+
+// errRedisPoolFull fails a check that found every connection in use for
+// the whole of its timeout
+var errRedisPoolFull = errors.New("redis: every connection is busy")
+
+// redisLimiter keeps the buckets in Redis, shared by a fleet, over a pool
+// of up to redisPoolSize connections, so that checks of concurrent requests
+// do not wait on one another.  A connection that fails is closed, and
+// redialed when next needed, backing off while dials fail.
+type redisLimiter struct {
+	addr    string
+	timeout time.Duration
+	// slots holds a token for each connection that may be open
+	slots chan struct{}
+	// idle holds the open connections not in use
+	idle chan *redisConn
+	mu   sync.Mutex
+	// redialAt is when the next dial may be tried, after redialDelay
+	redialAt    time.Time
+	redialDelay time.Duration
+}
+
+// redisConn is a connection to Redis, with its buffered replies
+type redisConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func newRedisLimiter(addr string, timeout time.Duration) *redisLimiter {
+	return &redisLimiter{addr: addr, timeout: timeout, slots: make(chan struct{}, redisPoolSize), idle: make(chan *redisConn, redisPoolSize)}
+}
+
+func (l *redisLimiter) Allow(key string, rate float64, burst int) (bool, error) {
+	conn, err := l.get()
+	if err != nil {
+		return false, err
+	}
+	args := []string{tokenBucketSHA, "1", redisKeyPrefix + key, strconv.FormatFloat(rate, 'g', -1, 64), strconv.Itoa(burst)}
+	reply, err := conn.do(l.timeout, append([]string{"EVALSHA"}, args...)...)
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		/* Redis has not seen the script since it started, so it is sent whole */
+		args[0] = tokenBucketScript
+		reply, err = conn.do(l.timeout, append([]string{"EVAL"}, args...)...)
+	}
+	l.put(conn, err)
+	if err != nil {
+		return false, err
+	}
+	return reply == 1, nil
+}
+
+// get takes an idle connection, or dials a new one if fewer than
+// redisPoolSize are open, waiting up to timeout for one to be put back
+func (l *redisLimiter) get() (*redisConn, error) {
+	select {
+	case conn := <-l.idle:
+		return conn, nil
+	default:
+	}
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case conn := <-l.idle:
+		return conn, nil
+	case l.slots <- struct{}{}:
+	case <-timer.C:
+		return nil, errRedisPoolFull
+	}
+	conn, err := l.dial()
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dial opens a connection, unless the last dial failed too recently
+func (l *redisLimiter) dial() (*redisConn, error) {
+	l.mu.Lock()
+	if time.Now().Before(l.redialAt) {
+		l.mu.Unlock()
+		return nil, errRedisBackoff
+	}
+	l.mu.Unlock()
+	conn, err := net.DialTimeout("tcp", l.addr, l.timeout)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err != nil {
+		l.redialDelay = min(max(2*l.redialDelay, l.timeout), maxRedisRedialDelay)
+		l.redialAt = time.Now().Add(l.redialDelay)
+		return nil, err
+	}
+	l.redialDelay = 0
+	return &redisConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// put returns a connection to the pool, unless err means it failed with
+// anything but an error reply, which leaves it usable, when it is closed, so
+// that the next command does not read this one's reply.
+func (l *redisLimiter) put(conn *redisConn, err error) {
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		conn.Close()
+		<-l.slots
+		return
+	}
+	l.idle <- conn
+}
+
+// redisError is an error reply, which leaves the connection usable
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// do sends a command and reads its integer reply, within timeout
+func (c *redisConn) do(timeout time.Duration, args ...string) (int64, error) {
+	c.SetDeadline(time.Now().Add(timeout))
+	command := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		command += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.Write([]byte(command)); err != nil {
+		return 0, err
+	}
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return 0, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '-':
+		return 0, redisError(line[1:])
+	}
+	return 0, fmt.Errorf("redis: unexpected reply %q", line)
+}
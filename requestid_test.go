@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestRequestID tests that an injected ID generator sets X-Request-Id and the log lines
+func TestRequestID(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+	next := 0
+	s.pollen.RequestID = func() string {
+		next++
+		return fmt.Sprintf("request-%d", next)
+	}
+
+	for i := 1; i <= 2; i++ {
+		res, err := http.Get(s.URL + "?challenge=xxx")
+		s.Assert(err == nil, "http client error:", err)
+		res.Body.Close()
+		expected := fmt.Sprintf("request-%d", i)
+		s.Assert(res.Header.Get("X-Request-Id") == expected, "expected:", expected, "got:", res.Header.Get("X-Request-Id"))
+	}
+	logs := s.logger.Logs()
+	s.Assert(len(logs) == 4, "expected 4 log messages, got:", logs)
+	for i, log := range logs {
+		expected := fmt.Sprintf(" request_id=request-%d ", i/2+1)
+		s.Assert(strings.Contains(log.message, expected), "expected", expected, "in:", log.message)
+	}
+}
+
+// TestRandomRequestID tests that request IDs are random by default
+func TestRandomRequestID(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+	ids := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		res, err := http.Get(s.URL + "?challenge=xxx")
+		s.Assert(err == nil, "http client error:", err)
+		res.Body.Close()
+		id := res.Header.Get("X-Request-Id")
+		s.Assert(len(id) == 16 && CheckHex(id) == nil, "expected 16 hex characters, got:", id)
+		ids[id] = true
+	}
+	s.Assert(len(ids) == 3, "expected unique request IDs, got:", ids)
+}
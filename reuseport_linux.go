@@ -0,0 +1,29 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+// soReusePort is SO_REUSEPORT, letting several processes bind one port,
+// which the kernel then balances connections across.  The syscall package
+// lacks it on some architectures, so it is spelled out, as in asm-generic,
+// which every Linux port of Go but MIPS follows.
+const soReusePort = 0xf
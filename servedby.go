@@ -0,0 +1,58 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+)
+
+var (
+	exposeSource  = flag.Bool("expose-source", false, "Name the source that served each seed, by its label, in an X-Entropy-Source header")
+	deviceLabel   = flag.String("device-label", "device", "The -expose-source label of -device")
+	fallbackLabel = flag.String("fallback-label", "fallback", "The -expose-source label of -fallback-device")
+	standbyLabel  = flag.String("standby-label", "standby", "The -expose-source label of -standby-device")
+)
+
+// sourceLabels are the labels of the sources that may serve a read, named
+// for operators rather than by their paths, which would leak the layout of
+// the host
+type sourceLabels struct {
+	device, fallback, standby string
+}
+
+// servedByKey holds a *string in a request's context, for readSources to
+// fill in with the label of the source that served it
+type servedByKey struct{}
+
+// withServedBy returns ctx, carrying a label that readSources fills in
+func withServedBy(ctx context.Context) (context.Context, *string) {
+	label := new(string)
+	return context.WithValue(ctx, servedByKey{}, label), label
+}
+
+// noteServedBy records the label of the source that served a read in ctx,
+// if it carries one
+func noteServedBy(ctx context.Context, label string) {
+	if servedBy, ok := ctx.Value(servedByKey{}).(*string); ok {
+		*servedBy = label
+	}
+}
@@ -0,0 +1,329 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// setupError names the step of setup that failed
+type setupError struct {
+	step string
+	err  error
+}
+
+func (e *setupError) Error() string {
+	return fmt.Sprintf("Cannot %s: %s", e.step, e.err)
+}
+
+func (e *setupError) Unwrap() error {
+	return e.err
+}
+
+// listeners are the sockets bound by setup, each nil if disabled, with the
+// certificate and session ticket keys of https, which setup loads while
+// their files may still be readable only by root
+type listeners struct {
+	monitoring  net.Listener
+	http        net.Listener
+	https       net.Listener
+	http3       net.PacketConn
+	dns         net.PacketConn
+	dnsTCP      net.Listener
+	certificate tls.Certificate
+	ticketKeys  [][32]byte
+}
+
+// takeListener returns *ln, leaving nil in its place, so that only the first
+// attempt of a supervised listener serves the socket bound by setup, and its
+// restarts bind anew.
+func takeListener[L any](ln *L) L {
+	first := *ln
+	var none L
+	*ln = none
+	return first
+}
+
+// setup builds the PollenServer from the flags, in the order that dropping
+// privileges afterward needs: it opens the devices and loads the TLS
+// certificate and keys first, since they may be readable only by root, then
+// binds the ports, since they may be privileged.
+// It returns a func closing everything it opened, or else an error naming
+// the step that failed, having closed whatever it had opened by then.
+func setup(log logger) (p *PollenServer, l *listeners, cleanup func(), err error) {
+	var closers []io.Closer
+	closeAll := func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i].Close()
+		}
+	}
+	defer func() {
+		if err != nil {
+			closeAll()
+		}
+	}()
+	var stuck *stuckDetector
+	if *stuckDetection > 0 {
+		stuck = newStuckDetector(max(*stuckDetection, 2))
+	}
+	var userAgent *regexp.Regexp
+	if *requireUserAgent != "" {
+		userAgent, err = regexp.Compile(*requireUserAgent)
+		if err != nil {
+			return nil, nil, nil, &setupError{"parse flags", fmt.Errorf("Invalid -require-user-agent: %s", err)}
+		}
+	}
+	if _, ok := challengeSources[*challengeSource]; !ok {
+		return nil, nil, nil, &setupError{"parse flags", fmt.Errorf("Unknown challenge source: %s", *challengeSource)}
+	}
+	if _, ok := challengeDecoders[*challengeDecode]; !ok {
+		return nil, nil, nil, &setupError{"parse flags", fmt.Errorf("Unknown challenge decoding: %s", *challengeDecode)}
+	}
+	durationPrecision, err := parseDurationPrecision(*logDurationPrecision)
+	if err != nil {
+		return nil, nil, nil, &setupError{"parse flags", err}
+	}
+	routes, err := parseSizeRoutes(*sizeRoutes)
+	if err != nil {
+		return nil, nil, nil, &setupError{"parse flags", err}
+	}
+	disabledEndpoints, err := parseDisabledEndpoints(*disableEndpoints)
+	if err != nil {
+		return nil, nil, nil, &setupError{"parse flags", err}
+	}
+	if *enablePprof && *monitoringAddr == "" {
+		return nil, nil, nil, &setupError{"parse flags", fmt.Errorf("-enable-pprof needs a private -monitoring-addr")}
+	}
+	if *maxBatch < 1 {
+		return nil, nil, nil, &setupError{"parse flags", fmt.Errorf("Invalid -max-batch: %d", *maxBatch)}
+	}
+	if *dnsMaxInflight < 1 {
+		return nil, nil, nil, &setupError{"parse flags", fmt.Errorf("Invalid -dns-max-inflight: %d", *dnsMaxInflight)}
+	}
+	newLimiter, ok := rateLimiters[*rateLimitBackend]
+	if !ok {
+		return nil, nil, nil, &setupError{"parse flags", fmt.Errorf("Unknown rate limit backend: %s", *rateLimitBackend)}
+	}
+	if *rateLimit > 0 && *rateLimitBurst < 1 {
+		return nil, nil, nil, &setupError{"parse flags", fmt.Errorf("Invalid -rate-limit-burst: %d", *rateLimitBurst)}
+	}
+	if *writeFailureSeverity != "err" && *writeFailureSeverity != "info" {
+		return nil, nil, nil, &setupError{"parse flags", fmt.Errorf("Unknown write failure severity: %s", *writeFailureSeverity)}
+	}
+	if *source == "device" && !*allowFileDevice {
+		paths := []string{*device}
+		if *mixDevices != "" {
+			paths = append(paths, strings.Split(*mixDevices, ",")...)
+		}
+		for _, path := range paths {
+			if err := validateDevice(path); err != nil {
+				return nil, nil, nil, &setupError{"open device", err}
+			}
+		}
+	}
+	open, ok := sources[*source]
+	if !ok {
+		return nil, nil, nil, &setupError{"parse flags", fmt.Errorf("Unknown random source: %s", *source)}
+	}
+	if unsafeSources[*source] {
+		log.Crit(fmt.Sprintf("The %s source is predictable, for load testing only, and must never serve production traffic", *source))
+	}
+	if *tlsPreferServerCiphers {
+		log.ErrKV("Ignoring -tls-prefer-server-ciphers, since Go orders TLS cipher suites itself", "at", time.Now().UnixNano())
+	}
+	dev, err := open()
+	if err != nil {
+		return nil, nil, nil, &setupError{"open device", err}
+	}
+	closers = append(closers, dev)
+	var mixSources []io.Reader
+	if *mixDevices != "" {
+		for _, path := range strings.Split(*mixDevices, ",") {
+			mixDev, err := os.Open(path)
+			if err != nil {
+				return nil, nil, nil, &setupError{"open device", err}
+			}
+			closers = append(closers, mixDev)
+			mixSources = append(mixSources, mixDev)
+		}
+	}
+	var randomSource io.ReadWriter = dev
+	if *deviceBufferSize > 0 {
+		randomSource = newBufferedSource(dev, *deviceBufferSize)
+	}
+	var fallback io.Reader
+	if *randomBlockTimeout > 0 {
+		fallbackDev, err := os.Open(*fallbackDevice)
+		if err != nil {
+			return nil, nil, nil, &setupError{"open fallback device", err}
+		}
+		closers = append(closers, fallbackDev)
+		fallback = fallbackDev
+	}
+	var standby *standbySource
+	if *standbyDevice != "" {
+		standbyDev, err := os.Open(*standbyDevice)
+		if err != nil {
+			return nil, nil, nil, &setupError{"open standby device", err}
+		}
+		closers = append(closers, standbyDev)
+		standby = newStandbySource(standbyDev)
+		if err := standby.check(); err != nil {
+			return nil, nil, nil, &setupError{"read standby device", err}
+		}
+	}
+	whiten, ok := whiteners[*whitening]
+	if !ok {
+		return nil, nil, nil, &setupError{"parse flags", fmt.Errorf("Unknown whitening: %s", *whitening)}
+	}
+	postprocessor, err := whiten()
+	if err != nil {
+		return nil, nil, nil, &setupError{"set up whitening", err}
+	}
+	var audit *auditLog
+	if *auditLRUSize > 0 {
+		var auditFile io.Writer
+		if *auditLogPath != "" {
+			f, err := os.OpenFile(*auditLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+			if err != nil {
+				return nil, nil, nil, &setupError{"open audit log", err}
+			}
+			closers = append(closers, f)
+			auditFile = f
+		}
+		audit = newAuditLog(auditFile, *auditLRUSize)
+	}
+	stirLength := *stirBytes
+	if stirLength == 0 {
+		stirLength = -1
+	}
+	var hook *webhook
+	if *webhookURL != "" {
+		hook = newWebhook(*webhookURL, *webhookQueue, log)
+	}
+	var queue *requestQueue
+	if *queueDepth > 0 {
+		queue = newRequestQueue(*queueDepth, *queueTimeout)
+	}
+	var recentSeeds *lru
+	if *seedRepeatCheck && *seedLRUSize > 0 {
+		recentSeeds = newLRU(*seedLRUSize)
+	}
+	p = &PollenServer{randomSource: randomSource, log: log, readSize: *size, sizeRoutes: routes,
+		strictChallenge: *strictChallenge, challengeLength: *strictChallengeLength, challengeDecode: *challengeDecode,
+		challengeSource:   *challengeSource,
+		maxChallengeBytes: *maxChallengeBytes,
+		challengePrefix:   *challengePrefix, hashChallengePrefix: *hashChallengePrefix, userAgent: userAgent, allowCIDRs: allowCIDRs, denyCIDRs: denyCIDRs,
+		readChunks: *readChunks, deviceReadTimeout: *deviceReadTimeout, Postprocessor: postprocessor, egressRate: *egressBytesPerSecond, padLength: *padResponses, connectionChaining: *connectionChaining, bindTLSSession: *bindTLSSession, responseHeaders: http.Header(responseHeaders),
+		rateLimit: *rateLimit, rateLimitBurst: *rateLimitBurst, RateLimiter: newLimiter(),
+		exposeSource: *exposeSource, sourceLabels: sourceLabels{*deviceLabel, *fallbackLabel, *standbyLabel},
+		mixSources: mixSources, readWorkers: *readWorkers, queue: queue,
+		retryAfter: *retryAfter, retryAfterJitter: *retryAfterJitter,
+		domainTag: *domainTag, domainTagChallenge: *domainTagChallenge, hmacKeyFile: *hmacKeyFile,
+		standby: standby, fallback: fallback, randomBlockTimeout: *randomBlockTimeout,
+		bodyChecksum: *bodyChecksum, entropyEstimate: *entropyEstimate, contentLength: *contentLength, audit: audit, recentSeeds: recentSeeds, stuck: stuck, adminToken: *adminToken, debugEndpoints: *enableDebugEndpoints, pprof: *enablePprof,
+		disabledEndpoints: disabledEndpoints, webhook: hook, hexGroup: *hexGroup, hexSeparator: *hexSeparator, durationPrecision: durationPrecision, logSampling: *logSampling,
+		writeFailureInfo: *writeFailureSeverity == "info", slowReadThreshold: *slowReadThreshold,
+		stirBytes: stirLength, stirMetadata: *stirMetadata, streamInterval: *streamInterval, streamIdleTimeout: *streamIdleTimeout,
+		maxStreams: *maxStreams, dnsMaxInflight: *dnsMaxInflight, maxCount: *maxCount, maxBatch: *maxBatch, maxBatchBytes: *maxBatchBytes, healthMinEntropy: *healthMinEntropy,
+		graceUntil: time.Now().Add(*startupGrace)}
+	if *hmacKeyFile != "" {
+		key, err := loadHMACKey(*hmacKeyFile)
+		if err != nil {
+			return nil, nil, nil, &setupError{"load HMAC key", err}
+		}
+		p.hmacKey.Store(&key)
+	}
+	if *responseMACKeyFile != "" {
+		if p.responseMACKey, err = loadHMACKey(*responseMACKeyFile); err != nil {
+			return nil, nil, nil, &setupError{"load response MAC key", err}
+		}
+	}
+	l = &listeners{}
+	bind := func(name, addr string, listen func(addr string) (net.Listener, error)) (net.Listener, error) {
+		ln, err := listen(addr)
+		if err != nil {
+			return nil, &setupError{"bind " + name, err}
+		}
+		closers = append(closers, ln)
+		return ln, nil
+	}
+	listenTCP := func(addr string) (net.Listener, error) {
+		return net.Listen("tcp", addr)
+	}
+	listenShared := func(addr string) (net.Listener, error) {
+		return listenConfig(*reusePort).Listen(context.Background(), "tcp", addr)
+	}
+	listenService := func(addr string) (net.Listener, error) {
+		return listen(addr, log)
+	}
+	if *monitoringAddr != "" {
+		if l.monitoring, err = bind("monitoring", *monitoringAddr, listenTCP); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	if *dnsPort != "" {
+		dnsAddr := fmt.Sprintf(":%s", *dnsPort)
+		if l.dns, err = listenConfig(*reusePort).ListenPacket(context.Background(), "udp", dnsAddr); err != nil {
+			return nil, nil, nil, &setupError{"bind dns", err}
+		}
+		closers = append(closers, l.dns)
+		if l.dnsTCP, err = bind("dns-tcp", dnsAddr, listenShared); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	if *httpPort != "" {
+		if l.http, err = bind("http", fmt.Sprintf(":%s", *httpPort), listenService); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	if *httpsPort != "" {
+		if l.certificate, err = tls.LoadX509KeyPair(*cert, *key); err != nil {
+			return nil, nil, nil, &setupError{"load certificate", err}
+		}
+		if *sessionTicketKeysFile != "" {
+			if l.ticketKeys, err = loadTicketKeys(*sessionTicketKeysFile); err != nil {
+				return nil, nil, nil, &setupError{"load session ticket keys", err}
+			}
+		}
+		if l.https, err = bind("https", fmt.Sprintf(":%s", *httpsPort), listenService); err != nil {
+			return nil, nil, nil, err
+		}
+		if bindHTTP3 != nil {
+			if l.http3, err = bindHTTP3(); err != nil {
+				return nil, nil, nil, &setupError{"bind http3", err}
+			}
+			if l.http3 != nil {
+				closers = append(closers, l.http3)
+			}
+		}
+	}
+	return p, l, closeAll, nil
+}
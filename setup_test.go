@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// setFlag sets the named flag for the rest of the test
+func setFlag(t *testing.T, name, value string) {
+	f := flag.Lookup(name)
+	old := f.Value.String()
+	if err := f.Value.Set(value); err != nil {
+		t.Fatal("cannot set", name, err)
+	}
+	t.Cleanup(func() { f.Value.Set(old) })
+}
+
+// TestSetupReportsFailingStep tests that setup names the step that failed,
+// and binds nothing when the device cannot be opened
+func TestSetupReportsFailingStep(t *testing.T) {
+	occupied, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal("cannot listen:", err)
+	}
+	defer occupied.Close()
+	_, busyPort, _ := net.SplitHostPort(occupied.Addr().String())
+
+	for _, tc := range []struct {
+		name, device, port, step string
+	}{
+		{"missing device", filepath.Join(t.TempDir(), "missing"), "0", "open device"},
+		{"busy port", "/dev/urandom", busyPort, "bind http"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setFlag(t, "device", tc.device)
+			setFlag(t, "http-port", tc.port)
+			setFlag(t, "https-port", "")
+			p, l, _, err := setup(&localLogger{})
+			var setupErr *setupError
+			if !errors.As(err, &setupErr) {
+				t.Fatal("expected a setup error, got:", err)
+			}
+			if setupErr.step != tc.step {
+				t.Errorf("expected the %s step to fail, got: %s", tc.step, err)
+			}
+			if p != nil || l != nil {
+				t.Error("expected no server or listeners on failure")
+			}
+		})
+	}
+
+	setFlag(t, "device", "/dev/urandom")
+	setFlag(t, "http-port", "0")
+	setFlag(t, "https-port", "")
+	p, l, cleanup, err := setup(&localLogger{})
+	if err != nil {
+		t.Fatal("setup error:", err)
+	}
+	defer cleanup()
+	if p.randomSource == nil || l.http == nil || l.https != nil {
+		t.Error("expected the device opened and only http bound, got:", p.randomSource, l)
+	}
+}
+
+// writeCertificate writes a self-signed certificate and its key to dir,
+// returning their paths
+func writeCertificate(t *testing.T, dir string) (certPath, keyPath string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("cannot generate key:", err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour), DNSNames: []string{"example.com"}}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("cannot create certificate:", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal("cannot marshal key:", err)
+	}
+	certPath, keyPath = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal("cannot write certificate:", err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal("cannot write key:", err)
+	}
+	return certPath, keyPath
+}
+
+// TestSetupLoadsTLS tests that setup loads the certificate and session
+// ticket keys of https, before privileges are dropped, and fails without them
+func TestSetupLoadsTLS(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeCertificate(t, dir)
+	ticketsPath := filepath.Join(dir, "tickets")
+	if err := ioutil.WriteFile(ticketsPath, []byte(TicketKeyA+"\n"), 0600); err != nil {
+		t.Fatal("cannot write ticket keys:", err)
+	}
+	setFlag(t, "device", "/dev/urandom")
+	setFlag(t, "http-port", "")
+	setFlag(t, "https-port", "0")
+	setFlag(t, "cert", certPath)
+	setFlag(t, "key", keyPath)
+	setFlag(t, "session-ticket-keys-file", ticketsPath)
+	_, l, cleanup, err := setup(&localLogger{})
+	if err != nil {
+		t.Fatal("setup error:", err)
+	}
+	cleanup()
+	if l.https == nil || len(l.certificate.Certificate) != 1 || len(l.ticketKeys) != 1 {
+		t.Error("expected https bound with its certificate and ticket keys, got:", l)
+	}
+
+	setFlag(t, "cert", filepath.Join(dir, "missing"))
+	_, _, _, err = setup(&localLogger{})
+	var setupErr *setupError
+	if !errors.As(err, &setupErr) || setupErr.step != "load certificate" {
+		t.Error("expected the certificate to fail to load, got:", err)
+	}
+}
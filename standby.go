@@ -0,0 +1,60 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// standbySource is a second random device, kept open and checked in the
+// background, that serves at once when the primary device fails.
+type standbySource struct {
+	dev     io.Reader
+	healthy atomic.Bool
+}
+
+func newStandbySource(dev io.Reader) *standbySource {
+	return &standbySource{dev: dev}
+}
+
+// check reads a byte from the standby, recording whether that worked
+func (s *standbySource) check() error {
+	var b [1]byte
+	_, err := io.ReadFull(s.dev, b[:])
+	s.healthy.Store(err == nil)
+	return err
+}
+
+// monitorStandby checks the standby every interval, logging as its health changes
+func (p *PollenServer) monitorStandby(interval time.Duration) {
+	for range time.Tick(interval) {
+		wasHealthy := p.standby.healthy.Load()
+		err := p.standby.check()
+		if err != nil && wasHealthy {
+			p.log.ErrKV("The standby device failed its health check", "error", err, "at", time.Now().UnixNano())
+		}
+		if err == nil && !wasHealthy {
+			p.log.InfoKV("The standby device passed its health check", "at", time.Now().UnixNano())
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestStandbyTakesOver tests that a checked standby serves as soon as the device fails
+func TestStandbyTakesOver(t *testing.T) {
+	s := NewSuiteWithDev(t, &FailingReader{bytes.NewBufferString("")})
+	defer s.TearDown()
+	standby := &CountingSource{ReadWriter: bytes.NewBufferString("!" + DilbertRandom)}
+	s.pollen.standby = newStandbySource(standby)
+	err := s.pollen.standby.check()
+	s.Assert(err == nil, "standby check error:", err)
+
+	res, err := http.Get(s.URL + "?challenge=pork+chop+sandwiches")
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	chal, seed, err := ReadResp(res.Body)
+	s.Assert(err == nil, "response error:", err)
+	s.Assert(chal == PorkChopSha512, "expected:", PorkChopSha512, "got:", chal)
+	expectedSeed := fmt.Sprintf("%x", cannedSeed())
+	s.Assert(seed == expectedSeed, "expected the standby's seed:", expectedSeed, "got:", seed)
+	s.Assert(standby.reads == 2, "expected the check and one read of the standby, got:", standby.reads)
+	found := false
+	for _, log := range s.logger.logs {
+		found = found || strings.HasPrefix(log.message, "Cannot read from random device, reading the standby")
+	}
+	s.Assert(found, "didn't log the failover, got:", s.logger.logs)
+}
+
+// TestUnhealthyStandby tests that a standby failing its check is not read
+func TestUnhealthyStandby(t *testing.T) {
+	s := NewSuiteWithDev(t, &FailingReader{bytes.NewBufferString("")})
+	defer s.TearDown()
+	s.pollen.standby = newStandbySource(&FailingReader{bytes.NewBufferString("")})
+	s.Assert(s.pollen.standby.check() != nil, "expected the standby check to fail")
+
+	res, err := http.Get(s.URL + "?challenge=xxx")
+	s.Assert(err == nil, "http client error:", err)
+	res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusInternalServerError, "expected 500 without a healthy standby, got:", res.Status)
+}
+
+// TestRandomBlockFallback tests that the fallback serves when the device blocks too long
+func TestRandomBlockFallback(t *testing.T) {
+	source := NewBlockingReader()
+	s := NewSuiteWithDev(t, source)
+	defer s.TearDown()
+	defer close(source.release)
+	s.pollen.fallback = bytes.NewBufferString(DilbertRandom)
+	s.pollen.randomBlockTimeout = 50 * time.Millisecond
+
+	start := time.Now()
+	res, err := http.Get(s.URL + "?challenge=pork+chop+sandwiches")
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	_, seed, err := ReadResp(res.Body)
+	s.Assert(err == nil, "response error:", err)
+	expectedSeed := fmt.Sprintf("%x", cannedSeed())
+	s.Assert(seed == expectedSeed, "expected the fallback's seed:", expectedSeed, "got:", seed)
+	s.Assert(time.Since(start) < 5*time.Second, "the fallback took too long:", time.Since(start))
+	found := false
+	for _, log := range s.logger.logs {
+		found = found || log.severity == "err" && strings.HasPrefix(log.message, "Random device blocked, reading the fallback")
+	}
+	s.Assert(found, "didn't log the fallback, got:", s.logger.logs)
+}
+
+// TestExposeSource tests that X-Entropy-Source names the labeled device, and
+// then the labeled standby once the device fails
+func TestExposeSource(t *testing.T) {
+	s := NewSuiteWithDev(t, &OnlyReader{bytes.NewBufferString(DilbertRandom)})
+	defer s.TearDown()
+	s.pollen.standby = newStandbySource(bytes.NewBufferString("!" + DilbertRandom))
+	err := s.pollen.standby.check()
+	s.Assert(err == nil, "standby check error:", err)
+	s.pollen.exposeSource = true
+	s.pollen.sourceLabels = sourceLabels{device: "hwrng", standby: "backup"}
+
+	for _, expected := range []string{"hwrng", "backup"} {
+		res, err := http.Get(s.URL + "?challenge=xxx")
+		s.Assert(err == nil, "http client error:", err)
+		res.Body.Close()
+		s.Assert(res.StatusCode == http.StatusOK, "expected 200, got:", res.Status)
+		s.Assert(res.Header.Get("X-Entropy-Source") == expected, "expected the source", expected, "got:", res.Header.Get("X-Entropy-Source"))
+	}
+
+	s.pollen.exposeSource = false
+	s.pollen.randomSource = &OnlyReader{bytes.NewBufferString(DilbertRandom)}
+	res, err := http.Get(s.URL + "?challenge=xxx")
+	s.Assert(err == nil, "http client error:", err)
+	res.Body.Close()
+	s.Assert(res.Header.Get("X-Entropy-Source") == "", "expected no source without -expose-source, got:", res.Header.Get("X-Entropy-Source"))
+}
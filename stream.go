@@ -0,0 +1,91 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// serveStream sends a server-sent event with a fresh seed for the challenge
+// every streamInterval, until the client goes away.  A client that stops
+// reading, without closing, is cut off once nothing could be written to it
+// for streamIdleTimeout, so that it cannot pin the stream or drain entropy.
+func (p *PollenServer) serveStream(w http.ResponseWriter, r *http.Request) {
+	challenge, ok := p.challenge(w, r)
+	if !ok {
+		return
+	}
+	/* Each stream drains entropy for as long as it is open */
+	defer p.metrics.activeStreams.Add(-1)
+	if streams := p.metrics.activeStreams.Add(1); p.maxStreams > 0 && streams > int64(p.maxStreams) {
+		p.log.InfoKV("Too many streams", "remote_addr", p.clientIP(r), "at", time.Now().UnixNano())
+		p.setRetryAfter(w)
+		http.Error(w, "Too many streams, please try again later", http.StatusServiceUnavailable)
+		return
+	}
+	binding, err := p.sessionBinding(r.TLS)
+	if err != nil {
+		p.log.ErrKV("Cannot export TLS keying material", "remote_addr", p.clientIP(r), "error", err, "at", time.Now().UnixNano())
+		http.Error(w, "Cannot bind the seed to the TLS session", http.StatusInternalServerError)
+		return
+	}
+	checksum := p.hashChallenge(challenge)
+	challengeResponse := checksum.Sum(nil)
+	p.stir(challengeResponse, p.clientIP(r))
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	controller := http.NewResponseController(w)
+	lastWrite := time.Now()
+	for {
+		checksum := p.hashChallenge(challenge)
+		checksum.Write(binding)
+		seed, err := p.readSeed(r.Context(), checksum)
+		if err != nil && err == r.Context().Err() {
+			return
+		}
+		if err != nil {
+			p.log.ErrKV("Cannot read from random device", "at", time.Now().UnixNano())
+			return
+		}
+		var event bytes.Buffer
+		encodeJSON(&event, challengeResponse, seed)
+		if p.streamIdleTimeout > 0 {
+			controller.SetWriteDeadline(lastWrite.Add(p.streamIdleTimeout))
+		}
+		_, err = fmt.Fprintf(w, "data: %s\n", event.Bytes())
+		if err == nil {
+			err = controller.Flush()
+		}
+		if err != nil {
+			p.log.InfoKV("Closing idle stream", "remote_addr", p.clientIP(r), "at", time.Now().UnixNano())
+			return
+		}
+		lastWrite = time.Now()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(p.streamInterval):
+		}
+	}
+}
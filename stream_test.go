@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestStream tests that /stream sends events with fresh seeds
+func TestStream(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+	s.pollen.streamInterval = time.Millisecond
+
+	res, err := http.Get(s.URL + "/stream?challenge=pork+chop+sandwiches")
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	s.Assert(res.Header.Get("Content-Type") == "text/event-stream", "wrong content type:", res.Header.Get("Content-Type"))
+	reader := bufio.NewReader(res.Body)
+	seeds := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		line, err := reader.ReadString('\n')
+		s.Assert(err == nil && strings.HasPrefix(line, "data: "), "expected an event, got:", line, err)
+		var event map[string]string
+		err = json.Unmarshal([]byte(line[len("data: "):]), &event)
+		s.Assert(err == nil, "json error:", err)
+		s.Assert(event["challenge_response"] == PorkChopSha512, "expected:", PorkChopSha512, "got:", event["challenge_response"])
+		s.SanityCheck(event["challenge_response"], event["seed"])
+		seeds[event["seed"]] = true
+		blank, err := reader.ReadString('\n')
+		s.Assert(err == nil && blank == "\n", "expected a blank line after the event, got:", blank, err)
+	}
+	s.Assert(len(seeds) == 3, "non-unique seeds")
+}
+
+// TestStreamIdle tests that a stream is torn down once its client stops reading
+func TestStreamIdle(t *testing.T) {
+	s := NewSuiteWithDev(t, StuckReader{})
+	defer s.TearDown()
+	s.pollen.streamInterval = 0
+	s.pollen.streamIdleTimeout = 100 * time.Millisecond
+
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	s.Assert(err == nil, "dial error:", err)
+	defer conn.Close()
+	/* Ask for a stream, then never read it */
+	fmt.Fprintf(conn, "GET /stream?challenge=xxx HTTP/1.1\r\nHost: pollen\r\n\r\n")
+	deadline := time.Now().Add(20 * time.Second)
+	closed := func() bool {
+		for _, log := range s.logger.Logs() {
+			if strings.HasPrefix(log.message, "Closing idle stream remote_addr=") {
+				return true
+			}
+		}
+		return false
+	}
+	for !closed() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Assert(closed(), "the idle stream wasn't closed")
+}
+
+// TestMaxStreams tests that streams beyond the limit get 503, until one closes
+func TestMaxStreams(t *testing.T) {
+	s := NewSuite(t)
+	defer s.TearDown()
+	s.pollen.streamInterval = 10 * time.Millisecond
+	s.pollen.maxStreams = 2
+
+	var streams []*http.Response
+	for i := 0; i < 2; i++ {
+		res, err := http.Get(s.URL + "/stream?challenge=xxx")
+		s.Assert(err == nil, "http client error:", err)
+		s.Assert(res.StatusCode == http.StatusOK, "expected stream", i, "to be served, got:", res.Status)
+		streams = append(streams, res)
+	}
+	res, err := http.Get(s.URL + "/stream?challenge=xxx")
+	s.Assert(err == nil, "http client error:", err)
+	res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusServiceUnavailable, "expected 503 beyond the limit, got:", res.Status)
+
+	streams[0].Body.Close()
+	deadline := time.Now().Add(10 * time.Second)
+	for s.pollen.metrics.activeStreams.Load() > 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	res, err = http.Get(s.URL + "/stream?challenge=xxx")
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	s.Assert(res.StatusCode == http.StatusOK, "expected a stream once one closed, got:", res.Status)
+	streams[1].Body.Close()
+}
@@ -0,0 +1,73 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// stuckDetector is a cheap tripwire for a stuck device, comparing a digest
+// of each read with that of the last, rather than testing its statistics.
+type stuckDetector struct {
+	// threshold is the identical reads in a row taken for a stuck device
+	threshold int
+
+	mu        sync.Mutex
+	last      uint64
+	identical int
+}
+
+func newStuckDetector(threshold int) *stuckDetector {
+	return &stuckDetector{threshold: threshold}
+}
+
+// observe records a read, returning how many reads in a row, including
+// this one, have been identical
+func (d *stuckDetector) observe(data []byte) int {
+	h := fnv.New64a()
+	h.Write(data)
+	sum := h.Sum64()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.identical > 0 && sum == d.last {
+		d.identical++
+	} else {
+		d.last = sum
+		d.identical = 1
+	}
+	return d.identical
+}
+
+// checkStuck holds the server out of readiness once the device has returned
+// threshold identical reads in a row, until it returns a different one.
+func (p *PollenServer) checkStuck(data []byte) {
+	identical := p.stuck.observe(data)
+	switch {
+	case identical == p.stuck.threshold:
+		p.log.Crit(flattenKV("Random device returned identical reads in a row, reporting not ready", []interface{}{"reads", identical, "at", time.Now().UnixNano()}))
+		p.stuckSource.Store(true)
+	case identical == 1 && p.stuckSource.Load():
+		p.log.InfoKV("Random device returned a different read, reporting ready", "at", time.Now().UnixNano())
+		p.stuckSource.Store(false)
+	}
+}
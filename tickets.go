@@ -0,0 +1,105 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// parseTicketKeys reads TLS session ticket keys, one 32 byte key in hex per
+// line, ignoring blank lines and # comments.  The first key encrypts new
+// tickets, and the rest only decrypt older ones, so keys are rotated by
+// adding a new first line and dropping the last.
+func parseTicketKeys(r io.Reader) ([][32]byte, error) {
+	var keys [][32]byte
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		var key [32]byte
+		decoded, err := hex.DecodeString(text)
+		if err != nil || len(decoded) != len(key) {
+			return nil, fmt.Errorf("Invalid session ticket key on line %d: must be %d hex characters", line, len(key)*2)
+		}
+		copy(key[:], decoded)
+		keys = append(keys, key)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("No session ticket keys")
+	}
+	return keys, nil
+}
+
+// loadTicketKeys reads the session ticket keys file at path
+func loadTicketKeys(path string) ([][32]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseTicketKeys(f)
+}
+
+// reloadTicketKeys reads the session ticket keys file at path, passing the
+// keys to set, such as a tls.Config's SetSessionTicketKeys.  If the file
+// cannot be read, set is not called and the previous keys stay in use.
+func reloadTicketKeys(path string, set func([][32]byte)) error {
+	keys, err := loadTicketKeys(path)
+	if err != nil {
+		return err
+	}
+	set(keys)
+	return nil
+}
+
+// reloadTicketKeysOnHangup reloads the session ticket keys of each of
+// configs from path on each SIGHUP, keeping the previous keys if that fails.
+// With -user, it runs after privileges are dropped, so path must be readable
+// by that user.
+func (p *PollenServer) reloadTicketKeysOnHangup(path string, configs ...*tls.Config) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	for range hangups {
+		if err := reloadTicketKeys(path, func(keys [][32]byte) {
+			for _, config := range configs {
+				config.SetSessionTicketKeys(keys)
+			}
+		}); err != nil {
+			p.log.ErrKV("Cannot reload session ticket keys", "path", path, "error", err, "at", time.Now().UnixNano())
+			continue
+		}
+		p.log.InfoKV("Reloaded session ticket keys", "path", path, "at", time.Now().UnixNano())
+	}
+}
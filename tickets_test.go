@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	TicketKeyA = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	TicketKeyB = "f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff000102030405060708090a0b0c0d0e0f"
+)
+
+// TestParseTicketKeys tests the session ticket keys file format
+func TestParseTicketKeys(t *testing.T) {
+	keys, err := parseTicketKeys(strings.NewReader("# current first\n" + TicketKeyB + "\n\n" + TicketKeyA + "\n"))
+	if err != nil {
+		t.Fatal("parse error:", err)
+	}
+	if len(keys) != 2 || keys[0][0] != 0xf0 || keys[1][31] != 0x1f {
+		t.Error("expected keys B and A, got:", keys)
+	}
+	for _, bad := range []string{"", "# nothing\n", "0001\n", "zz" + TicketKeyA[2:] + "\n"} {
+		if _, err := parseTicketKeys(strings.NewReader(bad)); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+// TestReloadTicketKeys tests that rotated keys are picked up, and bad files ignored
+func TestReloadTicketKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tickets")
+	var current [][32]byte
+	set := func(keys [][32]byte) {
+		current = keys
+	}
+	if err := ioutil.WriteFile(path, []byte(TicketKeyA+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadTicketKeys(path, set); err != nil || len(current) != 1 || current[0][0] != 0x00 {
+		t.Fatal("expected key A, got:", current, err)
+	}
+	/* Rotate in key B, keeping A to decrypt older tickets */
+	if err := ioutil.WriteFile(path, []byte(TicketKeyB+"\n"+TicketKeyA+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadTicketKeys(path, set); err != nil || len(current) != 2 || current[0][0] != 0xf0 {
+		t.Fatal("expected keys B and A, got:", current, err)
+	}
+	if err := ioutil.WriteFile(path, []byte("garbage\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadTicketKeys(path, set); err == nil || len(current) != 2 {
+		t.Error("expected a bad file to keep keys B and A, got:", current, err)
+	}
+	os.Remove(path)
+	if err := reloadTicketKeys(path, set); err == nil || len(current) != 2 {
+		t.Error("expected a missing file to keep keys B and A, got:", current, err)
+	}
+}
@@ -0,0 +1,37 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import "crypto/tls"
+
+// newTLSConfig returns the HTTPS server's TLS configuration.  Session tickets
+// are disabled unless there are shared ticket keys to set, and renegotiation,
+// a known denial of service vector, is refused explicitly, although Go's
+// servers never renegotiate anyway.  The order of cipher suites is left to
+// Go, which has ignored PreferServerCipherSuites since 1.18.
+func newTLSConfig(ticketKeys bool) *tls.Config {
+	return &tls.Config{
+		MinVersion:             tls.VersionTLS10,
+		NextProtos:             []string{"h2", "http/1.1", pollenProto},
+		SessionTicketsDisabled: !ticketKeys,
+		Renegotiation:          tls.RenegotiateNever,
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestTLSConfig tests the TLS configuration built for the flags
+func TestTLSConfig(t *testing.T) {
+	for _, tickets := range []bool{false, true} {
+		config := newTLSConfig(tickets)
+		if config.MinVersion != tls.VersionTLS10 {
+			t.Error("expected TLS 1.0 at least, got:", config.MinVersion)
+		}
+		if config.SessionTicketsDisabled == tickets {
+			t.Error("expected SessionTicketsDisabled", !tickets)
+		}
+		if config.Renegotiation != tls.RenegotiateNever {
+			t.Error("expected renegotiation to be refused, got:", config.Renegotiation)
+		}
+	}
+}
+
+// TestServerCipherOrder tests that the server picks the cipher suite by its
+// own order, not the client's, which is why -tls-prefer-server-ciphers has
+// nothing left to do
+func TestServerCipherOrder(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.NotFoundHandler())
+	server.TLS = newTLSConfig(false)
+	server.StartTLS()
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	/* The client puts CBC first, which Go ranks below GCM */
+	conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{
+		RootCAs: roots, ServerName: "example.com", MaxVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+	})
+	if err != nil {
+		t.Fatal("tls error:", err)
+	}
+	defer conn.Close()
+	if suite := conn.ConnectionState().CipherSuite; suite != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Error("expected the server's choice of AES-GCM, got:", tls.CipherSuiteName(suite))
+	}
+}
+
+// TestPreferServerCiphersIgnored tests that setup warns that
+// -tls-prefer-server-ciphers does nothing
+func TestPreferServerCiphersIgnored(t *testing.T) {
+	setFlag(t, "tls-prefer-server-ciphers", "true")
+	setFlag(t, "device", "/dev/urandom")
+	setFlag(t, "http-port", "0")
+	setFlag(t, "https-port", "")
+	log := &localLogger{}
+	_, _, cleanup, err := setup(log)
+	if err != nil {
+		t.Fatal("setup error:", err)
+	}
+	defer cleanup()
+	for _, entry := range log.Logs() {
+		if entry.severity == "err" && strings.HasPrefix(entry.message, "Ignoring -tls-prefer-server-ciphers") {
+			return
+		}
+	}
+	t.Error("expected a warning that the flag is ignored, got:", log.Logs())
+}
@@ -0,0 +1,40 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"crypto/sha512"
+	"crypto/tls"
+)
+
+// tlsExporterLabel labels the keying material pollen exports, per RFC 5705
+const tlsExporterLabel = "EXPORTER-pollen-seed"
+
+// sessionBinding returns keying material exported from the TLS session of
+// a request or pollen/1 connection, to mix into each seed served on it if
+// bindTLSSession, after the challenge, so that the seed is tied to that
+// session.  Plain HTTP requests, with no state, have none.
+func (p *PollenServer) sessionBinding(state *tls.ConnectionState) ([]byte, error) {
+	if !p.bindTLSSession || state == nil {
+		return nil, nil
+	}
+	return state.ExportKeyingMaterial(tlsExporterLabel, nil, sha512.Size)
+}
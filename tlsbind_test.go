@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestBindTLSSession tests that two TLS sessions sending the same challenge,
+// and reading the same device bytes, get different seeds
+func TestBindTLSSession(t *testing.T) {
+	s := NewSuiteWithDev(t, bytes.NewBufferString(strings.Repeat(DilbertRandom, 3)))
+	defer s.TearDown()
+	s.pollen.bindTLSSession = true
+	server := httptest.NewUnstartedServer(s.pollen.mux())
+	server.TLS = newTLSConfig(false)
+	server.StartTLS()
+	defer server.Close()
+
+	get := func() (string, string) {
+		/* Each client has its own connection, so its own session */
+		client := server.Client()
+		client.Transport = client.Transport.(*http.Transport).Clone()
+		res, err := client.Get(server.URL + "?challenge=pork+chop+sandwiches")
+		if err != nil {
+			t.Fatal("http client error:", err)
+		}
+		defer res.Body.Close()
+		chal, seed, err := ReadResp(res.Body)
+		s.Assert(err == nil, "response error:", err)
+		return chal, seed
+	}
+	chal, first := get()
+	_, second := get()
+	s.Assert(chal == PorkChopSha512, "expected an unchanged challenge response, got:", chal)
+	_, unbound := mix("pork chop sandwiches", []byte(DilbertRandom))
+	s.Assert(first != fmt.Sprintf("%x", unbound), "expected the seed bound to the session, got:", first)
+	s.Assert(first != second, "expected different sessions to get different seeds, got:", first)
+
+	/* Plain HTTP has no session to bind */
+	res, err := http.Get(s.URL + "?challenge=pork+chop+sandwiches")
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	_, seed, err := ReadResp(res.Body)
+	s.Assert(err == nil, "response error:", err)
+	s.Assert(seed == fmt.Sprintf("%x", unbound), "expected an unbound seed over HTTP, got:", seed)
+}
+
+// boundSeed is the seed of the pork chop sandwiches challenge and the canned
+// device bytes, bound to a TLS session by its exported keying material
+func boundSeed(t *testing.T, state *tls.ConnectionState) []byte {
+	if state == nil {
+		t.Fatal("expected a TLS session")
+	}
+	binding, err := state.ExportKeyingMaterial(tlsExporterLabel, nil, sha512.Size)
+	if err != nil {
+		t.Fatal("cannot export keying material:", err)
+	}
+	sum := sha512.New()
+	io.WriteString(sum, "pork chop sandwiches")
+	sum.Write(binding)
+	io.WriteString(sum, DilbertRandom)
+	return sum.Sum(nil)
+}
+
+// newBoundServer returns a TLS server of s binding seeds to TLS sessions,
+// with pollen/1 configured
+func newBoundServer(s *Suite) *httptest.Server {
+	s.pollen.bindTLSSession = true
+	server := httptest.NewUnstartedServer(s.pollen.mux())
+	s.pollen.configureALPN(server.Config)
+	server.TLS = newTLSConfig(false)
+	server.StartTLS()
+	return server
+}
+
+// TestBindTLSSessionBatch tests that /batch binds its seeds to the session
+func TestBindTLSSessionBatch(t *testing.T) {
+	s := NewSuiteWithDev(t, bytes.NewBufferString(DilbertRandom))
+	defer s.TearDown()
+	s.pollen.maxBatch = 4
+	server := newBoundServer(s)
+	defer server.Close()
+
+	res, err := server.Client().Post(server.URL+"/batch", "application/json", strings.NewReader(`["pork chop sandwiches"]`))
+	if err != nil {
+		t.Fatal("http client error:", err)
+	}
+	defer res.Body.Close()
+	var responses []batchResponse
+	if err := json.NewDecoder(res.Body).Decode(&responses); err != nil || len(responses) != 1 {
+		t.Fatal("cannot decode batch:", responses, err)
+	}
+	s.Assert(responses[0].ChallengeResponse == PorkChopSha512, "expected an unchanged challenge response, got:", responses[0].ChallengeResponse)
+	s.Assert(responses[0].Seed == fmt.Sprintf("%x", boundSeed(t, res.TLS)), "expected the seed bound to the session, got:", responses[0].Seed)
+}
+
+// TestBindTLSSessionStream tests that /stream binds its seeds to the session
+func TestBindTLSSessionStream(t *testing.T) {
+	s := NewSuiteWithDev(t, bytes.NewBufferString(DilbertRandom))
+	defer s.TearDown()
+	server := newBoundServer(s)
+	defer server.Close()
+
+	res, err := server.Client().Get(server.URL + "/stream?challenge=pork+chop+sandwiches")
+	if err != nil {
+		t.Fatal("http client error:", err)
+	}
+	defer res.Body.Close()
+	line, err := bufio.NewReader(res.Body).ReadString('\n')
+	s.Assert(err == nil && strings.HasPrefix(line, "data: "), "expected an event, got:", line, err)
+	var event map[string]string
+	err = json.Unmarshal([]byte(line[len("data: "):]), &event)
+	s.Assert(err == nil, "json error:", err)
+	s.Assert(event["seed"] == fmt.Sprintf("%x", boundSeed(t, res.TLS)), "expected the seed bound to the session, got:", event["seed"])
+}
+
+// TestBindTLSSessionPollenProto tests that pollen/1 binds its seeds to the
+// session of its connection
+func TestBindTLSSessionPollenProto(t *testing.T) {
+	s := NewSuiteWithDev(t, bytes.NewBufferString(DilbertRandom))
+	defer s.TearDown()
+	server := newBoundServer(s)
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "example.com", NextProtos: []string{pollenProto}})
+	if err != nil {
+		t.Fatal("tls error:", err)
+	}
+	defer conn.Close()
+	_, err = conn.Write(appendFrame(nil, []byte("pork chop sandwiches")))
+	s.Assert(err == nil, "write error:", err)
+	status := make([]byte, 1)
+	_, err = conn.Read(status)
+	s.Assert(err == nil && status[0] == pollenProtoOK, "expected success, got:", status, err)
+	_, err = readFrame(conn)
+	s.Assert(err == nil, "read error:", err)
+	seed, err := readFrame(conn)
+	s.Assert(err == nil, "read error:", err)
+	state := conn.ConnectionState()
+	s.Assert(bytes.Equal(seed, boundSeed(t, &state)), "expected the seed bound to the session, got:", seed)
+}
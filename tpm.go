@@ -0,0 +1,121 @@
+//go:build tpm
+
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+var tpmDevice = flag.String("tpm-device", "/dev/tpm0", "The TPM device to use with -source tpm")
+
+const (
+	tpmTagNoSessions  = 0x8001
+	tpmCommandRandom  = 0x0000017b
+	tpmHeaderSize     = 10
+	tpmMaxRandomBytes = 32
+)
+
+func init() {
+	sources["tpm"] = func() (io.ReadWriteCloser, error) {
+		dev, err := os.OpenFile(*tpmDevice, os.O_RDWR, 0)
+		if err != nil {
+			return nil, err
+		}
+		return &tpmSource{transport: dev}, nil
+	}
+}
+
+// tpmSource reads random bytes from a TPM 2.0 using its GetRandom command.
+// The TPM cannot be stirred, so writes are accepted and discarded.
+type tpmSource struct {
+	// mu holds each command and its response together, since the TPM
+	// answers whichever command came last
+	mu        sync.Mutex
+	transport io.ReadWriter
+}
+
+func (t *tpmSource) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		got, err := t.getRandom(p[n:])
+		n += got
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (t *tpmSource) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (t *tpmSource) Close() error {
+	if closer, ok := t.transport.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// getRandom issues a single TPM2_GetRandom command, filling as much of p as
+// the TPM returns.
+func (t *tpmSource) getRandom(p []byte) (int, error) {
+	want := len(p)
+	if want > tpmMaxRandomBytes {
+		want = tpmMaxRandomBytes
+	}
+	cmd := make([]byte, tpmHeaderSize+2)
+	binary.BigEndian.PutUint16(cmd[0:], tpmTagNoSessions)
+	binary.BigEndian.PutUint32(cmd[2:], uint32(len(cmd)))
+	binary.BigEndian.PutUint32(cmd[6:], tpmCommandRandom)
+	binary.BigEndian.PutUint16(cmd[10:], uint16(want))
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, err := t.transport.Write(cmd); err != nil {
+		return 0, err
+	}
+	/* The TPM returns the whole response to a single read */
+	resp := make([]byte, tpmHeaderSize+2+tpmMaxRandomBytes)
+	n, err := t.transport.Read(resp)
+	if err != nil {
+		return 0, err
+	}
+	resp = resp[:n]
+	if len(resp) < tpmHeaderSize+2 {
+		return 0, fmt.Errorf("tpm: short response of %d bytes", len(resp))
+	}
+	if rc := binary.BigEndian.Uint32(resp[6:]); rc != 0 {
+		return 0, fmt.Errorf("tpm: GetRandom failed with response code 0x%x", rc)
+	}
+	size := int(binary.BigEndian.Uint16(resp[tpmHeaderSize:]))
+	random := resp[tpmHeaderSize+2:]
+	if size == 0 || size > len(random) || size > len(p) {
+		return 0, fmt.Errorf("tpm: invalid GetRandom size %d", size)
+	}
+	return copy(p, random[:size]), nil
+}
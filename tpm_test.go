@@ -0,0 +1,102 @@
+//go:build tpm
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// fakeTPM answers every GetRandom command with bytes of fill, returning at
+// most limit bytes per command.  Like a TPM, it refuses a command while the
+// response to the last is unread.
+type fakeTPM struct {
+	fill     byte
+	limit    int
+	commands int
+	pending  []byte
+}
+
+func (f *fakeTPM) Write(cmd []byte) (int, error) {
+	if f.pending != nil {
+		return 0, errors.New("tpm: busy")
+	}
+	f.commands++
+	want := int(binary.BigEndian.Uint16(cmd[tpmHeaderSize:]))
+	if want > f.limit {
+		want = f.limit
+	}
+	resp := make([]byte, tpmHeaderSize+2+want)
+	binary.BigEndian.PutUint16(resp[0:], tpmTagNoSessions)
+	binary.BigEndian.PutUint32(resp[2:], uint32(len(resp)))
+	binary.BigEndian.PutUint16(resp[tpmHeaderSize:], uint16(want))
+	copy(resp[tpmHeaderSize+2:], bytes.Repeat([]byte{f.fill}, want))
+	f.pending = resp
+	return len(cmd), nil
+}
+
+func (f *fakeTPM) Read(p []byte) (int, error) {
+	n := copy(p, f.pending)
+	f.pending = nil
+	return n, nil
+}
+
+// TestTPMSourceFillsBuffer asserts a read is filled across several GetRandom commands
+func TestTPMSourceFillsBuffer(t *testing.T) {
+	fake := &fakeTPM{fill: 9, limit: 24}
+	tpm := &tpmSource{transport: fake}
+	data := make([]byte, 64)
+	n, err := tpm.Read(data)
+	if err != nil || n != len(data) {
+		t.Fatalf("expected %d bytes, got %d: %v", len(data), n, err)
+	}
+	if !bytes.Equal(data, bytes.Repeat([]byte{9}, len(data))) {
+		t.Error("buffer not filled with tpm bytes:", data)
+	}
+	if fake.commands != 3 {
+		t.Error("expected 3 GetRandom commands, got:", fake.commands)
+	}
+	if n, err := tpm.Write([]byte("stir")); n != 4 || err != nil {
+		t.Error("write should be a no-op, got:", n, err)
+	}
+}
+
+// TestTPMSourceServes asserts the handler serves seeds from the TPM
+func TestTPMSourceServes(t *testing.T) {
+	s := NewSuiteWithDev(t, &tpmSource{transport: &fakeTPM{fill: 9, limit: 32}})
+	defer s.TearDown()
+
+	res, err := http.Get(s.URL + "?challenge=xxx")
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	chal, seed, err := ReadResp(res.Body)
+	s.Assert(err == nil, "response err:", err)
+	s.SanityCheck(chal, seed)
+}
+
+// TestTPMSourceConcurrent asserts concurrent reads never interleave their
+// commands and responses
+func TestTPMSourceConcurrent(t *testing.T) {
+	tpm := &tpmSource{transport: &fakeTPM{fill: 9, limit: 24}}
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data := make([]byte, 64)
+			if _, err := tpm.Read(data); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error("read error:", err)
+	}
+}
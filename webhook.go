@@ -0,0 +1,135 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// webhookEvent summarizes a completed request for the webhook
+type webhookEvent struct {
+	RemoteAddr string  `json:"remote_addr"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Status     int     `json:"status"`
+	Duration   float64 `json:"duration"`
+	Bytes      int64   `json:"bytes"`
+	At         int64   `json:"at"`
+}
+
+// webhook POSTs events as JSON to url, one at a time, from a bounded queue
+// so that a slow or failing receiver never holds up a request.
+type webhook struct {
+	url    string
+	client *http.Client
+	events chan webhookEvent
+	log    logger
+}
+
+func newWebhook(url string, queue int, log logger) *webhook {
+	h := &webhook{url: url, client: &http.Client{Timeout: 5 * time.Second}, events: make(chan webhookEvent, queue), log: log}
+	go h.run()
+	return h
+}
+
+// send queues an event, dropping it if the queue is full
+func (h *webhook) send(event webhookEvent) {
+	select {
+	case h.events <- event:
+	default:
+		h.log.ErrKV("Dropped webhook event, the queue is full", "remote_addr", event.RemoteAddr, "at", time.Now().UnixNano())
+	}
+}
+
+func (h *webhook) run() {
+	for event := range h.events {
+		body, _ := json.Marshal(event)
+		res, err := h.client.Post(h.url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			h.log.ErrKV("Cannot post webhook event", "error", err, "at", time.Now().UnixNano())
+			continue
+		}
+		res.Body.Close()
+	}
+}
+
+// recordingWriter records the status and size of a response
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Write(p []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	n, err := rw.ResponseWriter.Write(p)
+	rw.bytes += int64(n)
+	return n, err
+}
+
+func (rw *recordingWriter) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets an http.ResponseController reach the underlying connection
+func (rw *recordingWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// notifyWebhook sends the webhook a summary of each request h completes,
+// if there is a webhook
+func (p *PollenServer) notifyWebhook(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p.webhook == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		recorder := &recordingWriter{ResponseWriter: w}
+		h.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		p.webhook.send(webhookEvent{
+			RemoteAddr: p.clientIP(r),
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Status:     recorder.status,
+			Duration:   time.Since(start).Seconds(),
+			Bytes:      recorder.bytes,
+			At:         time.Now().UnixNano(),
+		})
+	})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestWebhook tests that a completed request is summarized to the webhook
+func TestWebhook(t *testing.T) {
+	events := make(chan webhookEvent, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event webhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Error("json error:", err)
+		}
+		events <- event
+	}))
+	defer receiver.Close()
+	s := NewSuiteWithDev(t, bytes.NewBufferString(DilbertRandom))
+	defer s.TearDown()
+	s.pollen.webhook = newWebhook(receiver.URL, 1, s.logger)
+	s.Config.Handler = s.pollen.mux()
+
+	res, err := http.Get(s.URL + "?challenge=pork+chop+sandwiches")
+	s.Assert(err == nil, "http client error:", err)
+	res.Body.Close()
+	select {
+	case event := <-events:
+		s.Assert(strings.HasPrefix(event.RemoteAddr, "127.0.0.1:"), "wrong remote_addr:", event.RemoteAddr)
+		s.Assert(event.Method == "GET" && event.Path == "/", "wrong request:", event.Method, event.Path)
+		s.Assert(event.Status == http.StatusOK, "wrong status:", event.Status)
+		s.Assert(event.Bytes == int64(2*(2*64+1)), "wrong bytes:", event.Bytes)
+		s.Assert(event.Duration > 0 && event.At > 0, "missing times:", event.Duration, event.At)
+	case <-time.After(10 * time.Second):
+		t.Fatal("the webhook never received the event")
+	}
+}
+
+// TestWebhookDrops tests that events beyond the queue are dropped and logged, never blocking
+func TestWebhookDrops(t *testing.T) {
+	logger := &localLogger{}
+	hook := &webhook{events: make(chan webhookEvent, 1), log: logger}
+	hook.send(webhookEvent{RemoteAddr: "first"})
+	hook.send(webhookEvent{RemoteAddr: "second"})
+	logs := logger.Logs()
+	if len(logs) != 1 || !strings.HasPrefix(logs[0].message, "Dropped webhook event, the queue is full remote_addr=second") {
+		t.Error("expected the drop to be logged, got:", logs)
+	}
+}
@@ -0,0 +1,91 @@
+/*
+
+pollen: Entropy-as-a-Server web server
+
+  Copyright (C) 2012-2013 Dustin Kirkland <dustin.kirkland@gmail.com>
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU Affero General Public License as published by
+  the Free Software Foundation, version 3 of the License.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU Affero General Public License for more details.
+
+  You should have received a copy of the GNU Affero General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"sync"
+)
+
+// whiteners maps the -whitening names to functions building that
+// PollenServer.Postprocessor.  A nil Postprocessor leaves the bytes as read.
+var whiteners = map[string]func() (func([]byte) []byte, error){
+	"none": func() (func([]byte) []byte, error) {
+		return nil, nil
+	},
+	"vonneumann": func() (func([]byte) []byte, error) {
+		return vonNeumann, nil
+	},
+	"aes-ctr": newAESCTR,
+}
+
+// vonNeumann debiases data by taking each pair of bits, emitting the first
+// bit of a 01 or 10 pair and discarding 00 and 11 pairs.  Only whole output
+// bytes are returned.
+func vonNeumann(data []byte) []byte {
+	var out []byte
+	var current byte
+	bits := 0
+	for _, b := range data {
+		for shift := 6; shift >= 0; shift -= 2 {
+			pair := (b >> uint(shift)) & 3
+			if pair != 1 && pair != 2 {
+				continue
+			}
+			current = current<<1 | pair>>1
+			bits++
+			if bits == 8 {
+				out = append(out, current)
+				current, bits = 0, 0
+			}
+		}
+	}
+	return out
+}
+
+// newAESCTR returns a whitener encrypting data with AES-256 in CTR mode,
+// under a random key and IV that continue across requests.
+func newAESCTR() (func([]byte) []byte, error) {
+	key := make([]byte, 32)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	stream := cipher.NewCTR(block, iv)
+	var mu sync.Mutex
+	return func(data []byte) []byte {
+		out := make([]byte, len(data))
+		mu.Lock()
+		stream.XORKeyStream(out, data)
+		mu.Unlock()
+		return out
+	}, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+)
+
+// TestPostprocessor tests that the seed is mixed from the post-processed bytes
+func TestPostprocessor(t *testing.T) {
+	s := NewSuiteWithDev(t, bytes.NewBufferString(DilbertRandom))
+	defer s.TearDown()
+
+	s.pollen.Postprocessor = bytes.ToUpper
+	res, err := http.Get(s.URL + "?challenge=pork+chop+sandwiches")
+	s.Assert(err == nil, "http client error:", err)
+	defer res.Body.Close()
+	chal, seed, err := ReadResp(res.Body)
+	s.Assert(err == nil, "response error:", err)
+	s.Assert(chal == PorkChopSha512, "expected:", PorkChopSha512, "got:", chal)
+	expectedSum := sha512.New()
+	io.WriteString(expectedSum, "pork chop sandwiches")
+	io.WriteString(expectedSum, "NINENINENINENINENINENINENINENINENINENINENINENINENINENINENINENINE")
+	expectedSeed := fmt.Sprintf("%x", expectedSum.Sum(nil))
+	s.Assert(seed == expectedSeed, "expected:", expectedSeed, "got:", seed)
+}
+
+// TestVonNeumann tests Von Neumann debiasing of known bit pairs
+func TestVonNeumann(t *testing.T) {
+	// 0x9c is the pairs 10 01 11 00, giving the bits 1 0
+	// 0x66 is the pairs 01 10 01 10, giving the bits 0 1 0 1
+	in := []byte{0x9c, 0x9c, 0x9c, 0x9c, 0x66, 0x66, 0x66, 0x66}
+	out := vonNeumann(in)
+	if !bytes.Equal(out, []byte{0xaa, 0x55, 0x55}) {
+		t.Errorf("expected aa5555, got: %x", out)
+	}
+	if len(vonNeumann([]byte{0x00, 0xff})) != 0 {
+		t.Error("constant bits must be discarded")
+	}
+}
+
+// TestAESCTR tests that the aes-ctr whitener never repeats its output
+func TestAESCTR(t *testing.T) {
+	whiten, err := newAESCTR()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := whiten([]byte(DilbertRandom))
+	second := whiten([]byte(DilbertRandom))
+	if len(first) != len(DilbertRandom) || bytes.Equal(first, second) || bytes.Equal(first, []byte(DilbertRandom)) {
+		t.Error("aes-ctr did not whiten the input")
+	}
+}